@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+
+	"github.com/magodo/terrafix/internal/report"
+)
+
+// The exit codes of check, which are distinct from 1 of any fatal error (e.g. an invalid argument, or a crash of
+// the fixer), so that a check that fails to run is not taken as one that finds changes.
+const (
+	checkExitFailure = 2
+	checkExitChange  = 3
+)
+
+type CheckFlagSet struct {
+	CommonFlagSet
+	Format string
+}
+
+func runCheck(args []string) {
+	var fset CheckFlagSet
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	fset.register(fs)
+	fs.StringVar(&fset.Format, "format", "human", `The output format, which can be "human" or "json"`)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, `usage: terrafix check [options] root-module-path
+
+check runs the fixes in memory without writing anything, and lists the blocks and references that would change.
+It exits with 3 if there is any change, 2 if there is any failure (with "--keep-going"), 1 on any other error,
+or 0 if nothing would change.
+`)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if l := len(fs.Args()); l != 1 {
+		log.Fatalf("expects one argument, got=%d", l)
+	}
+	if err := fset.validate(); err != nil {
+		log.Fatal(err)
+	}
+	if fset.Format != "human" && fset.Format != "json" {
+		log.Fatalf(`unsupported "--format": %s`, fset.Format)
+	}
+
+	ctx := context.Background()
+
+	c, closeFn := newController(&fset.CommonFlagSet, fs.Arg(0), false)
+	runFixes(ctx, c, &fset.CommonFlagSet)
+	rpt, err := c.Report()
+	closeFn()
+	if err != nil {
+		log.Fatalf("building report: %v", err)
+	}
+
+	printDiagnostics(rpt)
+
+	switch fset.Format {
+	case "json":
+		err = rpt.WriteJSON(os.Stdout)
+	default:
+		err = writeCheckResult(os.Stdout, rpt)
+	}
+	if err != nil {
+		log.Fatalf("writing check result: %v", err)
+	}
+
+	if len(rpt.Failures) != 0 {
+		os.Exit(checkExitFailure)
+	}
+	if len(rpt.Modules) != 0 {
+		os.Exit(checkExitChange)
+	}
+}
+
+// writeCheckResult writes the changes and failures of the report in the human readable format, one per line.
+func writeCheckResult(w io.Writer, r *report.Report) error {
+	var n int
+	for _, mod := range r.Modules {
+		for _, f := range mod.Files {
+			for _, change := range f.Changes {
+				n++
+				msg := fmt.Sprintf("%s would change", change.Address)
+				if change.Phase == report.PhaseReference {
+					msg = fmt.Sprintf("reference to %s %s would change: %s -> %s", change.BlockType, change.BlockName, change.OldContent, change.NewContent)
+				}
+				if _, err := fmt.Fprintf(w, "%s:%d,%d: [%s] %s\n",
+					path.Join(mod.Path, f.Name), change.Range.Start.Line, change.Range.Start.Column, change.Phase, msg); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for _, failure := range r.Failures {
+		if _, err := fmt.Fprintf(w, "[%s] failed: %s\n", failure.Phase, failure); err != nil {
+			return err
+		}
+	}
+	if n == 0 && len(r.Failures) == 0 {
+		_, err := fmt.Fprintln(w, "All the configurations are migrated.")
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%d change(s), %d failure(s)\n", n, len(r.Failures))
+	return err
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-version"
+	"github.com/hashicorp/terraform-exec/tfexec"
+	tfjson "github.com/hashicorp/terraform-json"
+	tfaddr "github.com/hashicorp/terraform-registry-address"
+	"github.com/magodo/terrafix/internal/ctrl"
+	"github.com/magodo/terrafix/internal/fixer"
+	"github.com/magodo/terrafix/internal/providerschema"
+	"github.com/magodo/terrafix/internal/report"
+	"github.com/magodo/terrafix/internal/terraform/find"
+	"github.com/magodo/terraform-client-go/tfclient"
+)
+
+// CommonFlagSet is the flags shared by the fix and the check commands
+type CommonFlagSet struct {
+	Providers         providerFlags
+	ProviderPath      string
+	ProviderAddr      string
+	Fixer             string
+	Record            string
+	OldProviders      providerFlags
+	SchemaFile        string
+	StateFile         string
+	Workspace         string
+	Parallelism       int
+	KeepGoing         bool
+	Includes          patternFlags
+	Excludes          patternFlags
+	LogLevel          string
+	SkipFixReference  bool
+	SkipFixDefinition bool
+}
+
+func (fset *CommonFlagSet) register(fs *flag.FlagSet) {
+	fs.Var(&fset.Providers, "provider", `The target provider in form of "<fully qualified provider address>=<path to the provider executable>" (e.g. registry.terraform.io/hashicorp/azurerm=/path/to/terraform-provider-azurerm), or "<fully qualified provider address>=<fixer>" (see "--fixer"), which can be specified multiple times`)
+	fs.StringVar(&fset.ProviderAddr, "provider-addr", "", `The fully qualified provider address (e.g. registry.terraform.io/hashicorp/azurerm), only valid with "--provider-path" or "--fixer"`)
+	fs.StringVar(&fset.Fixer, "fixer", "", `The fixer of the provider specified by "--provider-addr", instead of the provider executable, in form of "rules:<path to the YAML/HCL rules file>", "script:<path to the Starlark script>", "rpc:<path to the JSON-RPC fixer executable>" or "replay:<path to the file recorded by --record>"`)
+	fs.StringVar(&fset.Record, "record", "", `The file to record the requests and responses of the fixers to (one JSON per line), which can be replayed offline by "--fixer replay:<file>", e.g. to reproduce a fixer bug without the provider`)
+	fs.StringVar(&fset.ProviderPath, "provider-path", "", `The path to the target provider executable (a shorthand of "--provider" for a single provider)`)
+	fs.Var(&fset.OldProviders, "old-provider", `The provider currently used by the configuration in form of "<fully qualified provider address>=<path to the provider executable>", whose schema is fetched from the executable directly instead of via terraform (no "terraform init" or terraform executable is needed), which can be specified multiple times`)
+	fs.StringVar(&fset.SchemaFile, "provider-schema-file", "", `The file of the saved "terraform providers schema -json" output of the providers currently used by the configuration, which is used instead of calling terraform (no "terraform init" or terraform executable is needed)`)
+	fs.StringVar(&fset.StateFile, "state-file", "", `The state file (e.g. a snapshot pulled by "terraform state pull") to read the resource states from (by default reads from the configured backend)`)
+	fs.StringVar(&fset.Workspace, "workspace", "", "The workspace to read the resource states from (by default the currently selected workspace)")
+	fs.IntVar(&fset.Parallelism, "parallelism", 1, "The max number of concurrent fixer calls")
+	fs.BoolVar(&fset.KeepGoing, "keep-going", false, "Continue on the blocks that failed to be fixed (and skip the modules that failed to be loaded), and print a summary of the failures (exits with 2 if there is any failure)")
+	fs.Var(&fset.Includes, "include", `Only fix the blocks (and the references to them) that match the pattern, which is a glob of the resource type (e.g. "azurerm_virtual_network*"), the full address if containing "." (e.g. "module.net.azurerm_subnet.a") or the module path if containing "/" (e.g. "./modules/*"), and can be specified multiple times`)
+	fs.Var(&fset.Excludes, "exclude", `Do not fix the blocks (and the references to them) that match the pattern (same syntax as "--include", and takes precedence over it), which can be specified multiple times`)
+	fs.StringVar(&fset.LogLevel, "log-level", hclog.Error.String(), "The log level")
+	fs.BoolVar(&fset.SkipFixReference, "skip-fix-reference", false, "Whether to skip fixing the reference")
+	fs.BoolVar(&fset.SkipFixDefinition, "skip-fix-definition", false, "Whether to skip fixing the definition")
+}
+
+func (fset *CommonFlagSet) validate() error {
+	if fset.ProviderPath == "" && fset.Fixer == "" && len(fset.Providers) == 0 {
+		return fmt.Errorf(`none of "--provider", "--provider-path" and "--fixer" is specified`)
+	}
+	if fset.ProviderAddr != "" && fset.ProviderPath == "" && fset.Fixer == "" {
+		return fmt.Errorf(`"--provider-addr" is only valid with "--provider-path" or "--fixer"`)
+	}
+	if fset.Fixer != "" {
+		if fset.ProviderPath != "" {
+			return fmt.Errorf(`"--fixer" conflicts with "--provider-path"`)
+		}
+		if fset.ProviderAddr == "" {
+			return fmt.Errorf(`"--fixer" requires "--provider-addr"`)
+		}
+		if kind, _ := fixerKind(fset.Fixer); kind == "" {
+			return fmt.Errorf(`invalid "--fixer" %q`, fset.Fixer)
+		}
+	}
+	if fset.StateFile != "" && fset.Workspace != "" {
+		return fmt.Errorf(`"--state-file" conflicts with "--workspace"`)
+	}
+	if fset.offline() && fset.Workspace != "" {
+		return fmt.Errorf(`"--workspace" conflicts with "--old-provider" and "--provider-schema-file"`)
+	}
+	if fset.Parallelism < 1 {
+		return fmt.Errorf(`"--parallelism" must be at least 1`)
+	}
+	return nil
+}
+
+// targetProviders returns the target providers in form of "<provider address>=<provider path>", including the one
+// specified by "--provider-path".
+func (fset *CommonFlagSet) targetProviders() []string {
+	providers := fset.Providers
+	if fset.ProviderPath != "" {
+		addr := fset.ProviderAddr
+		if addr == "" {
+			// Deduce the provider address via the provider executable name,
+			// and assuming it is namespaced by hashicorp.
+			// This is a shorthand only for hashicorp owned providers.
+			addr = "registry.terraform.io/hashicorp/" +
+				strings.TrimPrefix(filepath.Base(fset.ProviderPath), "terraform-provider-")
+		}
+		providers = append(providers, addr+"="+fset.ProviderPath)
+	}
+	if fset.Fixer != "" {
+		providers = append(providers, fset.ProviderAddr+"="+fset.Fixer)
+	}
+	return providers
+}
+
+// fixerKind returns the kind of the fixer and its argument, e.g. "rules" and "path/to/rules.yaml" for
+// "rules:path/to/rules.yaml". It returns an empty kind for the path to a provider executable.
+func fixerKind(fixer string) (string, string) {
+	kind, arg, ok := strings.Cut(fixer, ":")
+	if !ok {
+		return "", fixer
+	}
+	switch kind {
+	case "rules", "script", "rpc", "replay":
+		return kind, arg
+	default:
+		return "", fixer
+	}
+}
+
+// newFixer creates the fixer of the target provider, which is either specified by the fixer kind (see fixerKind),
+// or the provider executable at path. The returned function releases the fixer.
+func newFixer(path, logLevel string) (fixer.Fixer, func(), error) {
+	// Test purpose
+	if path == "terrafix-dummy" {
+		return &fixer.DummyFixer{}, func() {}, nil
+	}
+	switch kind, arg := fixerKind(path); kind {
+	case "rules":
+		fx, err := fixer.NewRuleFixer(arg)
+		if err != nil {
+			return nil, nil, err
+		}
+		return fx, func() {}, nil
+	case "script":
+		fx, err := fixer.NewScriptFixer(arg)
+		if err != nil {
+			return nil, nil, err
+		}
+		return fx, func() {}, nil
+	case "rpc":
+		fx, err := fixer.NewRPCFixer(arg)
+		if err != nil {
+			return nil, nil, err
+		}
+		return fx, fx.Close, nil
+	case "replay":
+		fx, err := fixer.NewReplayFixer(arg)
+		if err != nil {
+			return nil, nil, err
+		}
+		return fx, func() {}, nil
+	}
+	c, err := newProviderClient(path, logLevel)
+	if err != nil {
+		return nil, nil, err
+	}
+	fx, err := fixer.NewProviderFixer(c)
+	if err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+	return fx, c.Close, nil
+}
+
+// offline tells whether the provider schemas are obtained without terraform.
+func (fset *CommonFlagSet) offline() bool {
+	return len(fset.OldProviders) != 0 || fset.SchemaFile != ""
+}
+
+// providerSchemas returns the schemas of the providers currently used by the configuration, loaded from the schema
+// file and the old provider executables (which take precedence).
+func (fset *CommonFlagSet) providerSchemas() (*tfjson.ProviderSchemas, error) {
+	schs := &tfjson.ProviderSchemas{
+		FormatVersion: providerschema.FormatVersion,
+		Schemas:       map[string]*tfjson.ProviderSchema{},
+	}
+	if fset.SchemaFile != "" {
+		fschs, err := providerschema.LoadFile(fset.SchemaFile)
+		if err != nil {
+			return nil, err
+		}
+		schs = fschs
+	}
+	for _, p := range fset.OldProviders {
+		addr, path, _ := strings.Cut(p, "=")
+		paddr, err := tfaddr.ParseProviderSource(addr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse provider addr %q: %v", addr, err)
+		}
+		c, err := newProviderClient(path, fset.LogLevel)
+		if err != nil {
+			return nil, err
+		}
+		sch, err := providerschema.FromClient(c)
+		c.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", paddr, err)
+		}
+		schs.Schemas[paddr.String()] = sch
+	}
+	return schs, nil
+}
+
+// newProviderClient starts the provider executable at path, and returns the client connected to it.
+func newProviderClient(path, logLevel string) (tfclient.Client, error) {
+	return tfclient.New(tfclient.Option{
+		Cmd: exec.Command(path),
+		Logger: hclog.New(&hclog.LoggerOptions{
+			Output: hclog.DefaultOutput,
+			Level:  hclog.LevelFromString(logLevel),
+			Name:   filepath.Base(path),
+		}),
+	})
+}
+
+// newController creates the controller for the root module, with a fixer for each target provider.
+// The returned function closes the provider connections.
+func newController(fset *CommonFlagSet, modulePath string, includeExternalModules bool) (*ctrl.Controller, func()) {
+	providers := fset.targetProviders()
+
+	var (
+		tf   *tfexec.Terraform
+		schs *tfjson.ProviderSchemas
+		err  error
+	)
+	if fset.offline() {
+		schs, err = fset.providerSchemas()
+		if err != nil {
+			log.Fatalf("obtaining provider schemas: %v", err)
+		}
+	} else {
+		tfpath, err := find.FindTF(context.Background(), version.MustConstraints(version.NewConstraint(">=1.0.0")))
+		if err != nil {
+			log.Fatalf("finding terraform executable: %v", err)
+		}
+		tf, err = tfexec.NewTerraform(modulePath, tfpath)
+		if err != nil {
+			log.Fatalf("error running NewTerraform: %s", err)
+		}
+	}
+
+	var recorder *fixer.Recorder
+	if fset.Record != "" {
+		recorder, err = fixer.NewRecorder(fset.Record)
+		if err != nil {
+			log.Fatalf("creating the record file: %v", err)
+		}
+	}
+
+	var (
+		popts   []ctrl.Provider
+		closers []func()
+	)
+	closeFn := func() {
+		for _, c := range closers {
+			c()
+		}
+		// Closed after the fixers, which might be recording until then
+		if recorder != nil {
+			if err := recorder.Close(); err != nil {
+				log.Printf("closing the record file: %v", err)
+			}
+		}
+	}
+	for _, p := range providers {
+		addr, path, _ := strings.Cut(p, "=")
+		paddr, err := tfaddr.ParseProviderSource(addr)
+		if err != nil {
+			log.Fatalf("failed to parse provider addr %q: %v", addr, err)
+		}
+
+		fx, closer, err := newFixer(path, fset.LogLevel)
+		if err != nil {
+			closeFn()
+			log.Fatalf("new fixer for %s: %v", paddr, err)
+		}
+		closers = append(closers, closer)
+		if recorder != nil {
+			fx = fixer.NewRecordingFixer(fx, recorder)
+		}
+		popts = append(popts, ctrl.Provider{Addr: paddr, Fixer: fx})
+	}
+
+	c, err := ctrl.NewController(ctrl.Option{
+		Path:                   modulePath,
+		Providers:              popts,
+		TF:                     tf,
+		ProviderSchemas:        schs,
+		IncludeExternalModules: includeExternalModules,
+		StateFile:              fset.StateFile,
+		Workspace:              fset.Workspace,
+		Parallelism:            fset.Parallelism,
+		KeepGoing:              fset.KeepGoing,
+		Include:                fset.Includes,
+		Exclude:                fset.Excludes,
+	})
+	if err != nil {
+		closeFn()
+		log.Fatal(err)
+	}
+	return c, closeFn
+}
+
+// runFixes fixes the reference origins and then the definitions, unless skipped.
+func runFixes(ctx context.Context, c *ctrl.Controller, fset *CommonFlagSet) {
+	if !fset.SkipFixReference {
+		if err := c.FixReferenceOrigins(ctx); err != nil {
+			log.Fatal(err)
+		}
+
+		if err := c.UpdateRootState(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if !fset.SkipFixDefinition {
+		if err := c.FixDefinition(ctx); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// printDiagnostics prints the diagnostics from the fixers, and the skipped blocks and reference origins to the stderr.
+func printDiagnostics(r *report.Report) {
+	for _, diag := range r.Diagnostics {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", diag.Severity, diag)
+	}
+	for _, skip := range r.Skipped {
+		fmt.Fprintf(os.Stderr, "skipped: [%s] %s\n", skip.Phase, skip)
+	}
+}
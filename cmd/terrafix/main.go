@@ -6,41 +6,60 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 
-	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/go-version"
-	"github.com/hashicorp/terraform-exec/tfexec"
 	tfaddr "github.com/hashicorp/terraform-registry-address"
 	"github.com/magodo/terrafix/internal/ctrl"
 	"github.com/magodo/terrafix/internal/fixer"
+	"github.com/magodo/terrafix/internal/report"
 	"github.com/magodo/terrafix/internal/terraform/find"
-	"github.com/magodo/terraform-client-go/tfclient"
 )
 
 type FlagSet struct {
-	ProviderPath      string
-	ProviderAddr      string
-	Output            string
-	LogLevel          string
-	SkipFixReference  bool
-	SkipFixDefinition bool
+	CommonFlagSet
+	Output    string
+	Diff      bool
+	Write     bool
+	Backup    bool
+	Report    string
+	ReportOut string
+	VendorDir string
+	Fmt       bool
+	Validate  bool
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "restore":
+			runRestore(os.Args[2:])
+			return
+		case "check":
+			runCheck(os.Args[2:])
+			return
+		}
+	}
+
 	var fset FlagSet
 
-	flag.StringVar(&fset.ProviderAddr, "provider-addr", "", "The fully qualified provider address (e.g. registry.terraform.io/hashicorp/azurerm)")
-	flag.StringVar(&fset.ProviderPath, "provider-path", "", "The path to the target provider executable")
+	fset.register(flag.CommandLine)
 	flag.StringVar(&fset.Output, "output", "", "The output folder where the updated configs will be written to (by default writes to the stdout)")
-	flag.StringVar(&fset.LogLevel, "log-level", hclog.Error.String(), "The log level")
-	flag.BoolVar(&fset.SkipFixReference, "skip-fix-reference", false, "Whether to skip fixing the reference")
-	flag.BoolVar(&fset.SkipFixDefinition, "skip-fix-definition", false, "Whether to skip fixing the definition")
+	flag.BoolVar(&fset.Diff, "diff", false, "Print the unified diff of the changed files instead of the whole files (exits with 1 if there is any change)")
+	flag.BoolVar(&fset.Write, "write", false, "Write the changed files back to their original paths")
+	flag.BoolVar(&fset.Backup, "backup", false, `Keep a backup of each changed file with the ".terrafix.bak" suffix (only valid with "--write"), which can be restored by "terrafix restore". An existing backup (e.g. of an earlier run) is kept`)
+	flag.StringVar(&fset.Report, "report", "", `The format of the report of the applied changes, which can only be "json" for now (by default no report)`)
+	flag.StringVar(&fset.ReportOut, "report-out", "", "The file where the report will be written to (by default writes to the stderr)")
+	flag.StringVar(&fset.VendorDir, "vendor-dir", "", "Also fix the external modules installed under .terraform/modules, and write the changed ones to this folder (the module cache is never modified)")
+
+	flag.BoolVar(&fset.Fmt, "fmt", false, `Format the blocks touched by the fixes, the same as "terraform fmt" (the untouched blocks are left as is)`)
+	flag.BoolVar(&fset.Validate, "validate", false, `Run "terraform validate" against a temporary copy of the fixed configurations with the target providers, and report the diagnostics (exits with 2 if there is any error)`)
 
 	flag.Usage = func() {
 		fmt.Fprint(os.Stderr, `usage: terrafix [options] root-module-path
+       terrafix check [options] root-module-path
+       terrafix restore root-module-path
 
 terrafix fixes user's terraform configurations to match the targeting provider's schema.
 `)
@@ -51,84 +70,93 @@ terrafix fixes user's terraform configurations to match the targeting provider's
 	if l := len(flag.Args()); l != 1 {
 		log.Fatalf("expects one argument, got=%d", l)
 	}
-	if fset.ProviderPath == "" {
-		log.Fatal(`"--provider-path" is not specified`)
+	if err := fset.validate(); err != nil {
+		log.Fatal(err)
+	}
+	if fset.Diff && fset.Output != "" {
+		log.Fatal(`"--diff" conflicts with "--output"`)
+	}
+	if fset.Write && (fset.Diff || fset.Output != "") {
+		log.Fatal(`"--write" conflicts with "--diff" and "--output"`)
+	}
+	if fset.Backup && !fset.Write {
+		log.Fatal(`"--backup" is only valid with "--write"`)
+	}
+	if fset.Report != "" && fset.Report != "json" {
+		log.Fatalf(`unsupported "--report" format: %s`, fset.Report)
+	}
+	if fset.ReportOut != "" && fset.Report == "" {
+		log.Fatal(`"--report-out" is only valid with "--report"`)
 	}
 
 	ctx := context.Background()
 
-	modulePath := flag.Arg(0)
-	if fset.ProviderAddr == "" {
-		// Deduce the provider address via the provider executable name,
-		// and assuming it is namespaced by hashicorp.
-		// This is a shorthand only for hashicorp owned providers.
-		fset.ProviderAddr = "registry.terraform.io/hashicorp/" +
-			strings.TrimPrefix(filepath.Base(fset.ProviderPath), "terraform-provider-")
-	}
+	ctrl, closeFn := newController(&fset.CommonFlagSet, flag.Arg(0), fset.VendorDir != "")
+	defer closeFn()
 
-	tfpath, err := find.FindTF(context.Background(), version.MustConstraints(version.NewConstraint(">=1.0.0")))
-	if err != nil {
-		log.Fatalf("finding terraform executable: %v", err)
-	}
-	tf, err := tfexec.NewTerraform(modulePath, tfpath)
-	if err != nil {
-		log.Fatalf("error running NewTerraform: %s", err)
-	}
-
-	var fx fixer.Fixer
-	// Test purpose
-	if fset.ProviderPath == "terrafix-dummy" {
-		fx = &fixer.DummyFixer{}
-	} else {
-		opts := tfclient.Option{
-			Cmd: exec.Command(fset.ProviderPath),
-			Logger: hclog.New(&hclog.LoggerOptions{
-				Output: hclog.DefaultOutput,
-				Level:  hclog.LevelFromString(fset.LogLevel),
-				Name:   filepath.Base(fset.ProviderPath),
-			}),
-		}
-		c, err := tfclient.New(opts)
-		if err != nil {
-			log.Fatal(err)
+	runFixes(ctx, ctrl, &fset.CommonFlagSet)
+
+	if fset.Fmt {
+		if _, err := ctrl.Format(); err != nil {
+			log.Fatalf("formatting: %v", err)
 		}
-		defer c.Close()
+	}
 
-		fx, err = fixer.NewProviderFixer(c)
-		if err != nil {
-			log.Fatalf("new provider fixer: %v", err)
+	if fset.Validate {
+		if err := runValidate(ctx, ctrl, &fset.CommonFlagSet); err != nil {
+			log.Fatalf("validating: %v", err)
 		}
 	}
 
-	paddr, err := tfaddr.ParseProviderSource(fset.ProviderAddr)
+	rpt, err := ctrl.Report()
 	if err != nil {
-		log.Fatalf("failed to parse provider addr %q: %v", fset.ProviderAddr, err)
+		log.Fatalf("building report: %v", err)
 	}
 
-	ctrl, err := ctrl.NewController(ctrl.Option{
-		Path:         modulePath,
-		ProviderAddr: paddr,
-		TF:           tf,
-		Fixer:        fx,
-	})
-	if err != nil {
-		log.Fatal(err)
+	printDiagnostics(rpt)
+
+	if fset.Report != "" {
+		if err := writeReport(rpt, fset.ReportOut); err != nil {
+			log.Fatalf("writing report: %v", err)
+		}
 	}
 
-	if !fset.SkipFixReference {
-		if err := ctrl.FixReferenceOrigins(ctx); err != nil {
-			log.Fatal(err)
+	if fset.VendorDir != "" {
+		if _, err := ctrl.WriteExternalModules(fset.VendorDir); err != nil {
+			log.Fatalf("writing external modules: %v", err)
 		}
+		for _, mod := range rpt.ExternalModules {
+			rp, err := filepath.Rel(filepath.Join(".terraform", "modules"), mod.Dir)
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Fprintf(os.Stderr, "External module %q (%s) needs to be patched by its owner, fixed copy written to %s\n",
+				mod.Key, mod.Source, filepath.Join(fset.VendorDir, rp))
+		}
+	}
 
-		if err := ctrl.UpdateRootState(); err != nil {
+	if fset.Diff {
+		changed, err := ctrl.Diff(os.Stdout)
+		if err != nil {
 			log.Fatal(err)
 		}
+		exitOnFailures(rpt)
+		if changed {
+			os.Exit(1)
+		}
+		return
 	}
 
-	if !fset.SkipFixDefinition {
-		if err := ctrl.FixDefinition(ctx); err != nil {
+	if fset.Write {
+		paths, err := ctrl.WriteInPlace(fset.Backup)
+		if err != nil {
 			log.Fatal(err)
 		}
+		for _, path := range paths {
+			fmt.Fprintf(os.Stderr, "Updated %s\n", path)
+		}
+		exitOnFailures(rpt)
+		return
 	}
 
 	var odir *string
@@ -139,4 +167,100 @@ terrafix fixes user's terraform configurations to match the targeting provider's
 	if err := ctrl.Write(odir); err != nil {
 		log.Fatal(err)
 	}
+	exitOnFailures(rpt)
+}
+
+// exitOnFailures prints a summary of the failures (in the continue-on-error mode) to the stderr, and exits with 2
+// if there is any failure, or any error reported by "terraform validate".
+func exitOnFailures(r *report.Report) {
+	var invalid bool
+	for _, diag := range r.Diagnostics {
+		if diag.Phase == report.PhaseValidate && diag.Severity == fixer.SeverityError {
+			invalid = true
+			break
+		}
+	}
+	if len(r.Failures) == 0 && !invalid {
+		return
+	}
+	if len(r.Failures) != 0 {
+		fmt.Fprintf(os.Stderr, "%d failure(s):\n", len(r.Failures))
+		for _, failure := range r.Failures {
+			fmt.Fprintf(os.Stderr, "  [%s] %s\n", failure.Phase, failure)
+		}
+	}
+	if invalid {
+		fmt.Fprintln(os.Stderr, "terraform validate reported errors against the fixed configurations")
+	}
+	os.Exit(2)
+}
+
+// runValidate runs "terraform validate" against the fixed configurations, with the target providers.
+func runValidate(ctx context.Context, c *ctrl.Controller, fset *CommonFlagSet) error {
+	tfpath, err := find.FindTF(ctx, version.MustConstraints(version.NewConstraint(">=1.0.0")))
+	if err != nil {
+		return fmt.Errorf("finding terraform executable: %v", err)
+	}
+	paths := map[tfaddr.Provider]string{}
+	for _, p := range fset.targetProviders() {
+		addr, path, _ := strings.Cut(p, "=")
+		// Only the provider executables can be used by terraform
+		if kind, _ := fixerKind(path); kind != "" || path == "terrafix-dummy" {
+			continue
+		}
+		paddr, err := tfaddr.ParseProviderSource(addr)
+		if err != nil {
+			return fmt.Errorf("failed to parse provider addr %q: %v", addr, err)
+		}
+		paths[paddr] = path
+	}
+	_, err = c.Validate(ctx, tfpath, paths)
+	return err
+}
+
+// writeReport writes the report in JSON format to the file at path, or to the stderr if path is empty.
+func writeReport(r *report.Report, path string) error {
+	if path == "" {
+		return r.WriteJSON(os.Stderr)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := r.WriteJSON(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// providerFlags is the value of the repeatable "--provider" flag
+type providerFlags []string
+
+func (p *providerFlags) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *providerFlags) Set(v string) error {
+	addr, path, ok := strings.Cut(v, "=")
+	if !ok || addr == "" || path == "" {
+		return fmt.Errorf(`expects the form "<provider address>=<provider path>", got %q`, v)
+	}
+	*p = append(*p, v)
+	return nil
+}
+
+// patternFlags is the value of the repeatable "--include"/"--exclude" flag
+type patternFlags []string
+
+func (p *patternFlags) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *patternFlags) Set(v string) error {
+	if v == "" {
+		return fmt.Errorf("expects a non-empty pattern")
+	}
+	*p = append(*p, v)
+	return nil
 }
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/magodo/terrafix/internal/filesystem"
+)
+
+// runRestore runs the "restore" subcommand, which moves the backup files created by "--write --backup"
+// back to their original paths.
+func runRestore(args []string) {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, `usage: terrafix restore root-module-path
+
+restore moves the backup files created by "terrafix --write --backup" back to their original paths.
+`)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if l := len(fs.Args()); l != 1 {
+		log.Fatalf("expects one argument, got=%d", l)
+	}
+
+	paths, err := filesystem.RestoreBackups(fs.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, path := range paths {
+		fmt.Fprintf(os.Stderr, "Restored %s\n", path)
+	}
+}
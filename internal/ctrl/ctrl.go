@@ -1,44 +1,76 @@
 package ctrl
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"maps"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
 
 	"github.com/hashicorp/hcl-lang/lang"
 	"github.com/hashicorp/hcl-lang/reference"
 	"github.com/hashicorp/hcl/v2"
 	"github.com/hashicorp/hcl/v2/hclsyntax"
 	"github.com/hashicorp/terraform-exec/tfexec"
-	tfjson "github.com/hashicorp/terraform-json"
-	tfschema "github.com/hashicorp/terraform-schema/schema"
+	tfaddr "github.com/hashicorp/terraform-registry-address"
 	"github.com/magodo/terrafix/internal/filesystem"
+	"github.com/magodo/terrafix/internal/filter"
 	"github.com/magodo/terrafix/internal/fixer"
+	"github.com/magodo/terrafix/internal/jsonconfig"
+	"github.com/magodo/terrafix/internal/report"
 	"github.com/magodo/terrafix/internal/state"
+	"github.com/magodo/terrafix/internal/terraform/datadir"
 	"github.com/magodo/terrafix/internal/writer"
 )
 
 type Controller struct {
 	tf        *tfexec.Terraform
 	fs        *filesystem.MemFS
-	psch      *tfschema.ProviderSchema
-	pschJSON  *tfjson.ProviderSchema
+	providers []*provider
 	path      string
 	rootState *state.RootState
-	fixer     fixer.Fixer
+	stateOpt  state.Option
+	report    report.Report
+	// The max number of concurrent fixer calls
+	parallelism int
+	// Whether to continue on the per-block failures, which are recorded in the report
+	keepGoing bool
+	// The filter of the blocks to fix
+	filter *filter.Filter
 }
 
 func NewController(opt Option) (*Controller, error) {
 	ctrl := Controller{
-		tf:    opt.TF,
-		path:  opt.Path,
-		fixer: opt.Fixer,
+		tf:          opt.TF,
+		path:        opt.Path,
+		parallelism: opt.Parallelism,
+		keepGoing:   opt.KeepGoing,
+		stateOpt: state.Option{
+			IncludeExternalModules: opt.IncludeExternalModules,
+			StateFile:              opt.StateFile,
+			Workspace:              opt.Workspace,
+			ProviderSchemas:        opt.ProviderSchemas,
+			KeepGoing:              opt.KeepGoing,
+		},
 	}
 
-	fs, err := filesystem.NewMemFS(opt.Path, os.Stdout)
+	flt, err := filter.New(opt.Include, opt.Exclude)
+	if err != nil {
+		return nil, err
+	}
+	ctrl.filter = flt
+
+	newMemFS := filesystem.NewMemFS
+	if opt.IncludeExternalModules {
+		newMemFS = filesystem.NewMemFSWithModuleCache
+	}
+	fs, err := newMemFS(opt.Path, os.Stdout)
 	if err != nil {
 		return nil, fmt.Errorf("error new memory filesystem: %v", err)
 	}
@@ -47,33 +79,56 @@ func NewController(opt Option) (*Controller, error) {
 	if err := ctrl.UpdateRootState(); err != nil {
 		return nil, err
 	}
+	// The same module calls are skipped when the root state is updated later, only report them once.
+	for _, mcErr := range ctrl.rootState.ModuleCallErrors {
+		ctrl.report.AddFailure(report.Failure{
+			Phase:   report.PhaseLoad,
+			Module:  mcErr.Path,
+			Address: mcErr.Addr,
+			Error:   mcErr.Err.Error(),
+		})
+	}
 
-	paddr := opt.ProviderAddr
-	pschJSON, ok := ctrl.rootState.ProviderSchemasJSON.Schemas[paddr.String()]
-	if !ok {
-		possibles := []string{}
-		for v := range maps.Keys(ctrl.rootState.ProviderSchemasJSON.Schemas) {
-			possibles = append(possibles, v)
-		}
-		return nil, fmt.Errorf("no provider schema (JSON) defined for %s, possible values include %v", paddr, possibles)
+	if len(opt.Providers) == 0 {
+		return nil, fmt.Errorf("no target provider specified")
 	}
-	ctrl.pschJSON = pschJSON
+	for _, popt := range opt.Providers {
+		paddr := popt.Addr
+		if ctrl.providerByAddr(paddr) != nil {
+			return nil, fmt.Errorf("duplicated target provider %s", paddr)
+		}
 
-	psch, ok := ctrl.rootState.ProviderSchemas[paddr]
-	if !ok {
-		possibles := []string{}
-		for v := range maps.Keys(ctrl.rootState.ProviderSchemas) {
-			possibles = append(possibles, v.String())
+		pschJSON, ok := ctrl.rootState.ProviderSchemasJSON.Schemas[paddr.String()]
+		if !ok {
+			possibles := []string{}
+			for v := range maps.Keys(ctrl.rootState.ProviderSchemasJSON.Schemas) {
+				possibles = append(possibles, v)
+			}
+			return nil, fmt.Errorf("no provider schema (JSON) defined for %s, possible values include %v", paddr, possibles)
+		}
+
+		psch, ok := ctrl.rootState.ProviderSchemas[paddr]
+		if !ok {
+			possibles := []string{}
+			for v := range maps.Keys(ctrl.rootState.ProviderSchemas) {
+				possibles = append(possibles, v.String())
+			}
+			return nil, fmt.Errorf("no provider schema defined for %s, possible values include %v", paddr, possibles)
 		}
-		return nil, fmt.Errorf("no provider schema defined for %s, possible values include %v", paddr, possibles)
+
+		ctrl.providers = append(ctrl.providers, &provider{
+			addr:     paddr,
+			fixer:    popt.Fixer,
+			psch:     psch,
+			pschJSON: pschJSON,
+		})
 	}
-	ctrl.psch = psch
 
 	return &ctrl, nil
 }
 
 func (ctrl *Controller) UpdateRootState() error {
-	rootState, err := state.NewRootState(ctrl.tf, ctrl.fs, ctrl.path)
+	rootState, err := state.NewRootState(ctrl.tf, ctrl.fs, ctrl.path, ctrl.stateOpt)
 	if err != nil {
 		return err
 	}
@@ -81,164 +136,565 @@ func (ctrl *Controller) UpdateRootState() error {
 	return nil
 }
 
+// referenceJob is a request to fix the reference origins of a module, which targets to the same
+// resource/data source type.
+type referenceJob struct {
+	modPath    string
+	provider   *provider
+	req        fixer.FixReferenceOriginsRequest
+	originRefs []originRef
+}
+
+// FixReferenceOrigins fixes the reference origins that target to the resources/data sources of the target providers.
+//
+// The modules are processed in the lexical order of their paths. Within a module, the reference origins
+// targeting to the same resource/data source type are sent to the fixer in one request, and the requests are
+// ordered by their first reference origin's position (i.e. filename, byte offset).
+// The requests are sent concurrently if the parallelism is larger than 1, while the responses are always applied
+// in the above order. A stepwise fixer is called once per schema version for each request, see fixReferenceOrigins.
 func (ctrl *Controller) FixReferenceOrigins(ctx context.Context) error {
-	for modPath, modState := range ctrl.rootState.ModuleStates {
-		origins, err := ctrl.filterOriginRefsForMod(modPath, modState)
+	var jobs []referenceJob
+	for _, modPath := range ctrl.rootState.ModulePaths() {
+		modJobs, err := ctrl.referenceJobsForMod(modPath, ctrl.rootState.ModuleStates[modPath])
 		if err != nil {
-			return fmt.Errorf("finding reference targets from origins, for module %s: %v", modPath, err)
+			if ctrl.keepGoing {
+				ctrl.report.AddFailure(report.Failure{Phase: report.PhaseReference, Module: modPath, Error: err.Error()})
+				continue
+			}
+			return err
 		}
+		jobs = append(jobs, modJobs...)
+	}
 
-		type ReqType struct {
-			BlockType fixer.BlockType
-			BlockName string
-			Version   int
+	resps := make([]*fixer.FixReferenceOriginsResponse, len(jobs))
+	errs := ctrl.runJobs(ctx, len(jobs), func(ctx context.Context, i int) error {
+		resp, err := fixReferenceOrigins(ctx, jobs[i].provider.fixer, jobs[i].req)
+		if err != nil {
+			return fmt.Errorf("fixer fix reference origins: %v", err)
+		}
+		if len(resp.RawContents) != len(jobs[i].req.RawContents) {
+			return fmt.Errorf("fixer fix reference origins: expects %d contents returned, got %d", len(jobs[i].req.RawContents), len(resp.RawContents))
 		}
+		resps[i] = resp
+		return nil
+	})
 
-		// Combine origins belong to the same targeting to the same resource/data source into one request
-		reqs := map[ReqType]fixer.FixReferenceOriginsRequest{}
-		originRangesMap := map[ReqType][]hcl.Range{}
-		for _, origin := range origins {
-			reqType := ReqType{
-				BlockType: fixer.BlockTypeResource,
-			}
-			if origin.Addr[0].String() == "data" {
-				reqType.BlockType = fixer.BlockTypeDataSource
-				reqType.BlockName = origin.Addr[1].String()
-				if sch, ok := ctrl.pschJSON.DataSourceSchemas[reqType.BlockName]; ok {
-					reqType.Version = int(sch.Version)
+	modUpdatesMap := map[string]map[string][]blockUpdate{}
+	for i, job := range jobs {
+		if errs[i] != nil {
+			for _, ref := range job.originRefs {
+				rng := report.NewRange(ref.Range)
+				failure := report.Failure{
+					Phase:     report.PhaseReference,
+					Module:    job.modPath,
+					File:      ref.Range.Filename,
+					Range:     &rng,
+					BlockType: job.req.BlockType,
+					BlockName: job.req.BlockName,
+					Address:   string(ref.Content),
+					Error:     errs[i].Error(),
 				}
-			} else {
-				reqType.BlockName = origin.Addr[0].String()
-				if sch, ok := ctrl.pschJSON.ResourceSchemas[reqType.BlockName]; ok {
-					reqType.Version = int(sch.Version)
+				if !ctrl.keepGoing {
+					return fmt.Errorf("%s", failure)
 				}
+				ctrl.report.AddFailure(failure)
+			}
+			continue
+		}
+		updatesMap, ok := modUpdatesMap[job.modPath]
+		if !ok {
+			updatesMap = map[string][]blockUpdate{}
+			modUpdatesMap[job.modPath] = updatesMap
+		}
+		for j, origin := range resps[i].RawContents {
+			ref := job.originRefs[j]
+			var diags fixer.Diagnostics
+			if j < len(resps[i].Diagnostics) {
+				diags = resps[i].Diagnostics[j]
 			}
+			updatesMap[ref.Range.Filename] = append(updatesMap[ref.Range.Filename], blockUpdate{
+				Update: writer.Update{
+					Range:   ref.Range,
+					Content: ref.RestoreSymbol(ref.RestoreIndex(origin)),
+				},
+				BlockType:   job.req.BlockType,
+				BlockName:   job.req.BlockName,
+				Version:     job.req.Version,
+				Address:     string(ref.Content),
+				Diagnostics: diags,
+			})
+		}
+	}
+	for _, modPath := range ctrl.rootState.ModulePaths() {
+		if err := ctrl.applyUpdates(report.PhaseReference, modPath, modUpdatesMap[modPath]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// referenceJobsForMod returns the requests to fix the reference origins of the module.
+func (ctrl *Controller) referenceJobsForMod(modPath string, modState *state.ModuleState) ([]referenceJob, error) {
+	origins, err := ctrl.filterOriginRefsForMod(modPath, modState)
+	if err != nil {
+		return nil, fmt.Errorf("finding reference targets from origins, for module %s: %v", modPath, err)
+	}
+	var refs []originRef
+	for _, origin := range origins {
+		refs = append(refs, newOriginRef(origin, modState.Files[origin.Range.Filename].Bytes))
+	}
+
+	// hcl-lang can't resolve the targets for the origins with index/splat, find them by ourselves.
+	indexedRefs, err := ctrl.indexedOriginRefsForMod(modState)
+	if err != nil {
+		return nil, fmt.Errorf("finding indexed reference origins, for module %s: %v", modPath, err)
+	}
+	// hcl-lang can't resolve most of the origins in JSON, find them by ourselves.
+	jsonRefs, err := ctrl.jsonOriginRefsForMod(modState)
+	if err != nil {
+		return nil, fmt.Errorf("finding reference origins in JSON, for module %s: %v", modPath, err)
+	}
+	for _, iref := range append(indexedRefs, jsonRefs...) {
+		if !ctrl.selected(modPath, modState, iref.BlockName, originAddr(iref)) {
+			continue
+		}
+		overlapped := false
+		for _, ref := range refs {
+			if ref.Range.Filename == iref.Range.Filename && ref.Range.Overlaps(iref.Range) {
+				overlapped = true
+				break
+			}
+		}
+		if !overlapped {
+			refs = append(refs, iref)
+		}
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		if refs[i].Range.Filename != refs[j].Range.Filename {
+			return refs[i].Range.Filename < refs[j].Range.Filename
+		}
+		return refs[i].Range.Start.Byte < refs[j].Range.Start.Byte
+	})
 
-			req, ok := reqs[reqType]
-			if !ok {
-				req = fixer.FixReferenceOriginsRequest{
+	type ReqType struct {
+		Provider  tfaddr.Provider
+		BlockType fixer.BlockType
+		BlockName string
+		Version   int
+	}
+
+	// Combine origins belong to the same targeting to the same resource/data source into one request
+	var reqTypes []ReqType
+	jobs := map[ReqType]referenceJob{}
+	providerNames, err := blockProviderNames(modState)
+	if err != nil {
+		return nil, fmt.Errorf("finding the providers of the blocks, for module %s: %v", modPath, err)
+	}
+	for _, ref := range refs {
+		// The origins are only filtered by the block types, while the targeted block might specify a provider
+		// that is not a target provider.
+		p := ctrl.providerFor(modState, ref.BlockType, ref.BlockName, providerNames[originAddr(ref)])
+		if p == nil {
+			continue
+		}
+		reqType := ReqType{
+			Provider:  p.addr,
+			BlockType: ref.BlockType,
+			BlockName: ref.BlockName,
+			Version:   p.schemaVersion(ref.BlockType, ref.BlockName),
+		}
+		if ok, reason := p.canFix(reqType.BlockType, reqType.BlockName, reqType.Version); !ok {
+			ctrl.report.AddSkip(report.Skip{
+				Phase:     report.PhaseReference,
+				Module:    modPath,
+				File:      ref.Range.Filename,
+				Range:     report.NewRange(ref.Range),
+				BlockType: reqType.BlockType,
+				BlockName: reqType.BlockName,
+				Version:   reqType.Version,
+				Address:   string(ref.Content),
+				Reason:    reason,
+			})
+			continue
+		}
+
+		job, ok := jobs[reqType]
+		if !ok {
+			reqTypes = append(reqTypes, reqType)
+			job = referenceJob{
+				modPath:  modPath,
+				provider: p,
+				req: fixer.FixReferenceOriginsRequest{
 					BlockType:   reqType.BlockType,
 					BlockName:   reqType.BlockName,
 					Version:     reqType.Version,
 					RawContents: [][]byte{},
-				}
+				},
 			}
-			req.RawContents = append(req.RawContents, origin.Range.SliceBytes(modState.Files[origin.Range.Filename].Bytes))
-			reqs[reqType] = req
+		}
+		job.req.RawContents = append(job.req.RawContents, ref.Content)
+		job.originRefs = append(job.originRefs, ref)
+		jobs[reqType] = job
+	}
 
-			originRanges, ok := originRangesMap[reqType]
-			if !ok {
-				originRanges = []hcl.Range{}
-			}
-			originRanges = append(originRanges, origin.Range)
-			originRangesMap[reqType] = originRanges
+	var out []referenceJob
+	for _, reqType := range reqTypes {
+		out = append(out, jobs[reqType])
+	}
+	return out, nil
+}
+
+// definitionJob is a request to fix a definition block of a module.
+type definitionJob struct {
+	modPath string
+	blk     definitionBlock
+	req     fixer.FixDefinitionRequest
+	// The address of the block, e.g. azurerm_resource_group.test, data.azurerm_client_config.current, provider.azurerm
+	addr string
+}
 
+// FixDefinition fixes the provider/resource/data source blocks of the target providers.
+//
+// The blocks are sent to the fixer in the order of the module path (lexical), filename (lexical) and
+// the byte offset of the block. The requests are sent concurrently if the parallelism is larger than 1,
+// while the responses are always applied in the above order. A stepwise fixer is called once per schema version
+// for each block, see fixDefinition.
+func (ctrl *Controller) FixDefinition(ctx context.Context) error {
+	var jobs []definitionJob
+	for _, modPath := range ctrl.rootState.ModulePaths() {
+		modJobs, err := ctrl.definitionJobsForMod(modPath, ctrl.rootState.ModuleStates[modPath])
+		if err != nil {
+			if ctrl.keepGoing {
+				ctrl.report.AddFailure(report.Failure{Phase: report.PhaseDefinition, Module: modPath, Error: err.Error()})
+				continue
+			}
+			return err
 		}
+		jobs = append(jobs, modJobs...)
+	}
 
-		updatesMap := map[string][]writer.Update{}
-		for reqtype, req := range reqs {
-			resp, err := ctrl.fixer.FixReferenceOrigins(ctx, req)
+	resps := make([]*fixer.FixDefinitionResponse, len(jobs))
+	errs := ctrl.runJobs(ctx, len(jobs), func(ctx context.Context, i int) error {
+		blk := jobs[i].blk
+		resp, err := fixDefinition(ctx, blk.provider.fixer, jobs[i].req)
+		if err != nil {
+			return fmt.Errorf("fixer fix definition: %v", err)
+		}
+		if jsonconfig.IsJSONFilename(blk.Range.Filename) {
+			// Only the block body is updated for JSON, the block type and labels are not expected to change.
+			typ, labels, err := jsonconfig.BlockHeader(resp.RawContent)
 			if err != nil {
-				return fmt.Errorf("fixer fix reference origins: %v", err)
+				return fmt.Errorf("fixer fix definition of %s: %v", blk.DefRange, err)
 			}
-			originRanges := originRangesMap[reqtype]
-
-			for i, origin := range resp.RawContents {
-				originRange := originRanges[i]
-				updatesMap[originRange.Filename] = append(updatesMap[originRange.Filename], writer.Update{
-					Range:   originRange,
-					Content: origin,
-				})
+			if typ != blk.Type || !slices.Equal(labels, blk.Labels) {
+				return fmt.Errorf("fixer fix definition of %s: changing the block type or labels is not supported for JSON", blk.DefRange)
 			}
 		}
+		if err := validateDefinition(blk, resp.RawContent); err != nil {
+			return err
+		}
+		resps[i] = resp
+		return nil
+	})
 
-		for filename, updates := range updatesMap {
-			fpath := filepath.Join(modPath, filename)
-			b, err := ctrl.fs.ReadFile(fpath)
-			if err != nil {
-				return fmt.Errorf("reading %s: %v", fpath, err)
+	modUpdatesMap := map[string]map[string][]blockUpdate{}
+	for i, job := range jobs {
+		blk, resp := job.blk, resps[i]
+		filename := blk.Range.Filename
+		if errs[i] != nil {
+			rng := report.NewRange(blk.Range)
+			failure := report.Failure{
+				Phase:     report.PhaseDefinition,
+				Module:    job.modPath,
+				File:      filename,
+				Range:     &rng,
+				BlockType: job.req.BlockType,
+				BlockName: job.req.BlockName,
+				Address:   job.addr,
+				Error:     errs[i].Error(),
 			}
-			nb, err := writer.UpdateContent(b, updates)
-			if err != nil {
-				return fmt.Errorf("failed to update content for %s: %v", fpath, err)
-			}
-			if err := ctrl.fs.WriteFile(fpath, nb, 0644); err != nil {
-				return fmt.Errorf("writing back the new content: %v", err)
+			if !ctrl.keepGoing {
+				return fmt.Errorf("%s", failure)
 			}
+			ctrl.report.AddFailure(failure)
+			continue
+		}
+		bupdate := blockUpdate{
+			Update: writer.Update{
+				Range:   blk.Range,
+				Content: resp.RawContent,
+			},
+			BlockType:   job.req.BlockType,
+			BlockName:   job.req.BlockName,
+			Version:     job.req.Version,
+			Address:     job.addr,
+			Diagnostics: resp.Diagnostics,
+		}
+		if jsonconfig.IsJSONFilename(filename) && bytes.Equal(resp.RawContent, job.req.RawContent) {
+			// Encoding the content back to JSON is lossy (e.g. a single nested block in an array becomes an
+			// object), so the unchanged block is left as is.
+			ctrl.addUpdateDiagnostics(report.PhaseDefinition, job.modPath, filename, nil, blk.Range, bupdate)
+			continue
+		}
+		updatesMap, ok := modUpdatesMap[job.modPath]
+		if !ok {
+			updatesMap = map[string][]blockUpdate{}
+			modUpdatesMap[job.modPath] = updatesMap
+		}
+		updatesMap[filename] = append(updatesMap[filename], bupdate)
+	}
+	for _, modPath := range ctrl.rootState.ModulePaths() {
+		if err := ctrl.applyUpdates(report.PhaseDefinition, modPath, modUpdatesMap[modPath]); err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
-func (ctrl *Controller) FixDefinition(ctx context.Context) error {
-	for modPath, modState := range ctrl.rootState.ModuleStates {
-		blks, err := ctrl.filterDefinitionForMod(modState)
-		if err != nil {
-			return fmt.Errorf("finding definition blocks, for module %s: %v", modPath, err)
-		}
-
-		updatesMap := map[string][]writer.Update{}
-		for _, blk := range blks {
-			filename := blk.Range().Filename
-			f := modState.Files[filename]
-			rt := blk.Labels[0]
-			rn := blk.Labels[1]
-			req := fixer.FixDefinitionRequest{
-				BlockName:  rt,
-				RawContent: blk.Range().SliceBytes(f.Bytes),
-			}
-			resAddr := rt + "." + rn
-			switch blk.Type {
-			case "data":
-				req.BlockType = fixer.BlockTypeDataSource
-				resAddr = "data." + resAddr
-				if sch, ok := ctrl.pschJSON.DataSourceSchemas[rt]; ok {
-					req.Version = int(sch.Version)
-				}
-			case "resource":
-				req.BlockType = fixer.BlockTypeResource
-				if sch, ok := ctrl.pschJSON.ResourceSchemas[rt]; ok {
-					req.Version = int(sch.Version)
-				}
-			default:
-				panic("unreachable")
+// definitionJobsForMod returns the requests to fix the definition blocks of the module.
+func (ctrl *Controller) definitionJobsForMod(modPath string, modState *state.ModuleState) ([]definitionJob, error) {
+	blks, err := ctrl.filterDefinitionForMod(modPath, modState)
+	if err != nil {
+		return nil, fmt.Errorf("finding definition blocks, for module %s: %v", modPath, err)
+	}
+
+	var jobs []definitionJob
+	for _, blk := range blks {
+		req := fixer.FixDefinitionRequest{
+			RawContent: blk.Content,
+		}
+		var resAddr, addr string
+		switch blk.Type {
+		case "provider":
+			req.BlockType = fixer.BlockTypeProvider
+			req.BlockName = blk.provider.addr.Type
+			addr = "provider." + blk.Labels[0]
+		case "data":
+			rt, rn := blk.Labels[0], blk.Labels[1]
+			req.BlockType = fixer.BlockTypeDataSource
+			req.BlockName = rt
+			resAddr = "data." + rt + "." + rn
+		case "resource":
+			rt, rn := blk.Labels[0], blk.Labels[1]
+			req.BlockType = fixer.BlockTypeResource
+			req.BlockName = rt
+			resAddr = rt + "." + rn
+		default:
+			panic("unreachable")
+		}
+		if addr == "" {
+			addr = resAddr
+		}
+		req.Version = blk.provider.schemaVersion(req.BlockType, req.BlockName)
+		if ok, reason := blk.provider.canFix(req.BlockType, req.BlockName, req.Version); !ok {
+			ctrl.report.AddSkip(report.Skip{
+				Phase:     report.PhaseDefinition,
+				Module:    modPath,
+				File:      blk.Range.Filename,
+				Range:     report.NewRange(blk.Range),
+				BlockType: req.BlockType,
+				BlockName: req.BlockName,
+				Version:   req.Version,
+				Address:   addr,
+				Reason:    reason,
+			})
+			continue
+		}
+		if tfState := modState.TFStateResources[resAddr]; resAddr != "" && tfState != nil {
+			b, err := json.Marshal(tfState)
+			if err != nil {
+				return nil, fmt.Errorf("marshal tfstate for %s: %v", resAddr, err)
 			}
-			if tfState := modState.TFStateResources[resAddr]; tfState != nil {
+			req.RawState = b
+		}
+		if tfStates := modState.TFStateResourceInstances[resAddr]; resAddr != "" && len(tfStates) != 0 {
+			req.RawStates = map[string][]byte{}
+			for instAddr, tfState := range tfStates {
 				b, err := json.Marshal(tfState)
 				if err != nil {
-					return fmt.Errorf("marshal tfstate for %s: %v", resAddr, err)
+					return nil, fmt.Errorf("marshal tfstate for %s: %v", instAddr, err)
 				}
-				req.RawState = b
+				req.RawStates[instAddr] = b
 			}
-			resp, err := ctrl.fixer.FixDefinition(ctx, req)
-			if err != nil {
-				return fmt.Errorf("fixer fix definition: %v", err)
+		}
+		jobs = append(jobs, definitionJob{modPath: modPath, blk: blk, req: req, addr: addr})
+	}
+	return jobs, nil
+}
+
+// blockUpdate is an update to a file, together with the block that triggers it
+type blockUpdate struct {
+	writer.Update
+	BlockType fixer.BlockType
+	BlockName string
+	Version   int
+	// The address of the block definition, or the reference origin
+	Address string
+	// The diagnostics from the fixer about this update, whose subject ranges are relative to the content
+	Diagnostics fixer.Diagnostics
+}
+
+// applyUpdates applies the updates to each file of the module in memory, and records the changes.
+// The files are updated in the lexical order of the filename.
+//
+// In the continue-on-error mode, a file that fails to be updated is recorded as a failure and left unchanged.
+func (ctrl *Controller) applyUpdates(phase report.Phase, modPath string, updatesMap map[string][]blockUpdate) error {
+	for _, filename := range slices.Sorted(maps.Keys(updatesMap)) {
+		if err := ctrl.applyFileUpdates(phase, modPath, filename, updatesMap[filename]); err != nil {
+			if ctrl.keepGoing {
+				ctrl.report.AddFailure(report.Failure{Phase: phase, Module: modPath, File: filename, Error: err.Error()})
+				continue
 			}
-			updatesMap[filename] = append(updatesMap[filename], writer.Update{
-				Range:   blk.Range(),
-				Content: resp.RawContent,
-			})
+			return err
 		}
+	}
+	return nil
+}
 
-		for filename, updates := range updatesMap {
-			fpath := filepath.Join(modPath, filename)
-			b, err := ctrl.fs.ReadFile(fpath)
-			if err != nil {
-				return fmt.Errorf("reading %s: %v", fpath, err)
+// applyFileUpdates applies the updates to the file of the module in memory, and records the changes.
+func (ctrl *Controller) applyFileUpdates(phase report.Phase, modPath, filename string, bupdates []blockUpdate) error {
+	fpath := filepath.Join(modPath, filename)
+	b, err := ctrl.fs.ReadFile(fpath)
+	if err != nil {
+		return fmt.Errorf("reading %s: %v", fpath, err)
+	}
+	// Sort the updates by the start position, which is the order that they are applied by writer.UpdateContent
+	sort.SliceStable(bupdates, func(i, j int) bool {
+		return bupdates[i].Range.Start.Byte < bupdates[j].Range.Start.Byte
+	})
+	var updates writer.Updates
+	for _, bupdate := range bupdates {
+		updates = append(updates, bupdate.Update)
+	}
+	var nb []byte
+	if jsonconfig.IsJSONFilename(filename) {
+		nb, err = writer.UpdateJSONContent(b, updates)
+		// The update contents are encoded as JSON in place
+		for i := range bupdates {
+			bupdates[i].Update = updates[i]
+		}
+	} else {
+		nb, err = writer.UpdateContent(b, updates)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update content for %s: %v", fpath, err)
+	}
+	if err := ctrl.fs.WriteFile(fpath, nb, 0644); err != nil {
+		return fmt.Errorf("writing back the new content: %v", err)
+	}
+	for i, rng := range writer.UpdatedRanges(nb, updates) {
+		ctrl.addUpdateDiagnostics(phase, modPath, filename, nb, rng, bupdates[i])
+	}
+	// The ranges are of the content changed by the earlier phase (if any), map them back to the original file.
+	ob, err := ctrl.fs.ReadOriginFile(fpath)
+	if err != nil {
+		return fmt.Errorf("reading the original %s: %v", fpath, err)
+	}
+	for _, bupdate := range bupdates {
+		oldContent := bupdate.Range.SliceBytes(b)
+		if bytes.Equal(oldContent, bupdate.Content) {
+			continue
+		}
+		ctrl.report.Add(modPath, filename, report.Change{
+			Phase:      phase,
+			BlockType:  bupdate.BlockType,
+			BlockName:  bupdate.BlockName,
+			Version:    bupdate.Version,
+			Address:    bupdate.Address,
+			Range:      report.NewRange(originRange(ob, b, bupdate.Range)),
+			OldContent: string(oldContent),
+			NewContent: string(bupdate.Content),
+		})
+	}
+	return nil
+}
+
+// addUpdateDiagnostics adds the diagnostics of the block update to the report, where rng is the range of the updated
+// block in the new file content nb.
+func (ctrl *Controller) addUpdateDiagnostics(phase report.Phase, modPath, filename string, nb []byte, rng hcl.Range, bupdate blockUpdate) {
+	for _, diag := range bupdate.Diagnostics {
+		drng := rng
+		// The subject is relative to the fixed content in native syntax, which doesn't apply to JSON.
+		if diag.Subject != nil && !jsonconfig.IsJSONFilename(filename) {
+			drng = hcl.Range{
+				Start: writer.PosAt(nb, rng.Start.Byte+diag.Subject.Start.Byte),
+				End:   writer.PosAt(nb, rng.Start.Byte+diag.Subject.End.Byte),
 			}
-			nb, err := writer.UpdateContent(b, updates)
-			if err != nil {
-				return fmt.Errorf("failed to update content for %s: %v", fpath, err)
+		}
+		ctrl.report.AddDiagnostic(report.Diagnostic{
+			Phase:     phase,
+			Module:    modPath,
+			File:      filename,
+			Range:     report.NewRange(drng),
+			BlockType: bupdate.BlockType,
+			BlockName: bupdate.BlockName,
+			Address:   bupdate.Address,
+			Severity:  diag.Severity,
+			Summary:   diag.Summary,
+			Detail:    diag.Detail,
+		})
+	}
+}
+
+// Report returns the report of the changes applied so far.
+func (ctrl *Controller) Report() (*report.Report, error) {
+	extMods, err := ctrl.changedExternalModules()
+	if err != nil {
+		return nil, err
+	}
+	ctrl.report.ExternalModules = extMods
+	return &ctrl.report, nil
+}
+
+// changedExternalModules returns the external modules that have any file changed, ordered by the module key.
+func (ctrl *Controller) changedExternalModules() ([]report.ExternalModule, error) {
+	paths, err := ctrl.fs.ModifiedModuleCacheFiles()
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 || ctrl.rootState.ModuleManifest == nil {
+		return nil, nil
+	}
+	records := map[string]datadir.ModuleRecord{}
+	for _, path := range paths {
+		rp, err := filepath.Rel(ctrl.path, path)
+		if err != nil {
+			return nil, err
+		}
+		// Find the innermost external module that contains this file
+		var found *datadir.ModuleRecord
+		for _, record := range ctrl.rootState.ModuleManifest.Records {
+			if !record.IsExternal() || !strings.HasPrefix(rp, record.Dir+string(filepath.Separator)) {
+				continue
 			}
-			if err := ctrl.fs.WriteFile(fpath, nb, 0644); err != nil {
-				return fmt.Errorf("writing back the new content: %v", err)
+			if found == nil || len(record.Dir) > len(found.Dir) {
+				found = &record
 			}
-			//fmt.Printf("Updated %s\n\n%s\n", fpath, string(nb))
 		}
+		if found != nil {
+			records[found.Key] = *found
+		}
+	}
+	var out []report.ExternalModule
+	for _, record := range records {
+		out = append(out, report.ExternalModule{
+			Key:     record.Key,
+			Source:  record.RawSourceAddr,
+			Version: record.VersionStr,
+			Dir:     record.Dir,
+		})
 	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out, nil
+}
 
-	return nil
+// WriteExternalModules writes each changed external module to a subdirectory of dir, named after
+// the module's directory name in the module cache.
+// It returns the paths of the written module directories.
+func (ctrl *Controller) WriteExternalModules(dir string) ([]string, error) {
+	return ctrl.fs.WriteModuleCache(dir)
 }
 
 // Write writes the current filesystem in memory to the path in OS.
@@ -247,20 +703,82 @@ func (ctrl *Controller) Write(path *string) error {
 	return ctrl.fs.Write(path)
 }
 
-// filterDefinitionForMod filters the module's resource/data source definitions only if it belongs to the
+// WriteInPlace writes the files changed in memory back to their origin paths in OS.
+// If backup is true, the origin content of each file is kept in a backup file alongside.
+// It returns the paths of the written files.
+func (ctrl *Controller) WriteInPlace(backup bool) ([]string, error) {
+	return ctrl.fs.WriteInPlace(backup)
+}
+
+// Diff writes the unified diff of each file changed in memory (compared to the OS) to w.
+// It returns whether there is any change.
+func (ctrl *Controller) Diff(w io.Writer) (bool, error) {
+	return ctrl.fs.Diff(w)
+}
+
+// definitionBlock is a top-level block definition to be fixed
+type definitionBlock struct {
+	*hcl.Block
+	// Range is the range to be updated by the fixed block, which is the whole block for the native syntax,
+	// or the JSON object of the block body for the JSON syntax.
+	Range hcl.Range
+	// Content is the block in native syntax
+	Content []byte
+	// provider is the target provider that owns this block
+	provider *provider
+}
+
+// filterDefinitionForMod filters the module's provider/resource/data source definitions only if it belongs to the
 // interested provider.
-func (ctrl *Controller) filterDefinitionForMod(modState *state.ModuleState) ([]*hclsyntax.Block, error) {
-	var blks []*hclsyntax.Block
-	for _, f := range modState.Files {
-		body := f.Body.(*hclsyntax.Body)
-		for _, blk := range body.Blocks {
-			ok, err := ctrl.filterBlock(blk.AsHCLBlock())
+func (ctrl *Controller) filterDefinitionForMod(modPath string, modState *state.ModuleState) ([]definitionBlock, error) {
+	var blks []definitionBlock
+	for _, filename := range modState.Filenames() {
+		f := modState.Files[filename]
+		var candidates []definitionBlock
+		if jsonconfig.IsJSONFilename(filename) {
+			jblks, err := jsonconfig.Blocks(f)
 			if err != nil {
 				return nil, err
 			}
-			if !ok {
+			for _, blk := range jblks {
+				candidates = append(candidates, definitionBlock{Block: blk, Range: jsonconfig.BodyRange(blk)})
+			}
+		} else {
+			for _, blk := range f.Body.(*hclsyntax.Body).Blocks {
+				candidates = append(candidates, definitionBlock{Block: blk.AsHCLBlock(), Range: blk.Range(), Content: blk.Range().SliceBytes(f.Bytes)})
+			}
+		}
+		for _, blk := range candidates {
+			var (
+				p   *provider
+				err error
+			)
+			if blk.Type == "provider" {
+				p, err = ctrl.filterProviderBlock(modState, blk.Block)
+			} else {
+				p, err = ctrl.filterBlock(modState, blk.Block)
+			}
+			if err != nil {
+				return nil, err
+			}
+			if p == nil || !ctrl.selectedBlock(modPath, modState, blk.Block) {
 				continue
 			}
+			blk.provider = p
+			if blk.Content == nil {
+				blockType, blockName := fixer.BlockTypeProvider, ""
+				switch blk.Type {
+				case "resource":
+					blockType, blockName = fixer.BlockTypeResource, blk.Labels[0]
+				case "data":
+					blockType, blockName = fixer.BlockTypeDataSource, blk.Labels[0]
+				}
+				b, err := jsonconfig.BlockToNative(f.Bytes, blk.Block, p.blockSchema(blockType, blockName))
+				if err != nil {
+					return nil, err
+				}
+				blk.Content = b
+			}
 			blks = append(blks, blk)
 		}
 	}
@@ -280,6 +798,10 @@ func (ctrl *Controller) filterOriginRefsForMod(modPath string, modState *state.M
 		if !ok {
 			continue
 		}
+		// The origins in JSON are found by ourselves, see jsonOriginRefsForMod.
+		if jsonconfig.IsJSONFilename(origin.Range.Filename) {
+			continue
+		}
 		targets, err := d.ReferenceTargetsForOriginAtPos(lang.Path{Path: modPath, LanguageID: "terraform"}, origin.OriginRange().Filename, origin.OriginRange().Start)
 		if err != nil {
 			return nil, err
@@ -297,13 +819,18 @@ func (ctrl *Controller) filterOriginRefsForMod(modPath string, modState *state.M
 			// This shouldn't happen as we are processing reference local origins only, whose target should be within the same module.
 			return nil, fmt.Errorf("unexpected target path, expect=%s, got=%s", modPath, tgt.Path.Path)
 		}
-		f := modState.Files[tgt.Range.Filename]
-		blk := f.OutermostBlockAtPos(tgt.Range.Start)
-		ok, err = ctrl.filterBlock(blk)
+		blk, err := outermostBlockAtPos(modState.Files[tgt.Range.Filename], tgt.Range.Start)
 		if err != nil {
 			return nil, err
 		}
-		if !ok {
+		if blk == nil {
+			continue
+		}
+		p, err := ctrl.filterBlock(modState, blk)
+		if err != nil {
+			return nil, err
+		}
+		if p == nil || !ctrl.selectedBlock(modPath, modState, blk) {
 			continue
 		}
 		out = append(out, origin)
@@ -311,23 +838,81 @@ func (ctrl *Controller) filterOriginRefsForMod(modPath string, modState *state.M
 	return out, nil
 }
 
-// filterBlock tells whether a (top-level) block is a resource/data source, belongs to the interested provider.
-func (ctrl *Controller) filterBlock(blk *hcl.Block) (bool, error) {
+// selectedBlock tells whether the (top-level) provider/resource/data source block of the module is selected by
+// the include/exclude filter.
+func (ctrl *Controller) selectedBlock(modPath string, modState *state.ModuleState, blk *hcl.Block) bool {
+	switch blk.Type {
+	case "provider":
+		return ctrl.selected(modPath, modState, "", "provider."+blk.Labels[0])
+	case "data":
+		return ctrl.selected(modPath, modState, blk.Labels[0], "data."+blk.Labels[0]+"."+blk.Labels[1])
+	default:
+		return ctrl.selected(modPath, modState, blk.Labels[0], blk.Labels[0]+"."+blk.Labels[1])
+	}
+}
+
+// selected tells whether the block of the resource/data source type (empty for provider) and the address
+// (relative to the module) is selected by the include/exclude filter.
+func (ctrl *Controller) selected(modPath string, modState *state.ModuleState, typ, addr string) bool {
+	rel, err := filepath.Rel(ctrl.rootState.RootPath, modPath)
+	if err != nil {
+		rel = modPath
+	}
+	return ctrl.filter.Match(filter.Target{
+		ModulePath:  filepath.ToSlash(rel),
+		ModuleAddrs: modState.Addrs,
+		Type:        typ,
+		Address:     addr,
+	})
+}
+
+// outermostBlockAtPos returns the top-level block that contains the position, for either the native or
+// the JSON syntax. It returns nil if there is no such block.
+func outermostBlockAtPos(f *hcl.File, pos hcl.Pos) (*hcl.Block, error) {
+	if !jsonconfig.IsJSONFilename(f.Body.MissingItemRange().Filename) {
+		return f.OutermostBlockAtPos(pos), nil
+	}
+	blks, err := jsonconfig.Blocks(f)
+	if err != nil {
+		return nil, err
+	}
+	for _, blk := range blks {
+		// The TypeRange is shared by the blocks of the same type in JSON, hence starts from the last label.
+		if hcl.RangeBetween(blk.LabelRanges[len(blk.LabelRanges)-1], jsonconfig.BodyRange(blk)).ContainsPos(pos) {
+			return blk, nil
+		}
+	}
+	return nil, nil
+}
+
+// filterBlock returns the target provider that a (top-level) resource/data source block belongs to.
+// It returns nil if the block is not a resource/data source, or it doesn't belong to any target provider.
+func (ctrl *Controller) filterBlock(modState *state.ModuleState, blk *hcl.Block) (*provider, error) {
 	switch blk.Type {
 	case "resource":
 		if len(blk.Labels) != 2 {
-			return false, fmt.Errorf("invalid resource definition at %s: label length is not 2", blk.DefRange)
+			return nil, fmt.Errorf("invalid resource definition at %s: label length is not 2", blk.DefRange)
 		}
-		_, ok := ctrl.psch.Resources[blk.Labels[0]]
-		return ok, nil
+		return ctrl.providerFor(modState, fixer.BlockTypeResource, blk.Labels[0], blockProviderName(blk)), nil
 	case "data":
 		if len(blk.Labels) != 2 {
-			return false, fmt.Errorf("invalid data source definition at %s: label length is not 2", blk.DefRange)
+			return nil, fmt.Errorf("invalid data source definition at %s: label length is not 2", blk.DefRange)
 		}
-		_, ok := ctrl.psch.DataSources[blk.Labels[0]]
-		return ok, nil
+		return ctrl.providerFor(modState, fixer.BlockTypeDataSource, blk.Labels[0], blockProviderName(blk)), nil
 	default:
 		// Ignore reference origins targeting to non-resource/datasource
-		return false, nil
+		return nil, nil
+	}
+}
+
+// filterProviderBlock returns the target provider that a (top-level) provider configuration block (including the
+// aliased one) belongs to. It returns nil if the block is not a provider configuration of any target provider.
+func (ctrl *Controller) filterProviderBlock(modState *state.ModuleState, blk *hcl.Block) (*provider, error) {
+	if blk.Type != "provider" {
+		return nil, nil
+	}
+	if len(blk.Labels) != 1 {
+		return nil, fmt.Errorf("invalid provider definition at %s: label length is not 1", blk.DefRange)
 	}
+	return ctrl.providerByAddr(modState.ProviderAddr(blk.Labels[0])), nil
 }
@@ -2,15 +2,24 @@ package ctrl_test
 
 import (
 	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/go-version"
 	"github.com/hashicorp/terraform-exec/tfexec"
+	tfjson "github.com/hashicorp/terraform-json"
 	tfaddr "github.com/hashicorp/terraform-registry-address"
 	"github.com/magodo/terrafix/internal/ctrl"
 	"github.com/magodo/terrafix/internal/fixer"
+	"github.com/magodo/terrafix/internal/report"
 	"github.com/magodo/terrafix/internal/terraform/find"
 	"github.com/stretchr/testify/require"
+	"github.com/zclconf/go-cty/cty"
 )
 
 type FixDefinitionChecker func(t *testing.T, req fixer.FixDefinitionRequest)
@@ -50,6 +59,10 @@ func TestCtrl(t *testing.T) {
 			if req.BlockType == "resource" && req.BlockName == "azurerm_container_registry" {
 				require.True(t, req.Version > 0)
 			}
+			if req.BlockType == "provider" {
+				require.Equal(t, "azurerm", req.BlockName)
+				require.Empty(t, req.RawState)
+			}
 			defN += 1
 		},
 		FixReferenceOriginsChecker: func(t *testing.T, req fixer.FixReferenceOriginsRequest) {
@@ -63,10 +76,210 @@ func TestCtrl(t *testing.T) {
 	}
 
 	ctrl, err := ctrl.NewController(ctrl.Option{
-		Path:         rootModPath,
-		ProviderAddr: tfaddr.MustParseProviderSource("registry.terraform.io/hashicorp/azurerm"),
-		TF:           tf,
-		Fixer:        fx,
+		Path: rootModPath,
+		Providers: []ctrl.Provider{
+			{
+				Addr:  tfaddr.MustParseProviderSource("registry.terraform.io/hashicorp/azurerm"),
+				Fixer: fx,
+			},
+		},
+		TF: tf,
+	})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	require.NoError(t, ctrl.FixReferenceOrigins(ctx))
+	require.NoError(t, ctrl.UpdateRootState())
+	require.NoError(t, ctrl.FixDefinition(ctx))
+	require.Equal(t, 8, defN)
+	require.Equal(t, 14, refN)
+}
+
+func TestCtrl_ScriptFixer(t *testing.T) {
+	rootModPath := "testdata/script"
+
+	fx, err := fixer.NewScriptFixer(filepath.Join(rootModPath, "fix.star"))
+	require.NoError(t, err)
+
+	// No terraform is needed with the provider schemas specified
+	ctrl, err := ctrl.NewController(ctrl.Option{
+		Path: rootModPath,
+		Providers: []ctrl.Provider{
+			{
+				Addr:  tfaddr.MustParseProviderSource("registry.terraform.io/hashicorp/azurerm"),
+				Fixer: fx,
+			},
+		},
+		ProviderSchemas: resourceGroupSchemas(),
+	})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	require.NoError(t, ctrl.FixReferenceOrigins(ctx))
+	require.NoError(t, ctrl.UpdateRootState())
+	require.NoError(t, ctrl.FixDefinition(ctx))
+
+	rpt, err := ctrl.Report()
+	require.NoError(t, err)
+	require.Len(t, rpt.Modules, 1)
+	require.Len(t, rpt.Modules[0].Files, 1)
+	changes := rpt.Modules[0].Files[0].Changes
+	require.Len(t, changes, 1)
+	require.Equal(t, `resource "azurerm_resource_group" "test" {
+  name = "terrafix"
+  location = "westus2"
+}`, changes[0].NewContent)
+}
+
+func TestCtrl_ReplayFixer(t *testing.T) {
+	rootModPath := "testdata/script"
+
+	// The session is recorded from the ScriptFixer of TestCtrl_ScriptFixer
+	fx, err := fixer.NewReplayFixer(filepath.Join(rootModPath, "session.jsonl"))
+	require.NoError(t, err)
+
+	ctrl, err := ctrl.NewController(ctrl.Option{
+		Path: rootModPath,
+		Providers: []ctrl.Provider{
+			{
+				Addr:  tfaddr.MustParseProviderSource("registry.terraform.io/hashicorp/azurerm"),
+				Fixer: fx,
+			},
+		},
+		ProviderSchemas: resourceGroupSchemas(),
+	})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	require.NoError(t, ctrl.FixReferenceOrigins(ctx))
+	require.NoError(t, ctrl.UpdateRootState())
+	require.NoError(t, ctrl.FixDefinition(ctx))
+
+	rpt, err := ctrl.Report()
+	require.NoError(t, err)
+	require.Len(t, rpt.Modules, 1)
+	require.Len(t, rpt.Modules[0].Files, 1)
+	changes := rpt.Modules[0].Files[0].Changes
+	require.Len(t, changes, 1)
+	require.Equal(t, `resource "azurerm_resource_group" "test" {
+  name = "terrafix"
+  location = "westus2"
+}`, changes[0].NewContent)
+}
+
+func TestCtrl_ProviderMetaArgument(t *testing.T) {
+	rootModPath := "testdata/provider_meta"
+
+	// The definitions and the reference origins received by each fixer
+	received := map[string][]string{}
+	newFixer := func(name string) *TestFixer {
+		return &TestFixer{
+			t: t,
+			FixDefinitionChecker: func(t *testing.T, req fixer.FixDefinitionRequest) {
+				received[name] = append(received[name], string(req.RawContent[:strings.Index(string(req.RawContent), "{")]))
+			},
+			FixReferenceOriginsChecker: func(t *testing.T, req fixer.FixReferenceOriginsRequest) {
+				for _, content := range req.RawContents {
+					received[name] = append(received[name], string(content))
+				}
+			},
+		}
+	}
+
+	computeInstanceSchema := &tfjson.ProviderSchema{
+		ConfigSchema: &tfjson.Schema{Block: &tfjson.SchemaBlock{}},
+		ResourceSchemas: map[string]*tfjson.Schema{
+			"google_compute_instance": {
+				Block: &tfjson.SchemaBlock{
+					Attributes: map[string]*tfjson.SchemaAttribute{
+						"name": {AttributeType: cty.String, Required: true},
+					},
+				},
+			},
+		},
+	}
+	ctrl, err := ctrl.NewController(ctrl.Option{
+		Path: rootModPath,
+		Providers: []ctrl.Provider{
+			{
+				Addr:  tfaddr.MustParseProviderSource("registry.terraform.io/hashicorp/google"),
+				Fixer: newFixer("google"),
+			},
+			{
+				Addr:  tfaddr.MustParseProviderSource("registry.terraform.io/hashicorp/google-beta"),
+				Fixer: newFixer("google-beta"),
+			},
+		},
+		ProviderSchemas: &tfjson.ProviderSchemas{
+			FormatVersion: "1.0",
+			Schemas: map[string]*tfjson.ProviderSchema{
+				"registry.terraform.io/hashicorp/google":      computeInstanceSchema,
+				"registry.terraform.io/hashicorp/google-beta": computeInstanceSchema,
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	require.NoError(t, ctrl.FixReferenceOrigins(ctx))
+	require.NoError(t, ctrl.UpdateRootState())
+	require.NoError(t, ctrl.FixDefinition(ctx))
+
+	require.Equal(t, []string{
+		"google_compute_instance.ga.name",
+		`resource "google_compute_instance" "ga" `,
+	}, received["google"])
+	require.ElementsMatch(t, []string{
+		"google_compute_instance.beta.name",
+		"google_compute_instance.beta_alias",
+		`resource "google_compute_instance" "beta" `,
+		`resource "google_compute_instance" "beta_alias" `,
+		`provider "google-beta" `,
+	}, received["google-beta"])
+}
+
+// resourceGroupSchemas returns the provider schemas that only have the azurerm_resource_group, for the tests
+// without terraform.
+func resourceGroupSchemas() *tfjson.ProviderSchemas {
+	return &tfjson.ProviderSchemas{
+		FormatVersion: "1.0",
+		Schemas: map[string]*tfjson.ProviderSchema{
+			"registry.terraform.io/hashicorp/azurerm": {
+				ConfigSchema: &tfjson.Schema{Block: &tfjson.SchemaBlock{}},
+				ResourceSchemas: map[string]*tfjson.Schema{
+					"azurerm_resource_group": {
+						Block: &tfjson.SchemaBlock{
+							Attributes: map[string]*tfjson.SchemaAttribute{
+								"name":     {AttributeType: cty.String, Required: true},
+								"location": {AttributeType: cty.String, Optional: true, Computed: true},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// NoCapabilityFixer is a fixer that claims to fix nothing.
+type NoCapabilityFixer struct {
+	fixer.DummyFixer
+}
+
+func (NoCapabilityFixer) CanFix(fixer.BlockType, string, int) bool { return false }
+
+func TestCtrl_Skipped(t *testing.T) {
+	rootModPath := "testdata/script"
+
+	ctrl, err := ctrl.NewController(ctrl.Option{
+		Path: rootModPath,
+		Providers: []ctrl.Provider{
+			{
+				Addr:  tfaddr.MustParseProviderSource("registry.terraform.io/hashicorp/azurerm"),
+				Fixer: NoCapabilityFixer{},
+			},
+		},
+		ProviderSchemas: resourceGroupSchemas(),
 	})
 	require.NoError(t, err)
 
@@ -74,6 +287,270 @@ func TestCtrl(t *testing.T) {
 	require.NoError(t, ctrl.FixReferenceOrigins(ctx))
 	require.NoError(t, ctrl.UpdateRootState())
 	require.NoError(t, ctrl.FixDefinition(ctx))
-	require.Equal(t, 6, defN)
-	require.Equal(t, 12, refN)
+
+	rpt, err := ctrl.Report()
+	require.NoError(t, err)
+	require.Empty(t, rpt.Modules)
+	require.Len(t, rpt.Skipped, 1)
+	require.Equal(t, report.PhaseDefinition, rpt.Skipped[0].Phase)
+	require.Equal(t, "azurerm_resource_group.test", rpt.Skipped[0].Address)
+	require.Equal(t, "main.tf", rpt.Skipped[0].File)
+}
+
+func TestCtrl_JSONUnchanged(t *testing.T) {
+	rootModPath := "testdata/json"
+
+	var defN int
+	ctrl, err := ctrl.NewController(ctrl.Option{
+		Path: rootModPath,
+		Providers: []ctrl.Provider{
+			{
+				Addr: tfaddr.MustParseProviderSource("registry.terraform.io/hashicorp/azurerm"),
+				Fixer: &TestFixer{
+					t:                          t,
+					FixDefinitionChecker:       func(t *testing.T, req fixer.FixDefinitionRequest) { defN++ },
+					FixReferenceOriginsChecker: func(t *testing.T, req fixer.FixReferenceOriginsRequest) {},
+				},
+			},
+		},
+		ProviderSchemas: resourceGroupSchemas(),
+	})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	require.NoError(t, ctrl.FixReferenceOrigins(ctx))
+	require.NoError(t, ctrl.UpdateRootState())
+	require.NoError(t, ctrl.FixDefinition(ctx))
+	require.Equal(t, 1, defN)
+
+	// The block returned unchanged is not encoded back to JSON, which would have changed its layout
+	changed, err := ctrl.Diff(io.Discard)
+	require.NoError(t, err)
+	require.False(t, changed)
+	rpt, err := ctrl.Report()
+	require.NoError(t, err)
+	require.Empty(t, rpt.Modules)
+}
+
+func TestCtrl_MissingModule(t *testing.T) {
+	rootModPath := "testdata/missing_module"
+
+	var defN int
+	opt := ctrl.Option{
+		Path: rootModPath,
+		Providers: []ctrl.Provider{
+			{
+				Addr: tfaddr.MustParseProviderSource("registry.terraform.io/hashicorp/azurerm"),
+				Fixer: &TestFixer{
+					t:                          t,
+					FixDefinitionChecker:       func(t *testing.T, req fixer.FixDefinitionRequest) { defN++ },
+					FixReferenceOriginsChecker: func(t *testing.T, req fixer.FixReferenceOriginsRequest) {},
+				},
+			},
+		},
+		ProviderSchemas: resourceGroupSchemas(),
+	}
+	_, err := ctrl.NewController(opt)
+	require.ErrorContains(t, err, "module call module.missing: ")
+
+	// The module call is skipped and reported as a failure in the keep-going mode, while the others are still fixed
+	opt.KeepGoing = true
+	ctrl, err := ctrl.NewController(opt)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	require.NoError(t, ctrl.FixReferenceOrigins(ctx))
+	require.NoError(t, ctrl.UpdateRootState())
+	require.NoError(t, ctrl.FixDefinition(ctx))
+	require.Equal(t, 1, defN)
+
+	rpt, err := ctrl.Report()
+	require.NoError(t, err)
+	require.Len(t, rpt.Failures, 1)
+	require.Equal(t, report.PhaseLoad, rpt.Failures[0].Phase)
+	require.Equal(t, filepath.Join(rootModPath, "not_exist"), rpt.Failures[0].Module)
+	require.Equal(t, "module.missing", rpt.Failures[0].Address)
+}
+
+// RewriteFixer is a fixer that rewrites the contents by the functions.
+type RewriteFixer struct {
+	Definition func(content string) (string, error)
+	Reference  func(content string) string
+}
+
+func (f RewriteFixer) FixDefinition(_ context.Context, req fixer.FixDefinitionRequest) (*fixer.FixDefinitionResponse, error) {
+	content, err := f.Definition(string(req.RawContent))
+	if err != nil {
+		return nil, err
+	}
+	return &fixer.FixDefinitionResponse{RawContent: []byte(content)}, nil
+}
+
+func (f RewriteFixer) FixReferenceOrigins(_ context.Context, req fixer.FixReferenceOriginsRequest) (*fixer.FixReferenceOriginsResponse, error) {
+	resp := &fixer.FixReferenceOriginsResponse{}
+	for _, content := range req.RawContents {
+		resp.RawContents = append(resp.RawContents, []byte(f.Reference(string(content))))
+	}
+	return resp, nil
+}
+
+func TestCtrl_ChangeRanges(t *testing.T) {
+	rootModPath := "testdata/ranges"
+
+	ctrl, err := ctrl.NewController(ctrl.Option{
+		Path: rootModPath,
+		Providers: []ctrl.Provider{
+			{
+				Addr: tfaddr.MustParseProviderSource("registry.terraform.io/hashicorp/azurerm"),
+				Fixer: RewriteFixer{
+					Definition: func(content string) (string, error) { return strings.Replace(content, "westus2", "eastus", 1), nil },
+					// Adds two lines, which shifts the blocks below
+					Reference: func(content string) string { return "(\n    " + content + "\n  )" },
+				},
+			},
+		},
+		ProviderSchemas: resourceGroupSchemas(),
+	})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	require.NoError(t, ctrl.FixReferenceOrigins(ctx))
+	require.NoError(t, ctrl.UpdateRootState())
+	require.NoError(t, ctrl.FixDefinition(ctx))
+
+	rpt, err := ctrl.Report()
+	require.NoError(t, err)
+	require.Len(t, rpt.Modules, 1)
+	require.Len(t, rpt.Modules[0].Files, 1)
+	changes := rpt.Modules[0].Files[0].Changes
+	require.Len(t, changes, 3)
+
+	require.Equal(t, report.PhaseReference, changes[0].Phase)
+	require.Equal(t, "azurerm_resource_group.a.name", changes[0].Address)
+	require.Equal(t, report.Pos{Line: 7, Column: 10, Byte: 101}, changes[0].Range.Start)
+
+	// The ranges of the definition phase are in the original file
+	require.Equal(t, report.PhaseDefinition, changes[1].Phase)
+	require.Equal(t, "azurerm_resource_group.a", changes[1].Address)
+	require.Equal(t, report.Range{Start: report.Pos{Line: 1, Column: 1, Byte: 0}, End: report.Pos{Line: 4, Column: 2, Byte: 81}}, changes[1].Range)
+	require.Equal(t, report.PhaseDefinition, changes[2].Phase)
+	require.Equal(t, "azurerm_resource_group.b", changes[2].Address)
+	require.Equal(t, report.Range{Start: report.Pos{Line: 10, Column: 1, Byte: 134}, End: report.Pos{Line: 13, Column: 2, Byte: 215}}, changes[2].Range)
+}
+
+func TestCtrl_KeepGoing(t *testing.T) {
+	rootModPath := "testdata/ranges"
+
+	newController := func(keepGoing bool) *ctrl.Controller {
+		ctrl, err := ctrl.NewController(ctrl.Option{
+			Path: rootModPath,
+			Providers: []ctrl.Provider{
+				{
+					Addr: tfaddr.MustParseProviderSource("registry.terraform.io/hashicorp/azurerm"),
+					Fixer: RewriteFixer{
+						Definition: func(content string) (string, error) {
+							if strings.Contains(content, `"a"`) {
+								return "", fmt.Errorf("can't fix a")
+							}
+							return strings.Replace(content, "westus2", "eastus", 1), nil
+						},
+						Reference: func(content string) string { return content },
+					},
+				},
+			},
+			ProviderSchemas: resourceGroupSchemas(),
+			Parallelism:     2,
+			KeepGoing:       keepGoing,
+		})
+		require.NoError(t, err)
+		return ctrl
+	}
+
+	ctx := context.Background()
+	c := newController(false)
+	require.ErrorContains(t, c.FixDefinition(ctx), "azurerm_resource_group.a: fixer fix definition: can't fix a")
+	rpt, err := c.Report()
+	require.NoError(t, err)
+	require.Empty(t, rpt.Modules)
+
+	// The failure is recorded, while the other block is still fixed
+	c = newController(true)
+	require.NoError(t, c.FixDefinition(ctx))
+	rpt, err = c.Report()
+	require.NoError(t, err)
+	require.Len(t, rpt.Failures, 1)
+	failure := rpt.Failures[0]
+	require.Equal(t, report.PhaseDefinition, failure.Phase)
+	require.Equal(t, rootModPath, failure.Module)
+	require.Equal(t, "main.tf", failure.File)
+	require.Equal(t, "azurerm_resource_group.a", failure.Address)
+	require.Equal(t, "fixer fix definition: can't fix a", failure.Error)
+	require.Equal(t, 1, failure.Range.Start.Line)
+
+	require.Len(t, rpt.Modules, 1)
+	require.Len(t, rpt.Modules[0].Files, 1)
+	changes := rpt.Modules[0].Files[0].Changes
+	require.Len(t, changes, 1)
+	require.Equal(t, "azurerm_resource_group.b", changes[0].Address)
+	require.Contains(t, changes[0].NewContent, `location = "eastus"`)
+}
+
+// SlowFixer is a fixer that takes a random time to fix each block, so that the concurrent calls complete in a
+// random order.
+type SlowFixer struct{}
+
+func (SlowFixer) FixDefinition(_ context.Context, req fixer.FixDefinitionRequest) (*fixer.FixDefinitionResponse, error) {
+	time.Sleep(time.Duration(rand.IntN(20)) * time.Millisecond)
+	return &fixer.FixDefinitionResponse{
+		RawContent:  []byte(strings.Replace(string(req.RawContent), "westus2", "eastus", 1)),
+		Diagnostics: fixer.Diagnostics{{Severity: fixer.SeverityWarning, Summary: "location changed"}},
+	}, nil
+}
+
+func (SlowFixer) FixReferenceOrigins(_ context.Context, req fixer.FixReferenceOriginsRequest) (*fixer.FixReferenceOriginsResponse, error) {
+	time.Sleep(time.Duration(rand.IntN(20)) * time.Millisecond)
+	resp := &fixer.FixReferenceOriginsResponse{}
+	for _, content := range req.RawContents {
+		resp.RawContents = append(resp.RawContents, []byte(strings.Replace(string(content), ".location", ".region", 1)))
+	}
+	return resp, nil
+}
+
+func TestCtrl_Deterministic(t *testing.T) {
+	run := func() (string, string) {
+		ctrl, err := ctrl.NewController(ctrl.Option{
+			Path: "testdata/parallel",
+			Providers: []ctrl.Provider{
+				{
+					Addr:  tfaddr.MustParseProviderSource("registry.terraform.io/hashicorp/azurerm"),
+					Fixer: SlowFixer{},
+				},
+			},
+			ProviderSchemas: resourceGroupSchemas(),
+			Parallelism:     4,
+		})
+		require.NoError(t, err)
+
+		ctx := context.Background()
+		require.NoError(t, ctrl.FixReferenceOrigins(ctx))
+		require.NoError(t, ctrl.UpdateRootState())
+		require.NoError(t, ctrl.FixDefinition(ctx))
+
+		var diff, rptJSON strings.Builder
+		changed, err := ctrl.Diff(&diff)
+		require.NoError(t, err)
+		require.True(t, changed)
+		rpt, err := ctrl.Report()
+		require.NoError(t, err)
+		require.Len(t, rpt.Diagnostics, 6)
+		require.NoError(t, rpt.WriteJSON(&rptJSON))
+		return diff.String(), rptJSON.String()
+	}
+
+	diff, rptJSON := run()
+	for range 3 {
+		ndiff, nrptJSON := run()
+		require.Equal(t, diff, ndiff)
+		require.Equal(t, rptJSON, nrptJSON)
+	}
 }
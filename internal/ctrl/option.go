@@ -2,6 +2,7 @@ package ctrl
 
 import (
 	"github.com/hashicorp/terraform-exec/tfexec"
+	tfjson "github.com/hashicorp/terraform-json"
 	tfaddr "github.com/hashicorp/terraform-registry-address"
 	"github.com/magodo/terrafix/internal/fixer"
 )
@@ -10,9 +11,44 @@ type Option struct {
 	// The root module path
 	Path string
 
-	// The target provider's fully qualified address
-	ProviderAddr tfaddr.Provider
+	// The target providers, each with the fixer that owns it
+	Providers []Provider
+
+	// The terraform used to read the provider schemas and the terraform state.
+	// It can be nil if ProviderSchemas is specified.
+	TF *tfexec.Terraform
+
+	// The schemas of the (old) providers used by the configuration. If specified, the terraform is not used, hence
+	// no "terraform init" or backend access is needed. See state.Option for details.
+	ProviderSchemas *tfjson.ProviderSchemas
+
+	// Whether to also fix the external modules (e.g. registry, git modules) installed under .terraform/modules.
+	// The fixed external modules are never written back to the module cache, but can be written to another
+	// directory via Controller.WriteExternalModules.
+	IncludeExternalModules bool
+
+	// The state file to read the terraform state from, instead of the backend configured by the root module.
+	StateFile string
+
+	// The workspace whose state is read from the backend (by default the currently selected workspace).
+	Workspace string
 
-	TF    *tfexec.Terraform
+	// The max number of concurrent fixer calls. A value less than or equal to 1 means the fixer calls are made
+	// sequentially. Otherwise, the fixers must be safe for concurrent use.
+	Parallelism int
+
+	// Whether to continue on the failure of fixing a block (or a file, or a module). The failures are recorded in
+	// the report, while the successful fixes are still applied.
+	KeepGoing bool
+
+	// The patterns of the blocks to include/exclude, which are applied to both the definitions and the reference
+	// origins (by their targets). See filter.Filter for the pattern syntax.
+	Include []string
+	Exclude []string
+}
+
+type Provider struct {
+	// The target provider's fully qualified address
+	Addr  tfaddr.Provider
 	Fixer fixer.Fixer
 }
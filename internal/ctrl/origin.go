@@ -0,0 +1,441 @@
+package ctrl
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl-lang/lang"
+	"github.com/hashicorp/hcl-lang/reference"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/magodo/terrafix/internal/fixer"
+	"github.com/magodo/terrafix/internal/jsonconfig"
+	"github.com/magodo/terrafix/internal/state"
+)
+
+// originRef is a reference origin that targets to a resource/data source of the interested provider.
+type originRef struct {
+	BlockType fixer.BlockType
+	BlockName string
+
+	// Range is the range of the whole reference origin
+	Range hcl.Range
+
+	// Content is the content of the reference origin that is sent to the fixer.
+	// For the indexed origin, the Index is stripped from it.
+	// For the origin accessed through the Symbol, the Symbol is replaced by the Prefix.
+	Content []byte
+
+	// Prefix is the address of the targeting resource/data source, e.g. azurerm_subnet.foo or data.azurerm_subnet.foo.
+	Prefix []byte
+
+	// Index is the index or splat segment following the Prefix of an indexed origin, e.g. [0], ["a"], [each.key], [*] or .*.
+	// It is nil for non-indexed origin.
+	Index []byte
+
+	// Symbol is the value symbol of a for expression that iterates the targeting resource/data source, which the
+	// origin is accessed through, e.g. s for the s.id of [for s in azurerm_subnet.x : s.id].
+	// It is nil for the origin that is not accessed through a for expression.
+	Symbol []byte
+}
+
+// newOriginRef builds the originRef from a local origin collected by hcl-lang.
+func newOriginRef(origin reference.LocalOrigin, b []byte) originRef {
+	ref := originRef{
+		BlockType: fixer.BlockTypeResource,
+		Range:     origin.Range,
+		Content:   origin.Range.SliceBytes(b),
+	}
+	if addrStepName(origin.Addr[0]) == "data" {
+		ref.BlockType = fixer.BlockTypeDataSource
+		ref.BlockName = addrStepName(origin.Addr[1])
+		ref.Prefix = []byte("data." + ref.BlockName + "." + addrStepName(origin.Addr[2]))
+	} else {
+		ref.BlockName = addrStepName(origin.Addr[0])
+		ref.Prefix = []byte(ref.BlockName + "." + addrStepName(origin.Addr[1]))
+	}
+	return ref
+}
+
+// addrStepName returns the name of the root or attribute step of an address, e.g. azurerm_subnet for the
+// attribute step ".azurerm_subnet".
+func addrStepName(step lang.AddressStep) string {
+	switch step := step.(type) {
+	case lang.RootStep:
+		return step.Name
+	case lang.AttrStep:
+		return step.Name
+	default:
+		return step.String()
+	}
+}
+
+// originAddr returns the address of the resource/data source that the origin targets to, e.g. azurerm_subnet.foo.
+// The Prefix is normalized by removing any white space, e.g. "azurerm_subnet . foo".
+func originAddr(ref originRef) string {
+	return strings.Join(strings.Fields(string(ref.Prefix)), "")
+}
+
+// RestoreIndex inserts the Index back to the fixed content, right after the first occurrence of the Prefix.
+// If the fixed content doesn't contain the Prefix (e.g. the fixer replaces the origin with a literal value),
+// it is returned as is.
+func (ref originRef) RestoreIndex(content []byte) []byte {
+	if len(ref.Index) == 0 {
+		return content
+	}
+	_, end := ref.findPrefix(content)
+	if end == -1 {
+		return content
+	}
+	var out []byte
+	out = append(out, content[:end]...)
+	out = append(out, ref.Index...)
+	out = append(out, content[end:]...)
+	return out
+}
+
+// RestoreSymbol replaces the first occurrence of the Prefix in the fixed content back with the Symbol.
+// If the fixed content doesn't contain the Prefix, it is returned as is.
+func (ref originRef) RestoreSymbol(content []byte) []byte {
+	if len(ref.Symbol) == 0 {
+		return content
+	}
+	start, end := ref.findPrefix(content)
+	if start == -1 {
+		return content
+	}
+	var out []byte
+	out = append(out, content[:start]...)
+	out = append(out, ref.Symbol...)
+	out = append(out, content[end:]...)
+	return out
+}
+
+// findPrefix returns the start and end offsets of the first occurrence of the Prefix in the content, that is not a
+// part of a longer identifier (e.g. azurerm_subnet.foo vs azurerm_subnet.foobar). It returns -1 if not found.
+func (ref originRef) findPrefix(content []byte) (int, int) {
+	for offset := 0; ; {
+		idx := bytes.Index(content[offset:], ref.Prefix)
+		if idx == -1 {
+			return -1, -1
+		}
+		start, end := offset+idx, offset+idx+len(ref.Prefix)
+		if (start > 0 && isIdentifierByte(content[start-1])) || (end < len(content) && isIdentifierByte(content[end])) {
+			offset = end
+			continue
+		}
+		return start, end
+	}
+}
+
+func isIdentifierByte(b byte) bool {
+	return b == '_' || b == '-' || ('a' <= b && b <= 'z') || ('A' <= b && b <= 'Z') || ('0' <= b && b <= '9')
+}
+
+// findIndexedOriginRefs walks the expressions of the file, and finds the reference origins that target to
+// a resource/data source (that is accepted by the filter), with an index or splat following the resource address.
+// E.g. azurerm_subnet.x[0].id, azurerm_subnet.x["a"].id, azurerm_subnet.x[each.key].id, azurerm_subnet.x[*].id.
+// These origins are not recognized by hcl-lang.
+//
+// It also finds the attribute accesses on the value symbol of a for expression that iterates a resource/data source,
+// e.g. the s.id of [for s in azurerm_subnet.x : s.id], see forSymbolOriginRefs.
+func findIndexedOriginRefs(f *hcl.File, filter func(blockType fixer.BlockType, blockName string) bool) ([]originRef, error) {
+	body, ok := f.Body.(*hclsyntax.Body)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a native HCL file", f.Body.MissingItemRange().Filename)
+	}
+
+	var refs []originRef
+	hclsyntax.VisitAll(body, func(node hclsyntax.Node) hcl.Diagnostics {
+		var (
+			prefixExpr hclsyntax.Expression
+			indexRange hcl.Range
+			attrRange  *hcl.Range
+		)
+		switch expr := node.(type) {
+		case *hclsyntax.ForExpr:
+			// e.g. [for s in azurerm_subnet.x : s.id]
+			refs = append(refs, forSymbolOriginRefs(f, expr, filter)...)
+			return nil
+		case *hclsyntax.ScopeTraversalExpr:
+			// e.g. azurerm_subnet.x[0].id
+			n := prefixLen(expr.Traversal)
+			if n == 0 || len(expr.Traversal) == n {
+				return nil
+			}
+			if _, ok := expr.Traversal[n].(hcl.TraverseIndex); !ok {
+				return nil
+			}
+			prefixExpr = &hclsyntax.ScopeTraversalExpr{
+				Traversal: expr.Traversal[:n],
+				SrcRange:  hcl.RangeBetween(expr.Traversal[0].SourceRange(), expr.Traversal[n-1].SourceRange()),
+			}
+			indexRange = expr.Traversal[n].SourceRange()
+			if len(expr.Traversal) > n+1 {
+				rng := hcl.RangeBetween(expr.Traversal[n+1].SourceRange(), expr.Traversal[len(expr.Traversal)-1].SourceRange())
+				attrRange = &rng
+			}
+		case *hclsyntax.SplatExpr:
+			// e.g. azurerm_subnet.x[*].id, azurerm_subnet.x.*.id
+			prefixExpr = expr.Source
+			indexRange = expr.MarkerRange
+			if each, ok := expr.Each.(*hclsyntax.RelativeTraversalExpr); ok {
+				if _, ok := each.Source.(*hclsyntax.AnonSymbolExpr); ok {
+					rng := each.Traversal.SourceRange()
+					attrRange = &rng
+				}
+			}
+		case *hclsyntax.RelativeTraversalExpr:
+			// e.g. azurerm_subnet.x[each.key].id
+			idxExpr, ok := expr.Source.(*hclsyntax.IndexExpr)
+			if !ok {
+				return nil
+			}
+			prefixExpr = idxExpr.Collection
+			indexRange = hcl.Range{Filename: idxExpr.Collection.Range().Filename, Start: idxExpr.Collection.Range().End, End: idxExpr.SrcRange.End}
+			rng := expr.Traversal.SourceRange()
+			attrRange = &rng
+		case *hclsyntax.IndexExpr:
+			// e.g. azurerm_subnet.x[each.key]
+			prefixExpr = expr.Collection
+			indexRange = hcl.Range{Filename: expr.Collection.Range().Filename, Start: expr.Collection.Range().End, End: expr.SrcRange.End}
+		default:
+			return nil
+		}
+
+		prefix, ok := prefixExpr.(*hclsyntax.ScopeTraversalExpr)
+		if !ok || prefixLen(prefix.Traversal) != len(prefix.Traversal) {
+			return nil
+		}
+		ref := originRef{
+			BlockType: fixer.BlockTypeResource,
+			BlockName: prefix.Traversal.RootName(),
+			Prefix:    prefix.SrcRange.SliceBytes(f.Bytes),
+			Index:     indexRange.SliceBytes(f.Bytes),
+		}
+		if ref.BlockName == "data" {
+			ref.BlockType = fixer.BlockTypeDataSource
+			ref.BlockName = prefix.Traversal[1].(hcl.TraverseAttr).Name
+		}
+		if !filter(ref.BlockType, ref.BlockName) {
+			return nil
+		}
+		ref.Range = hcl.RangeBetween(prefix.SrcRange, indexRange)
+		ref.Content = append([]byte{}, ref.Prefix...)
+		if attrRange != nil {
+			ref.Range = hcl.RangeBetween(ref.Range, *attrRange)
+			ref.Content = append(ref.Content, attrRange.SliceBytes(f.Bytes)...)
+		}
+		refs = append(refs, ref)
+		return nil
+	})
+
+	// Remove the origins that are contained by another one, e.g. the IndexExpr inside a RelativeTraversalExpr.
+	sort.Slice(refs, func(i, j int) bool {
+		if refs[i].Range.Start.Byte != refs[j].Range.Start.Byte {
+			return refs[i].Range.Start.Byte < refs[j].Range.Start.Byte
+		}
+		return refs[i].Range.End.Byte > refs[j].Range.End.Byte
+	})
+	var out []originRef
+	for _, ref := range refs {
+		if len(out) != 0 && out[len(out)-1].Range.End.Byte >= ref.Range.End.Byte {
+			continue
+		}
+		out = append(out, ref)
+	}
+	return out, nil
+}
+
+// forSymbolOriginRefs finds the attribute accesses on the value symbol of the for expression, whose collection is a
+// resource/data source (that is accepted by the filter), e.g. the s.id and s.name of
+// {for s in azurerm_subnet.x : s.name => s.id}.
+// Each of them is regarded as a reference origin of the resource/data source with the symbol replaced by its address
+// (i.e. azurerm_subnet.x.id), as the collection is expected to be the instances of a resource/data source that uses
+// count/for_each. The nested for expressions that redeclare the symbol are skipped.
+func forSymbolOriginRefs(f *hcl.File, expr *hclsyntax.ForExpr, filter func(blockType fixer.BlockType, blockName string) bool) []originRef {
+	coll, ok := expr.CollExpr.(*hclsyntax.ScopeTraversalExpr)
+	if !ok {
+		return nil
+	}
+	n := prefixLen(coll.Traversal)
+	if n == 0 || n != len(coll.Traversal) {
+		return nil
+	}
+	tmpl := originRef{
+		BlockType: fixer.BlockTypeResource,
+		BlockName: coll.Traversal.RootName(),
+		Prefix:    coll.SrcRange.SliceBytes(f.Bytes),
+		Symbol:    []byte(expr.ValVar),
+	}
+	if tmpl.BlockName == "data" {
+		tmpl.BlockType = fixer.BlockTypeDataSource
+		tmpl.BlockName = coll.Traversal[1].(hcl.TraverseAttr).Name
+	}
+	if !filter(tmpl.BlockType, tmpl.BlockName) {
+		return nil
+	}
+
+	var (
+		refs     []originRef
+		shadowed []hcl.Range
+	)
+	for _, e := range []hclsyntax.Expression{expr.KeyExpr, expr.ValExpr, expr.CondExpr} {
+		if e == nil {
+			continue
+		}
+		hclsyntax.VisitAll(e, func(node hclsyntax.Node) hcl.Diagnostics {
+			switch node := node.(type) {
+			case *hclsyntax.ForExpr:
+				// The collection of the nested for expression is still in the scope of the symbol
+				if node.KeyVar == expr.ValVar || node.ValVar == expr.ValVar {
+					for _, e := range []hclsyntax.Expression{node.KeyExpr, node.ValExpr, node.CondExpr} {
+						if e != nil {
+							shadowed = append(shadowed, e.Range())
+						}
+					}
+				}
+			case *hclsyntax.ScopeTraversalExpr:
+				trav := node.Traversal
+				if trav.RootName() != expr.ValVar || len(trav) < 2 {
+					return nil
+				}
+				if _, ok := trav[1].(hcl.TraverseAttr); !ok {
+					return nil
+				}
+				ref := tmpl
+				ref.Range = node.SrcRange
+				ref.Content = append(append([]byte{}, tmpl.Prefix...), hcl.RangeBetween(trav[1].SourceRange(), trav[len(trav)-1].SourceRange()).SliceBytes(f.Bytes)...)
+				refs = append(refs, ref)
+			}
+			return nil
+		})
+	}
+
+	var out []originRef
+	for _, ref := range refs {
+		inShadow := false
+		for _, rng := range shadowed {
+			if rng.ContainsOffset(ref.Range.Start.Byte) {
+				inShadow = true
+				break
+			}
+		}
+		if !inShadow {
+			out = append(out, ref)
+		}
+	}
+	return out
+}
+
+// findJSONOriginRefs finds the reference origins in the JSON file that target to a resource/data source
+// (that is accepted by the filter), including the indexed ones.
+// hcl-lang only recognizes the reference origins in JSON that are a single interpolation with no index
+// (e.g. "${azurerm_subnet.x.id}"), hence all the origins in JSON are found by ourselves.
+//
+// Note that only the absolute traversals are recognized, e.g. the splat in "${azurerm_subnet.x[*].id}"
+// is recognized as the reference origin azurerm_subnet.x.
+func findJSONOriginRefs(f *hcl.File, filter func(blockType fixer.BlockType, blockName string) bool) ([]originRef, error) {
+	traversals, err := jsonconfig.Traversals(f)
+	if err != nil {
+		return nil, err
+	}
+	var out []originRef
+	for _, traversal := range traversals {
+		n := prefixLen(traversal)
+		if n == 0 {
+			continue
+		}
+		ref := originRef{
+			BlockType: fixer.BlockTypeResource,
+			BlockName: traversal.RootName(),
+			Range:     traversal.SourceRange(),
+			Prefix:    hcl.RangeBetween(traversal[0].SourceRange(), traversal[n-1].SourceRange()).SliceBytes(f.Bytes),
+		}
+		if ref.BlockName == "data" {
+			ref.BlockType = fixer.BlockTypeDataSource
+			ref.BlockName = traversal[1].(hcl.TraverseAttr).Name
+		}
+		if !filter(ref.BlockType, ref.BlockName) {
+			continue
+		}
+		ref.Content = append([]byte{}, ref.Prefix...)
+		if len(traversal) > n {
+			rest := traversal[n:]
+			if _, ok := traversal[n].(hcl.TraverseIndex); ok {
+				ref.Index = traversal[n].SourceRange().SliceBytes(f.Bytes)
+				rest = traversal[n+1:]
+			}
+			if len(rest) != 0 {
+				ref.Content = append(ref.Content, hcl.RangeBetween(rest[0].SourceRange(), rest[len(rest)-1].SourceRange()).SliceBytes(f.Bytes)...)
+			}
+		}
+		out = append(out, ref)
+	}
+	return out, nil
+}
+
+// prefixLen returns the number of the leading traversal steps that compose a resource/data source address,
+// i.e. <resource type>.<resource name> or data.<data source type>.<data source name>.
+// It returns 0 if the traversal doesn't start with such an address.
+func prefixLen(traversal hcl.Traversal) int {
+	n := 2
+	if traversal.RootName() == "data" {
+		n = 3
+	}
+	if len(traversal) < n {
+		return 0
+	}
+	for _, step := range traversal[1:n] {
+		if _, ok := step.(hcl.TraverseAttr); !ok {
+			return 0
+		}
+	}
+	return n
+}
+
+// indexedOriginRefsForMod finds the indexed reference origins of the module, whose target belongs to
+// the interested provider.
+func (ctrl *Controller) indexedOriginRefsForMod(modState *state.ModuleState) ([]originRef, error) {
+	var out []originRef
+	for _, filename := range modState.Filenames() {
+		f := modState.Files[filename]
+		if jsonconfig.IsJSONFilename(filename) {
+			continue
+		}
+		refs, err := findIndexedOriginRefs(f, ctrl.originTargetFilter(modState))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, refs...)
+	}
+	return out, nil
+}
+
+// jsonOriginRefsForMod finds the reference origins in the JSON files of the module, whose target belongs to
+// the interested provider.
+func (ctrl *Controller) jsonOriginRefsForMod(modState *state.ModuleState) ([]originRef, error) {
+	var out []originRef
+	for _, filename := range modState.Filenames() {
+		f := modState.Files[filename]
+		if !jsonconfig.IsJSONFilename(filename) {
+			continue
+		}
+		refs, err := findJSONOriginRefs(f, ctrl.originTargetFilter(modState))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, refs...)
+	}
+	return out, nil
+}
+
+// originTargetFilter returns a filter that tells whether the resource/data source targeted by a reference origin
+// belongs to any target provider.
+func (ctrl *Controller) originTargetFilter(modState *state.ModuleState) func(blockType fixer.BlockType, blockName string) bool {
+	return func(blockType fixer.BlockType, blockName string) bool {
+		return ctrl.providerFor(modState, blockType, blockName, "") != nil
+	}
+}
@@ -0,0 +1,252 @@
+package ctrl
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/hcl-lang/lang"
+	"github.com/hashicorp/hcl-lang/reference"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/magodo/terrafix/internal/fixer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewOriginRef(t *testing.T) {
+	cases := []struct {
+		name      string
+		src       string
+		addr      lang.Address
+		blockType fixer.BlockType
+		blockName string
+		prefix    string
+	}{
+		{
+			name:      "resource",
+			src:       "azurerm_subnet.foo.id",
+			addr:      lang.Address{lang.RootStep{Name: "azurerm_subnet"}, lang.AttrStep{Name: "foo"}, lang.AttrStep{Name: "id"}},
+			blockType: fixer.BlockTypeResource,
+			blockName: "azurerm_subnet",
+			prefix:    "azurerm_subnet.foo",
+		},
+		{
+			name:      "data source",
+			src:       "data.azurerm_subnet.foo.id",
+			addr:      lang.Address{lang.RootStep{Name: "data"}, lang.AttrStep{Name: "azurerm_subnet"}, lang.AttrStep{Name: "foo"}, lang.AttrStep{Name: "id"}},
+			blockType: fixer.BlockTypeDataSource,
+			blockName: "azurerm_subnet",
+			prefix:    "data.azurerm_subnet.foo",
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			origin := reference.LocalOrigin{
+				Addr:  tt.addr,
+				Range: hcl.Range{Start: hcl.Pos{Byte: 0}, End: hcl.Pos{Byte: len(tt.src)}},
+			}
+			ref := newOriginRef(origin, []byte(tt.src))
+			require.Equal(t, tt.blockType, ref.BlockType)
+			require.Equal(t, tt.blockName, ref.BlockName)
+			require.Equal(t, tt.prefix, string(ref.Prefix))
+			require.Equal(t, tt.src, string(ref.Content))
+		})
+	}
+}
+
+func TestPrefixLen(t *testing.T) {
+	cases := []struct {
+		src    string
+		expect int
+	}{
+		{src: "azurerm_subnet.x", expect: 2},
+		{src: "azurerm_subnet.x.id", expect: 2},
+		{src: "azurerm_subnet.x[0].id", expect: 2},
+		{src: "data.azurerm_subnet.x.id", expect: 3},
+		{src: "data.azurerm_subnet", expect: 0},
+		{src: "azurerm_subnet", expect: 0},
+		{src: "azurerm_subnet[0].id", expect: 0},
+	}
+	for _, tt := range cases {
+		t.Run(tt.src, func(t *testing.T) {
+			trav, diags := hclsyntax.ParseTraversalAbs([]byte(tt.src), "", hcl.InitialPos)
+			require.False(t, diags.HasErrors())
+			require.Equal(t, tt.expect, prefixLen(trav))
+		})
+	}
+}
+
+func TestFindIndexedOriginRefs(t *testing.T) {
+	type expectRef struct {
+		blockType fixer.BlockType
+		blockName string
+		// The source of the whole origin
+		src     string
+		content string
+		prefix  string
+		index   string
+		symbol  string
+	}
+	cases := []struct {
+		name   string
+		expr   string
+		expect []expectRef
+	}{
+		{
+			name:   "number index",
+			expr:   "azurerm_subnet.x[0].id",
+			expect: []expectRef{{fixer.BlockTypeResource, "azurerm_subnet", "azurerm_subnet.x[0].id", "azurerm_subnet.x.id", "azurerm_subnet.x", "[0]", ""}},
+		},
+		{
+			name:   "string key",
+			expr:   `azurerm_subnet.x["a"].id`,
+			expect: []expectRef{{fixer.BlockTypeResource, "azurerm_subnet", `azurerm_subnet.x["a"].id`, "azurerm_subnet.x.id", "azurerm_subnet.x", `["a"]`, ""}},
+		},
+		{
+			name:   "each.key",
+			expr:   "azurerm_subnet.x[each.key].id",
+			expect: []expectRef{{fixer.BlockTypeResource, "azurerm_subnet", "azurerm_subnet.x[each.key].id", "azurerm_subnet.x.id", "azurerm_subnet.x", "[each.key]", ""}},
+		},
+		{
+			name:   "each.key without attribute",
+			expr:   "azurerm_subnet.x[each.key]",
+			expect: []expectRef{{fixer.BlockTypeResource, "azurerm_subnet", "azurerm_subnet.x[each.key]", "azurerm_subnet.x", "azurerm_subnet.x", "[each.key]", ""}},
+		},
+		{
+			name:   "full splat",
+			expr:   "azurerm_subnet.x[*].id",
+			expect: []expectRef{{fixer.BlockTypeResource, "azurerm_subnet", "azurerm_subnet.x[*].id", "azurerm_subnet.x.id", "azurerm_subnet.x", "[*]", ""}},
+		},
+		{
+			name:   "attribute splat",
+			expr:   "azurerm_subnet.x.*.id",
+			expect: []expectRef{{fixer.BlockTypeResource, "azurerm_subnet", "azurerm_subnet.x.*.id", "azurerm_subnet.x.id", "azurerm_subnet.x", ".*", ""}},
+		},
+		{
+			name:   "data source",
+			expr:   "data.azurerm_subnet.x[0].id",
+			expect: []expectRef{{fixer.BlockTypeDataSource, "azurerm_subnet", "data.azurerm_subnet.x[0].id", "data.azurerm_subnet.x.id", "data.azurerm_subnet.x", "[0]", ""}},
+		},
+		{
+			name: "for expression",
+			expr: "{for k, s in azurerm_subnet.x : s.name => s.ip_configuration[0].name if s.enabled}",
+			expect: []expectRef{
+				{fixer.BlockTypeResource, "azurerm_subnet", "s.name", "azurerm_subnet.x.name", "azurerm_subnet.x", "", "s"},
+				{fixer.BlockTypeResource, "azurerm_subnet", "s.ip_configuration[0].name", "azurerm_subnet.x.ip_configuration[0].name", "azurerm_subnet.x", "", "s"},
+				{fixer.BlockTypeResource, "azurerm_subnet", "s.enabled", "azurerm_subnet.x.enabled", "azurerm_subnet.x", "", "s"},
+			},
+		},
+		{
+			name: "nested for expression redeclaring the symbol",
+			expr: "[for s in azurerm_subnet.x : [for s in s.addresses : s.name]]",
+			expect: []expectRef{
+				{fixer.BlockTypeResource, "azurerm_subnet", "s.addresses", "azurerm_subnet.x.addresses", "azurerm_subnet.x", "", "s"},
+			},
+		},
+		{
+			name: "not indexed",
+			expr: "azurerm_subnet.x.id",
+		},
+		{
+			name: "not accepted by the filter",
+			expr: "foo_subnet.x[0].id",
+		},
+		{
+			name: "for expression over a non resource",
+			expr: "[for s in var.subnets : s.id]",
+		},
+	}
+	filter := func(blockType fixer.BlockType, blockName string) bool {
+		return strings.HasPrefix(blockName, "azurerm_")
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			src := []byte("locals {\n  v = " + tt.expr + "\n}\n")
+			f, diags := hclsyntax.ParseConfig(src, "main.tf", hcl.InitialPos)
+			require.False(t, diags.HasErrors(), diags.Error())
+			refs, err := findIndexedOriginRefs(f, filter)
+			require.NoError(t, err)
+			var actual []expectRef
+			for _, ref := range refs {
+				actual = append(actual, expectRef{
+					blockType: ref.BlockType,
+					blockName: ref.BlockName,
+					src:       string(ref.Range.SliceBytes(src)),
+					content:   string(ref.Content),
+					prefix:    string(ref.Prefix),
+					index:     string(ref.Index),
+					symbol:    string(ref.Symbol),
+				})
+			}
+			require.Equal(t, tt.expect, actual)
+		})
+	}
+}
+
+func TestOriginRefRestore(t *testing.T) {
+	cases := []struct {
+		name    string
+		ref     originRef
+		content string
+		expect  string
+	}{
+		{
+			name:    "index",
+			ref:     originRef{Prefix: []byte("azurerm_subnet.x"), Index: []byte("[0]")},
+			content: "azurerm_subnet.x.new_id",
+			expect:  "azurerm_subnet.x[0].new_id",
+		},
+		{
+			name:    "string key",
+			ref:     originRef{Prefix: []byte("azurerm_subnet.x"), Index: []byte(`["a"]`)},
+			content: `"${azurerm_subnet.x.new_id}"`,
+			expect:  `"${azurerm_subnet.x["a"].new_id}"`,
+		},
+		{
+			name:    "each.key",
+			ref:     originRef{Prefix: []byte("azurerm_subnet.x"), Index: []byte("[each.key]")},
+			content: "azurerm_subnet.x.new_id",
+			expect:  "azurerm_subnet.x[each.key].new_id",
+		},
+		{
+			name:    "splat",
+			ref:     originRef{Prefix: []byte("azurerm_subnet.x"), Index: []byte("[*]")},
+			content: "azurerm_subnet.x.new_id",
+			expect:  "azurerm_subnet.x[*].new_id",
+		},
+		{
+			name:    "longer identifier is skipped",
+			ref:     originRef{Prefix: []byte("azurerm_subnet.x"), Index: []byte("[0]")},
+			content: "join(azurerm_subnet.xy.id, azurerm_subnet.x.id)",
+			expect:  "join(azurerm_subnet.xy.id, azurerm_subnet.x[0].id)",
+		},
+		{
+			name:    "prefix not found",
+			ref:     originRef{Prefix: []byte("azurerm_subnet.x"), Index: []byte("[0]")},
+			content: `"literal"`,
+			expect:  `"literal"`,
+		},
+		{
+			name:    "not indexed",
+			ref:     originRef{Prefix: []byte("azurerm_subnet.x")},
+			content: "azurerm_subnet.x.new_id",
+			expect:  "azurerm_subnet.x.new_id",
+		},
+		{
+			name:    "symbol",
+			ref:     originRef{Prefix: []byte("azurerm_subnet.x"), Symbol: []byte("s")},
+			content: "azurerm_subnet.x.new_id",
+			expect:  "s.new_id",
+		},
+		{
+			name:    "symbol with a longer identifier skipped",
+			ref:     originRef{Prefix: []byte("azurerm_subnet.x"), Symbol: []byte("s")},
+			content: "coalesce(my_azurerm_subnet.x.id, azurerm_subnet.x.id)",
+			expect:  "coalesce(my_azurerm_subnet.x.id, s.id)",
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.expect, string(tt.ref.RestoreSymbol(tt.ref.RestoreIndex([]byte(tt.content)))))
+		})
+	}
+}
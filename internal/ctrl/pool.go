@@ -0,0 +1,98 @@
+package ctrl
+
+import (
+	"context"
+	"sync"
+)
+
+// runParallel calls fn for each index in [0, n), with at most parallelism calls running at the same time.
+// A parallelism less than or equal to 1 means the calls are made sequentially.
+//
+// The calls are started in the order of the index. Once any call fails, no more calls are started, and the
+// error of the failed call with the smallest index is returned. This is the same error as calling sequentially.
+// Once the ctx is done, no more calls are started either, and the ctx error is regarded as the error of the first
+// call that is not started.
+func runParallel(ctx context.Context, parallelism, n int, fn func(ctx context.Context, i int) error) error {
+	if parallelism <= 1 {
+		for i := range n {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := fn(ctx, i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed bool
+		errs   = make([]error, n)
+		sem    = make(chan struct{}, parallelism)
+	)
+	for i := range n {
+		sem <- struct{}{}
+		mu.Lock()
+		stop := failed
+		mu.Unlock()
+		if stop {
+			<-sem
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			<-sem
+			// No call of this index is running, hence no lock is needed
+			errs[i] = err
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := fn(ctx, i); err != nil {
+				mu.Lock()
+				errs[i] = err
+				failed = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runJobs calls fn for each job via runParallel, with the parallelism of the controller, and returns the error
+// of each job (indexed by the job). In the continue-on-error mode, all the jobs are run regardless of the failures.
+// Otherwise, no more jobs are started once any job fails.
+// Once the ctx is done, no more jobs are started, and the error of each job that is not started is the ctx error.
+func (ctrl *Controller) runJobs(ctx context.Context, n int, fn func(ctx context.Context, i int) error) []error {
+	errs := make([]error, n)
+	started := make([]bool, n)
+	// The error is always recorded in errs, hence the returned error is not needed.
+	_ = runParallel(ctx, ctrl.parallelism, n, func(ctx context.Context, i int) error {
+		started[i] = true
+		errs[i] = fn(ctx, i)
+		if ctrl.keepGoing {
+			return nil
+		}
+		return errs[i]
+	})
+	if err := ctx.Err(); err != nil {
+		for i := range errs {
+			if !started[i] {
+				errs[i] = err
+			}
+		}
+	}
+	return errs
+}
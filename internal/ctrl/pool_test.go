@@ -0,0 +1,151 @@
+package ctrl
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunParallel_Bound(t *testing.T) {
+	for _, parallelism := range []int{1, 3} {
+		t.Run(fmt.Sprintf("parallelism %d", parallelism), func(t *testing.T) {
+			var (
+				running, maxRunning atomic.Int32
+				mu                  sync.Mutex
+				called              []int
+			)
+			err := runParallel(context.Background(), parallelism, 20, func(_ context.Context, i int) error {
+				n := running.Add(1)
+				defer running.Add(-1)
+				for {
+					m := maxRunning.Load()
+					if n <= m || maxRunning.CompareAndSwap(m, n) {
+						break
+					}
+				}
+				time.Sleep(time.Millisecond)
+				mu.Lock()
+				called = append(called, i)
+				mu.Unlock()
+				return nil
+			})
+			require.NoError(t, err)
+			require.Len(t, called, 20)
+			require.LessOrEqual(t, int(maxRunning.Load()), parallelism)
+			if parallelism == 1 {
+				// Sequential calls are in the order of the index
+				for i := range called {
+					require.Equal(t, i, called[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRunParallel_SmallestFailingIndex(t *testing.T) {
+	for _, parallelism := range []int{1, 10} {
+		t.Run(fmt.Sprintf("parallelism %d", parallelism), func(t *testing.T) {
+			err := runParallel(context.Background(), parallelism, 10, func(_ context.Context, i int) error {
+				switch i {
+				case 2:
+					// Fails later than the job of a larger index
+					time.Sleep(20 * time.Millisecond)
+					return fmt.Errorf("job 2")
+				case 5:
+					return fmt.Errorf("job 5")
+				}
+				return nil
+			})
+			require.EqualError(t, err, "job 2")
+		})
+	}
+}
+
+func TestRunParallel_StopOnFailure(t *testing.T) {
+	var started atomic.Int32
+	err := runParallel(context.Background(), 2, 100, func(_ context.Context, i int) error {
+		started.Add(1)
+		if i == 0 {
+			return fmt.Errorf("job 0")
+		}
+		time.Sleep(time.Millisecond)
+		return nil
+	})
+	require.EqualError(t, err, "job 0")
+	require.Less(t, int(started.Load()), 100)
+}
+
+func TestRunParallel_Cancel(t *testing.T) {
+	for _, parallelism := range []int{1, 2} {
+		t.Run(fmt.Sprintf("parallelism %d", parallelism), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			var started atomic.Int32
+			err := runParallel(ctx, parallelism, 100, func(ctx context.Context, i int) error {
+				started.Add(1)
+				if i == 0 {
+					cancel()
+					return nil
+				}
+				// Hold the slot until the cancellation, so that only the first job frees a slot before it
+				<-ctx.Done()
+				return nil
+			})
+			require.ErrorIs(t, err, context.Canceled)
+			// The running calls at the cancellation are finished, but no more is started
+			require.LessOrEqual(t, int(started.Load()), parallelism)
+		})
+	}
+}
+
+func TestRunJobs(t *testing.T) {
+	fn := func(_ context.Context, i int) error {
+		if i%3 == 0 {
+			return fmt.Errorf("job %d", i)
+		}
+		return nil
+	}
+
+	// Keep going
+	ctrl := &Controller{parallelism: 4, keepGoing: true}
+	errs := ctrl.runJobs(context.Background(), 10, fn)
+	require.Len(t, errs, 10)
+	for i, err := range errs {
+		if i%3 == 0 {
+			require.EqualError(t, err, fmt.Sprintf("job %d", i))
+		} else {
+			require.NoError(t, err)
+		}
+	}
+
+	// Stop on the first failure
+	ctrl = &Controller{parallelism: 1}
+	errs = ctrl.runJobs(context.Background(), 10, fn)
+	require.EqualError(t, errs[0], "job 0")
+	for _, err := range errs[1:] {
+		require.NoError(t, err)
+	}
+
+	// The jobs not started after the cancellation result in the ctx error
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctrl = &Controller{parallelism: 1, keepGoing: true}
+	errs = ctrl.runJobs(ctx, 10, func(ctx context.Context, i int) error {
+		if i == 4 {
+			cancel()
+		}
+		return nil
+	})
+	for i, err := range errs {
+		if i <= 4 {
+			require.NoError(t, err)
+		} else {
+			require.ErrorIs(t, err, context.Canceled)
+		}
+	}
+}
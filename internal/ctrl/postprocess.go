@@ -0,0 +1,264 @@
+package ctrl
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/hashicorp/terraform-exec/tfexec"
+	tfjson "github.com/hashicorp/terraform-json"
+	tfaddr "github.com/hashicorp/terraform-registry-address"
+	"github.com/magodo/terrafix/internal/fixer"
+	"github.com/magodo/terrafix/internal/jsonconfig"
+	"github.com/magodo/terrafix/internal/report"
+	"github.com/magodo/terrafix/internal/writer"
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// Format formats the top-level blocks that are touched by the fixes (i.e. whose content differs from any block of
+// the original file) in each modified file, the same as "terraform fmt". The untouched blocks are left as is, to
+// keep the diffs small. The files in JSON syntax are skipped. It returns the paths of the formatted files.
+func (ctrl *Controller) Format() ([]string, error) {
+	paths, err := ctrl.fs.ModifiedFiles()
+	if err != nil {
+		return nil, err
+	}
+	cachePaths, err := ctrl.fs.ModifiedModuleCacheFiles()
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, path := range append(paths, cachePaths...) {
+		if jsonconfig.IsJSONFilename(path) {
+			continue
+		}
+		ob, err := ctrl.fs.ReadOriginFile(path)
+		if err != nil {
+			return nil, err
+		}
+		b, err := ctrl.fs.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		nb, err := formatTouchedBlocks(path, ob, b)
+		if err != nil {
+			return nil, fmt.Errorf("formatting %s: %v", path, err)
+		}
+		if bytes.Equal(nb, b) {
+			continue
+		}
+		if err := ctrl.fs.WriteFile(path, nb, 0644); err != nil {
+			return nil, err
+		}
+		out = append(out, path)
+	}
+	return out, nil
+}
+
+// formatTouchedBlocks formats the top-level blocks of the content b that don't exist in the original content ob.
+func formatTouchedBlocks(filename string, ob, b []byte) ([]byte, error) {
+	of, diags := hclsyntax.ParseConfig(ob, filename, hcl.InitialPos)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	f, diags := hclsyntax.ParseConfig(b, filename, hcl.InitialPos)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	origins := map[string]int{}
+	for _, blk := range of.Body.(*hclsyntax.Body).Blocks {
+		origins[string(blk.Range().SliceBytes(ob))]++
+	}
+	var updates writer.Updates
+	for _, blk := range f.Body.(*hclsyntax.Body).Blocks {
+		content := blk.Range().SliceBytes(b)
+		if origins[string(content)] > 0 {
+			origins[string(content)]--
+			continue
+		}
+		if formatted := hclwrite.Format(content); !bytes.Equal(formatted, content) {
+			updates = append(updates, writer.Update{Range: blk.Range(), Content: formatted})
+		}
+	}
+	if len(updates) == 0 {
+		return b, nil
+	}
+	return writer.UpdateContent(b, updates)
+}
+
+// devOverridesWarning is the summary of the warning that terraform always emits when the dev_overrides is in effect.
+const devOverridesWarning = "Provider development overrides are in effect"
+
+// Validate runs "terraform validate" against a temporary copy of the fixed configurations, with the providers
+// (keyed by the provider address) overridden by the executables at the paths via the "dev_overrides" of the
+// terraform CLI configuration. The temporary copy is initialized (without backend) beforehand, which installs the
+// other providers and the external modules as usual.
+//
+// The validation diagnostics are recorded in the report, with the ranges mapped back to the original files.
+// It returns whether there is any error diagnostic.
+func (ctrl *Controller) Validate(ctx context.Context, tfPath string, providerPaths map[tfaddr.Provider]string) (bool, error) {
+	dir, err := os.MkdirTemp("", "terrafix-validate-")
+	if err != nil {
+		return false, err
+	}
+	defer os.RemoveAll(dir)
+
+	wdir := filepath.Join(dir, "config")
+	if err := ctrl.fs.Write(&wdir); err != nil {
+		return false, fmt.Errorf("writing the configurations to %s: %v", wdir, err)
+	}
+
+	cliConfig, err := writeDevOverrides(filepath.Join(dir, "plugins"), providerPaths)
+	if err != nil {
+		return false, fmt.Errorf("writing the CLI configuration: %v", err)
+	}
+	cliConfigPath := filepath.Join(dir, "terraform.tfrc")
+	if err := os.WriteFile(cliConfigPath, cliConfig, 0644); err != nil {
+		return false, err
+	}
+
+	tf, err := tfexec.NewTerraform(wdir, tfPath)
+	if err != nil {
+		return false, err
+	}
+	env := map[string]string{}
+	for _, kv := range os.Environ() {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			env[k] = v
+		}
+	}
+	env = tfexec.CleanEnv(env)
+	env["TF_CLI_CONFIG_FILE"] = cliConfigPath
+	if err := tf.SetEnv(env); err != nil {
+		return false, err
+	}
+	if err := tf.Init(ctx, tfexec.Backend(false)); err != nil {
+		return false, fmt.Errorf("terraform init: %v", err)
+	}
+	out, err := tf.Validate(ctx)
+	if err != nil {
+		return false, fmt.Errorf("terraform validate: %v", err)
+	}
+	for _, diag := range out.Diagnostics {
+		// This warning is caused by the provider overrides of our own.
+		if diag.Summary == devOverridesWarning {
+			continue
+		}
+		ctrl.report.AddDiagnostic(ctrl.validateDiagnostic(diag))
+	}
+	return out.ErrorCount > 0, nil
+}
+
+// validateDiagnostic converts a diagnostic of "terraform validate", whose filename is relative to the root module,
+// to the diagnostic of the report.
+func (ctrl *Controller) validateDiagnostic(diag tfjson.Diagnostic) report.Diagnostic {
+	out := report.Diagnostic{
+		Phase:    report.PhaseValidate,
+		Module:   ctrl.path,
+		Severity: fixer.SeverityWarning,
+		Summary:  diag.Summary,
+		Detail:   diag.Detail,
+	}
+	if diag.Severity == tfjson.DiagnosticSeverityError {
+		out.Severity = fixer.SeverityError
+	}
+	if rng := diag.Range; rng != nil {
+		path := filepath.Join(ctrl.path, filepath.FromSlash(rng.Filename))
+		out.Module = filepath.Dir(path)
+		out.File = filepath.Base(path)
+		hrng := hcl.Range{
+			Start: hcl.Pos{Line: rng.Start.Line, Column: rng.Start.Column, Byte: rng.Start.Byte},
+			End:   hcl.Pos{Line: rng.End.Line, Column: rng.End.Column, Byte: rng.End.Byte},
+		}
+		// The range is of the fixed content in the temporary copy, map it back to the original content.
+		ob, oerr := ctrl.fs.ReadOriginFile(path)
+		b, err := ctrl.fs.ReadFile(path)
+		if oerr == nil && err == nil {
+			hrng = originRange(ob, b, hrng)
+		}
+		out.Range = report.NewRange(hrng)
+	}
+	return out
+}
+
+// originRange maps the range of the fixed content b back to the original content ob, see originPos.
+// The filename of the range is kept.
+func originRange(ob, b []byte, rng hcl.Range) hcl.Range {
+	if bytes.Equal(ob, b) {
+		return rng
+	}
+	start, end := originPos(ob, b, rng.Start), originPos(ob, b, rng.End)
+	if end.Byte < start.Byte {
+		end = start
+	}
+	return hcl.Range{Filename: rng.Filename, Start: start, End: end}
+}
+
+// originPos maps the position of the fixed content b back to the original content ob, via the line diff between
+// them. A position in the unchanged lines is mapped to the same position of the corresponding original line, while a
+// position in the changed lines is mapped to the beginning of the original lines that are changed.
+func originPos(ob, b []byte, pos hcl.Pos) hcl.Pos {
+	olines, lines := strings.SplitAfter(string(ob), "\n"), strings.SplitAfter(string(b), "\n")
+	line := pos.Line - 1
+	m := difflib.NewMatcherWithJunk(olines, lines, false, nil)
+	for _, op := range m.GetOpCodes() {
+		if line < op.J1 || line >= op.J2 {
+			continue
+		}
+		if op.Tag == 'e' {
+			oline := op.I1 + line - op.J1
+			return hcl.Pos{
+				Line:   oline + 1,
+				Column: pos.Column,
+				Byte:   lineOffset(olines, oline) + pos.Byte - lineOffset(lines, line),
+			}
+		}
+		return hcl.Pos{Line: op.I1 + 1, Column: 1, Byte: lineOffset(olines, op.I1)}
+	}
+	return pos
+}
+
+// lineOffset returns the byte offset of the beginning of the line (0-based) of the lines.
+func lineOffset(lines []string, line int) int {
+	var offset int
+	for _, l := range lines[:min(line, len(lines))] {
+		offset += len(l)
+	}
+	return offset
+}
+
+// writeDevOverrides links the provider executables into the plugin directory with the names expected by terraform,
+// and returns the CLI configuration that overrides the providers with them.
+func writeDevOverrides(pluginDir string, providerPaths map[tfaddr.Provider]string) ([]byte, error) {
+	var addrs []tfaddr.Provider
+	for addr := range providerPaths {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i].String() < addrs[j].String() })
+
+	var buf bytes.Buffer
+	buf.WriteString("provider_installation {\n  dev_overrides {\n")
+	for _, addr := range addrs {
+		path, err := filepath.Abs(providerPaths[addr])
+		if err != nil {
+			return nil, err
+		}
+		dir := filepath.Join(pluginDir, addr.Hostname.String(), addr.Namespace, addr.Type)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		if err := os.Symlink(path, filepath.Join(dir, "terraform-provider-"+addr.Type)); err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&buf, "    %q = %q\n", addr.String(), dir)
+	}
+	buf.WriteString("  }\n  direct {}\n}\n")
+	return buf.Bytes(), nil
+}
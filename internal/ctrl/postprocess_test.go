@@ -0,0 +1,211 @@
+package ctrl
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/hcl/v2"
+	tfjson "github.com/hashicorp/terraform-json"
+	tfaddr "github.com/hashicorp/terraform-registry-address"
+	"github.com/magodo/terrafix/internal/fixer"
+	"github.com/magodo/terrafix/internal/report"
+	"github.com/stretchr/testify/require"
+	"github.com/zclconf/go-cty/cty"
+)
+
+func TestFormatTouchedBlocks(t *testing.T) {
+	cases := []struct {
+		name   string
+		origin string
+		fixed  string
+		expect string
+	}{
+		{
+			name:   "touched block is formatted",
+			origin: "resource \"foo\" \"a\" {\n  name = \"a\"\n}\n",
+			fixed:  "resource \"foo\" \"a\" {\n  name = \"a\"\n  location = \"b\"\n}\n",
+			expect: "resource \"foo\" \"a\" {\n  name     = \"a\"\n  location = \"b\"\n}\n",
+		},
+		{
+			name:   "untouched block keeps its formatting",
+			origin: "resource \"foo\" \"a\" {\n  name = \"a\"\n  location   =  \"b\"\n}\n\nresource \"foo\" \"b\" {\n  name = \"b\"\n}\n",
+			fixed:  "resource \"foo\" \"a\" {\n  name = \"a\"\n  location   =  \"b\"\n}\n\nresource \"foo\" \"b\" {\n  name = \"b\"\n  tags = {}\n}\n",
+			expect: "resource \"foo\" \"a\" {\n  name = \"a\"\n  location   =  \"b\"\n}\n\nresource \"foo\" \"b\" {\n  name = \"b\"\n  tags = {}\n}\n",
+		},
+		{
+			name:   "touched and untouched blocks",
+			origin: "locals {\n  a   = 1\n}\n\nresource \"foo\" \"b\" {\n  name = \"b\"\n}\n",
+			fixed:  "locals {\n  a   = 1\n}\n\nresource \"foo\" \"b\" {\n  name = \"b\"\n  location = \"c\"\n}\n",
+			expect: "locals {\n  a   = 1\n}\n\nresource \"foo\" \"b\" {\n  name     = \"b\"\n  location = \"c\"\n}\n",
+		},
+		{
+			name:   "unchanged",
+			origin: "locals {\n  a   = 1\n}\n",
+			fixed:  "locals {\n  a   = 1\n}\n",
+			expect: "locals {\n  a   = 1\n}\n",
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := formatTouchedBlocks("main.tf", []byte(tt.origin), []byte(tt.fixed))
+			require.NoError(t, err)
+			require.Equal(t, tt.expect, string(b))
+		})
+	}
+}
+
+func TestOriginPos(t *testing.T) {
+	origin := "a = 1\nb = 2\nc = 3\n"
+	fixed := "a = 1\nb = 20\nbb = 3\nc = 3\n"
+	cases := []struct {
+		name   string
+		pos    hcl.Pos
+		expect hcl.Pos
+	}{
+		{
+			name:   "unchanged line before the change",
+			pos:    hcl.Pos{Line: 1, Column: 5, Byte: 4},
+			expect: hcl.Pos{Line: 1, Column: 5, Byte: 4},
+		},
+		{
+			name:   "changed line",
+			pos:    hcl.Pos{Line: 3, Column: 3, Byte: 15},
+			expect: hcl.Pos{Line: 2, Column: 1, Byte: 6},
+		},
+		{
+			name:   "unchanged line after the change",
+			pos:    hcl.Pos{Line: 4, Column: 5, Byte: 24},
+			expect: hcl.Pos{Line: 3, Column: 5, Byte: 16},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.expect, originPos([]byte(origin), []byte(fixed), tt.pos))
+		})
+	}
+}
+
+// newScriptController returns the controller of the testdata/script module, which is fixed by its ScriptFixer.
+func newScriptController(t *testing.T) *Controller {
+	fx, err := fixer.NewScriptFixer("testdata/script/fix.star")
+	require.NoError(t, err)
+	ctrl, err := NewController(Option{
+		Path:      "testdata/script",
+		Providers: []Provider{{Addr: tfaddr.MustParseProviderSource("registry.terraform.io/hashicorp/azurerm"), Fixer: fx}},
+		ProviderSchemas: &tfjson.ProviderSchemas{
+			FormatVersion: "1.0",
+			Schemas: map[string]*tfjson.ProviderSchema{
+				"registry.terraform.io/hashicorp/azurerm": {
+					ConfigSchema: &tfjson.Schema{Block: &tfjson.SchemaBlock{}},
+					ResourceSchemas: map[string]*tfjson.Schema{
+						"azurerm_resource_group": {
+							Block: &tfjson.SchemaBlock{
+								Attributes: map[string]*tfjson.SchemaAttribute{
+									"name":     {AttributeType: cty.String, Required: true},
+									"location": {AttributeType: cty.String, Optional: true},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+	return ctrl
+}
+
+func TestValidateDiagnostic(t *testing.T) {
+	rootModPath := "testdata/script"
+	ctrl := newScriptController(t)
+	require.NoError(t, ctrl.FixDefinition(context.Background()))
+
+	// The fixed content is:
+	//
+	//	resource "azurerm_resource_group" "test" {
+	//	  name = "terrafix"
+	//	  location = "westus2"
+	//	}
+	diag := func(startLine, startCol, startByte, endLine, endCol, endByte int) tfjson.Diagnostic {
+		return tfjson.Diagnostic{
+			Severity: tfjson.DiagnosticSeverityError,
+			Summary:  "invalid",
+			Range: &tfjson.Range{
+				Filename: "main.tf",
+				Start:    tfjson.Pos{Line: startLine, Column: startCol, Byte: startByte},
+				End:      tfjson.Pos{Line: endLine, Column: endCol, Byte: endByte},
+			},
+		}
+	}
+
+	// The location attribute is added, mapped to the beginning of the changed lines
+	out := ctrl.validateDiagnostic(diag(3, 3, 63, 3, 23, 83))
+	require.Equal(t, "main.tf", out.File)
+	require.Equal(t, rootModPath, out.Module)
+	require.Equal(t, fixer.SeverityError, out.Severity)
+	require.Equal(t, report.Range{Start: report.Pos{Line: 2, Column: 1, Byte: 43}, End: report.Pos{Line: 2, Column: 1, Byte: 43}}, out.Range)
+
+	// The closing brace is unchanged, but moved by one line
+	out = ctrl.validateDiagnostic(diag(4, 1, 86, 4, 2, 87))
+	require.Equal(t, report.Range{Start: report.Pos{Line: 3, Column: 1, Byte: 71}, End: report.Pos{Line: 3, Column: 2, Byte: 72}}, out.Range)
+
+	// The block header is unchanged
+	out = ctrl.validateDiagnostic(diag(1, 10, 9, 1, 34, 33))
+	require.Equal(t, report.Range{Start: report.Pos{Line: 1, Column: 10, Byte: 9}, End: report.Pos{Line: 1, Column: 34, Byte: 33}}, out.Range)
+}
+
+func TestWriteDevOverrides(t *testing.T) {
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "terraform-provider-foo")
+	require.NoError(t, os.WriteFile(bin, []byte("#!/bin/sh\n"), 0755))
+
+	pluginDir := filepath.Join(dir, "plugins")
+	b, err := writeDevOverrides(pluginDir, map[tfaddr.Provider]string{
+		tfaddr.MustParseProviderSource("registry.terraform.io/hashicorp/foo"): bin,
+		tfaddr.MustParseProviderSource("registry.terraform.io/acme/bar"):      bin,
+	})
+	require.NoError(t, err)
+
+	fooDir := filepath.Join(pluginDir, "registry.terraform.io", "hashicorp", "foo")
+	barDir := filepath.Join(pluginDir, "registry.terraform.io", "acme", "bar")
+	// Sorted by the provider address
+	require.Equal(t, `provider_installation {
+  dev_overrides {
+    "registry.terraform.io/acme/bar" = "`+barDir+`"
+    "registry.terraform.io/hashicorp/foo" = "`+fooDir+`"
+  }
+  direct {}
+}
+`, string(b))
+
+	// The executables are linked with the names expected by terraform
+	target, err := os.Readlink(filepath.Join(fooDir, "terraform-provider-foo"))
+	require.NoError(t, err)
+	require.Equal(t, bin, target)
+	target, err = os.Readlink(filepath.Join(barDir, "terraform-provider-bar"))
+	require.NoError(t, err)
+	require.Equal(t, bin, target)
+}
+
+func TestFormat(t *testing.T) {
+	ctrl := newScriptController(t)
+	require.NoError(t, ctrl.FixDefinition(context.Background()))
+
+	paths, err := ctrl.Format()
+	require.NoError(t, err)
+	require.Equal(t, []string{filepath.Join("testdata", "script", "main.tf")}, paths)
+	b, err := ctrl.fs.ReadFile(paths[0])
+	require.NoError(t, err)
+	require.Equal(t, `resource "azurerm_resource_group" "test" {
+  name     = "terrafix"
+  location = "westus2"
+}
+`, string(b))
+
+	// Nothing to format any more
+	paths, err = ctrl.Format()
+	require.NoError(t, err)
+	require.Empty(t, paths)
+}
@@ -0,0 +1,179 @@
+package ctrl
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	tfjson "github.com/hashicorp/terraform-json"
+	tfaddr "github.com/hashicorp/terraform-registry-address"
+	tfschema "github.com/hashicorp/terraform-schema/schema"
+	"github.com/magodo/terrafix/internal/fixer"
+	"github.com/magodo/terrafix/internal/jsonconfig"
+	"github.com/magodo/terrafix/internal/state"
+)
+
+// provider is a target provider, together with its schema and the fixer that owns it
+type provider struct {
+	addr     tfaddr.Provider
+	fixer    fixer.Fixer
+	psch     *tfschema.ProviderSchema
+	pschJSON *tfjson.ProviderSchema
+}
+
+// hasBlock tells whether the resource/data source is defined by this provider.
+func (p *provider) hasBlock(blockType fixer.BlockType, blockName string) bool {
+	switch blockType {
+	case fixer.BlockTypeResource:
+		_, ok := p.psch.Resources[blockName]
+		return ok
+	case fixer.BlockTypeDataSource:
+		_, ok := p.psch.DataSources[blockName]
+		return ok
+	default:
+		return false
+	}
+}
+
+// schema returns the schema of the provider/resource/data source. It returns nil if not found.
+// The blockName is ignored for the provider.
+func (p *provider) schema(blockType fixer.BlockType, blockName string) *tfjson.Schema {
+	switch blockType {
+	case fixer.BlockTypeProvider:
+		return p.pschJSON.ConfigSchema
+	case fixer.BlockTypeResource:
+		return p.pschJSON.ResourceSchemas[blockName]
+	case fixer.BlockTypeDataSource:
+		return p.pschJSON.DataSourceSchemas[blockName]
+	default:
+		return nil
+	}
+}
+
+// schemaVersion returns the schema version of the provider/resource/data source, or 0 if not found.
+func (p *provider) schemaVersion(blockType fixer.BlockType, blockName string) int {
+	if sch := p.schema(blockType, blockName); sch != nil {
+		return int(sch.Version)
+	}
+	return 0
+}
+
+// blockSchema returns the block schema of the provider/resource/data source, or nil if not found.
+func (p *provider) blockSchema(blockType fixer.BlockType, blockName string) *tfjson.SchemaBlock {
+	if sch := p.schema(blockType, blockName); sch != nil {
+		return sch.Block
+	}
+	return nil
+}
+
+// canFix tells whether the fixer claims to fix the provider/resource/data source at the schema version, see
+// fixer.CapableFixer. A stepwise fixer must claim every schema version from the version up to (but excluding) the
+// target one, as it is called once per version, see fixDefinition. It returns the reason if not.
+func (p *provider) canFix(blockType fixer.BlockType, blockName string, version int) (bool, string) {
+	cfx, ok := p.fixer.(fixer.CapableFixer)
+	if !ok {
+		return true, ""
+	}
+	last := version
+	if sfx, ok := p.fixer.(fixer.StepwiseFixer); ok {
+		if target, ok := sfx.TargetSchemaVersion(blockType, blockName); ok && target-1 > last {
+			last = target - 1
+		}
+	}
+	for v := version; v <= last; v++ {
+		if !cfx.CanFix(blockType, blockName, v) {
+			return false, fmt.Sprintf("the fixer of %s doesn't claim to fix the %s %s at schema version %d", p.addr, blockType, blockName, v)
+		}
+	}
+	return true, ""
+}
+
+// providerByAddr returns the target provider of the address, or nil if it is not a target provider.
+func (ctrl *Controller) providerByAddr(addr tfaddr.Provider) *provider {
+	for _, p := range ctrl.providers {
+		if p.addr == addr {
+			return p
+		}
+	}
+	return nil
+}
+
+// providerFor returns the target provider that defines the resource/data source, or nil if there is none.
+//
+// The provider explicitly specified by the "provider" meta-argument (the localName), if not empty, is the only
+// candidate. Otherwise, the provider implied by the resource type (e.g. azurerm for azurerm_resource_group), as is
+// resolved by the module's required_providers, is preferred, and then the first target provider that defines it.
+func (ctrl *Controller) providerFor(modState *state.ModuleState, blockType fixer.BlockType, blockName, localName string) *provider {
+	if localName != "" {
+		if p := ctrl.providerByAddr(modState.ProviderAddr(localName)); p != nil && p.hasBlock(blockType, blockName) {
+			return p
+		}
+		return nil
+	}
+	localName, _, _ = strings.Cut(blockName, "_")
+	if p := ctrl.providerByAddr(modState.ProviderAddr(localName)); p != nil && p.hasBlock(blockType, blockName) {
+		return p
+	}
+	for _, p := range ctrl.providers {
+		if p.hasBlock(blockType, blockName) {
+			return p
+		}
+	}
+	return nil
+}
+
+// blockProviderName returns the local name of the provider specified by the "provider" meta-argument of the
+// resource/data source block (e.g. google-beta for "google-beta.west"), or "" if not specified.
+func blockProviderName(blk *hcl.Block) string {
+	content, _, diags := blk.Body.PartialContent(&hcl.BodySchema{Attributes: []hcl.AttributeSchema{{Name: "provider"}}})
+	if diags.HasErrors() {
+		return ""
+	}
+	attr, ok := content.Attributes["provider"]
+	if !ok {
+		return ""
+	}
+	trav, diags := hcl.AbsTraversalForExpr(attr.Expr)
+	if diags.HasErrors() {
+		return ""
+	}
+	return trav.RootName()
+}
+
+// blockProviderNames returns the local names of the providers specified by the "provider" meta-argument of the
+// resource/data source blocks of the module, keyed by the block address (e.g. google_compute_instance.x or
+// data.google_compute_image.x). The blocks without the meta-argument are absent.
+func blockProviderNames(modState *state.ModuleState) (map[string]string, error) {
+	out := map[string]string{}
+	for _, filename := range modState.Filenames() {
+		f := modState.Files[filename]
+		var blks []*hcl.Block
+		if jsonconfig.IsJSONFilename(filename) {
+			jblks, err := jsonconfig.Blocks(f)
+			if err != nil {
+				return nil, err
+			}
+			blks = jblks
+		} else {
+			for _, blk := range f.Body.(*hclsyntax.Body).Blocks {
+				blks = append(blks, blk.AsHCLBlock())
+			}
+		}
+		for _, blk := range blks {
+			var addr string
+			switch {
+			case blk.Type == "resource" && len(blk.Labels) == 2:
+				addr = blk.Labels[0] + "." + blk.Labels[1]
+			case blk.Type == "data" && len(blk.Labels) == 2:
+				addr = "data." + blk.Labels[0] + "." + blk.Labels[1]
+			default:
+				continue
+			}
+			if name := blockProviderName(blk); name != "" {
+				out[addr] = name
+			}
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,93 @@
+package ctrl
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/magodo/terrafix/internal/fixer"
+	"github.com/magodo/terrafix/internal/validate"
+)
+
+// fixDefinition fixes the block definition by the fixer.
+//
+// A StepwiseFixer is driven one schema version at a time, from the request's version up to the target schema
+// version, with the fixed content re-parsed between steps. The block is left unchanged if it is already at
+// the target schema version.
+func fixDefinition(ctx context.Context, fx fixer.Fixer, req fixer.FixDefinitionRequest) (*fixer.FixDefinitionResponse, error) {
+	sfx, ok := fx.(fixer.StepwiseFixer)
+	if !ok {
+		return fx.FixDefinition(ctx, req)
+	}
+	target, ok := sfx.TargetSchemaVersion(req.BlockType, req.BlockName)
+	if !ok {
+		return fx.FixDefinition(ctx, req)
+	}
+
+	out := &fixer.FixDefinitionResponse{RawContent: req.RawContent}
+	for version := req.Version; version < target; version++ {
+		stepReq := req
+		stepReq.Version = version
+		stepReq.TargetVersion = version + 1
+		stepReq.RawContent = out.RawContent
+		resp, err := sfx.FixDefinition(ctx, stepReq)
+		if err != nil {
+			return nil, fmt.Errorf("upgrading from schema version %d to %d: %v", version, version+1, err)
+		}
+		if _, diags := validate.ParseBlock(resp.RawContent, "", hcl.InitialPos); diags.HasErrors() {
+			return nil, fmt.Errorf("upgrading from schema version %d to %d: invalid fixed content: %v", version, version+1, diags.Error())
+		}
+		// The subject ranges of the previous steps don't apply to the final content.
+		for i := range out.Diagnostics {
+			out.Diagnostics[i].Subject = nil
+		}
+		out.RawContent = resp.RawContent
+		out.Diagnostics = append(out.Diagnostics, resp.Diagnostics...)
+	}
+	return out, nil
+}
+
+// fixReferenceOrigins fixes the reference origins by the fixer.
+//
+// A StepwiseFixer is driven one schema version at a time, from the request's version up to the target schema
+// version, with the fixed contents re-parsed between steps. The reference origins are left unchanged if the
+// target is already at the target schema version.
+func fixReferenceOrigins(ctx context.Context, fx fixer.Fixer, req fixer.FixReferenceOriginsRequest) (*fixer.FixReferenceOriginsResponse, error) {
+	sfx, ok := fx.(fixer.StepwiseFixer)
+	if !ok {
+		return fx.FixReferenceOrigins(ctx, req)
+	}
+	target, ok := sfx.TargetSchemaVersion(req.BlockType, req.BlockName)
+	if !ok {
+		return fx.FixReferenceOrigins(ctx, req)
+	}
+
+	out := &fixer.FixReferenceOriginsResponse{
+		RawContents: req.RawContents,
+		Diagnostics: make([]fixer.Diagnostics, len(req.RawContents)),
+	}
+	for version := req.Version; version < target; version++ {
+		stepReq := req
+		stepReq.Version = version
+		stepReq.TargetVersion = version + 1
+		stepReq.RawContents = out.RawContents
+		resp, err := sfx.FixReferenceOrigins(ctx, stepReq)
+		if err != nil {
+			return nil, fmt.Errorf("upgrading from schema version %d to %d: %v", version, version+1, err)
+		}
+		if len(resp.RawContents) != len(req.RawContents) {
+			return nil, fmt.Errorf("upgrading from schema version %d to %d: expects %d contents returned, got %d", version, version+1, len(req.RawContents), len(resp.RawContents))
+		}
+		for i, content := range resp.RawContents {
+			if _, diags := hclsyntax.ParseExpression(content, "", hcl.InitialPos); diags.HasErrors() {
+				return nil, fmt.Errorf("upgrading from schema version %d to %d: invalid fixed content %q: %v", version, version+1, content, diags.Error())
+			}
+			if i < len(resp.Diagnostics) {
+				out.Diagnostics[i] = append(out.Diagnostics[i], resp.Diagnostics[i]...)
+			}
+		}
+		out.RawContents = resp.RawContents
+	}
+	return out, nil
+}
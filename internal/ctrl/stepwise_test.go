@@ -0,0 +1,208 @@
+package ctrl
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/hcl/v2"
+	tfaddr "github.com/hashicorp/terraform-registry-address"
+	"github.com/magodo/terrafix/internal/fixer"
+	"github.com/stretchr/testify/require"
+)
+
+// stepFixer is a StepwiseFixer that appends an attribute of each step to the definition, and an attribute step to
+// each reference origin.
+type stepFixer struct {
+	target    int
+	stepwise  bool
+	defReqs   []fixer.FixDefinitionRequest
+	refReqs   []fixer.FixReferenceOriginsRequest
+	dropFirst bool
+	invalid   bool
+}
+
+var _ fixer.StepwiseFixer = &stepFixer{}
+
+func (f *stepFixer) TargetSchemaVersion(fixer.BlockType, string) (int, bool) {
+	return f.target, f.stepwise
+}
+
+func (f *stepFixer) FixDefinition(_ context.Context, req fixer.FixDefinitionRequest) (*fixer.FixDefinitionResponse, error) {
+	f.defReqs = append(f.defReqs, req)
+	content := string(req.RawContent)
+	attr := fmt.Sprintf("  v%d = true\n", req.TargetVersion)
+	if f.invalid {
+		attr = "  v = \n"
+	}
+	content = strings.TrimSuffix(content, "}") + attr + "}"
+	rng := hcl.Range{Start: hcl.Pos{Line: 1, Column: 1}, End: hcl.Pos{Line: 1, Column: 2, Byte: 1}}
+	return &fixer.FixDefinitionResponse{
+		RawContent:  []byte(content),
+		Diagnostics: fixer.Diagnostics{{Severity: fixer.SeverityWarning, Summary: fmt.Sprintf("step %d", req.TargetVersion), Subject: &rng}},
+	}, nil
+}
+
+func (f *stepFixer) FixReferenceOrigins(_ context.Context, req fixer.FixReferenceOriginsRequest) (*fixer.FixReferenceOriginsResponse, error) {
+	f.refReqs = append(f.refReqs, req)
+	resp := &fixer.FixReferenceOriginsResponse{}
+	for _, content := range req.RawContents {
+		resp.RawContents = append(resp.RawContents, []byte(fmt.Sprintf("%s.v%d", content, req.TargetVersion)))
+		resp.Diagnostics = append(resp.Diagnostics, fixer.Diagnostics{{Severity: fixer.SeverityWarning, Summary: fmt.Sprintf("step %d", req.TargetVersion)}})
+	}
+	if f.dropFirst {
+		resp.RawContents = resp.RawContents[1:]
+	}
+	return resp, nil
+}
+
+func TestFixDefinition_Stepwise(t *testing.T) {
+	req := fixer.FixDefinitionRequest{
+		BlockType:  fixer.BlockTypeResource,
+		BlockName:  "foo_resource",
+		Version:    0,
+		RawContent: []byte("resource \"foo_resource\" \"test\" {\n}"),
+	}
+
+	fx := &stepFixer{target: 2, stepwise: true}
+	resp, err := fixDefinition(context.Background(), fx, req)
+	require.NoError(t, err)
+	require.Equal(t, "resource \"foo_resource\" \"test\" {\n  v1 = true\n  v2 = true\n}", string(resp.RawContent))
+	require.Len(t, fx.defReqs, 2)
+	for i, req := range fx.defReqs {
+		require.Equal(t, i, req.Version)
+		require.Equal(t, i+1, req.TargetVersion)
+	}
+	// Each step receives the content fixed by the previous step
+	require.Equal(t, "resource \"foo_resource\" \"test\" {\n  v1 = true\n}", string(fx.defReqs[1].RawContent))
+	// The subjects of the previous steps are cleared
+	require.Len(t, resp.Diagnostics, 2)
+	require.Equal(t, "step 1", resp.Diagnostics[0].Summary)
+	require.Nil(t, resp.Diagnostics[0].Subject)
+	require.Equal(t, "step 2", resp.Diagnostics[1].Summary)
+	require.NotNil(t, resp.Diagnostics[1].Subject)
+
+	// Already at the target version
+	fx = &stepFixer{target: 2, stepwise: true}
+	atTarget := req
+	atTarget.Version = 2
+	resp, err = fixDefinition(context.Background(), fx, atTarget)
+	require.NoError(t, err)
+	require.Equal(t, string(req.RawContent), string(resp.RawContent))
+	require.Empty(t, fx.defReqs)
+
+	// Not stepwise for the block, which is fixed in one call
+	fx = &stepFixer{target: 2, stepwise: false}
+	resp, err = fixDefinition(context.Background(), fx, req)
+	require.NoError(t, err)
+	require.Len(t, fx.defReqs, 1)
+	require.Equal(t, 0, fx.defReqs[0].TargetVersion)
+	require.Equal(t, "resource \"foo_resource\" \"test\" {\n  v0 = true\n}", string(resp.RawContent))
+
+	// Invalid content of a step
+	fx = &stepFixer{target: 2, stepwise: true, invalid: true}
+	_, err = fixDefinition(context.Background(), fx, req)
+	require.ErrorContains(t, err, "upgrading from schema version 0 to 1: invalid fixed content")
+	require.Len(t, fx.defReqs, 1)
+}
+
+func TestFixReferenceOrigins_Stepwise(t *testing.T) {
+	req := fixer.FixReferenceOriginsRequest{
+		BlockType:   fixer.BlockTypeResource,
+		BlockName:   "foo_resource",
+		Version:     1,
+		RawContents: [][]byte{[]byte("foo_resource.a"), []byte("foo_resource.b")},
+	}
+
+	fx := &stepFixer{target: 3, stepwise: true}
+	resp, err := fixReferenceOrigins(context.Background(), fx, req)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("foo_resource.a.v2.v3"), []byte("foo_resource.b.v2.v3")}, resp.RawContents)
+	require.Len(t, fx.refReqs, 2)
+	for i, req := range fx.refReqs {
+		require.Equal(t, i+1, req.Version)
+		require.Equal(t, i+2, req.TargetVersion)
+	}
+	require.Equal(t, [][]byte{[]byte("foo_resource.a.v2"), []byte("foo_resource.b.v2")}, fx.refReqs[1].RawContents)
+	// The diagnostics of all the steps are collected for each origin
+	require.Len(t, resp.Diagnostics, 2)
+	for _, diags := range resp.Diagnostics {
+		require.Len(t, diags, 2)
+		require.Equal(t, "step 2", diags[0].Summary)
+		require.Equal(t, "step 3", diags[1].Summary)
+	}
+
+	// Already at the target version
+	fx = &stepFixer{target: 1, stepwise: true}
+	resp, err = fixReferenceOrigins(context.Background(), fx, req)
+	require.NoError(t, err)
+	require.Equal(t, req.RawContents, resp.RawContents)
+	require.Empty(t, fx.refReqs)
+
+	// The length of the contents mismatches
+	fx = &stepFixer{target: 3, stepwise: true, dropFirst: true}
+	_, err = fixReferenceOrigins(context.Background(), fx, req)
+	require.EqualError(t, err, "upgrading from schema version 1 to 2: expects 2 contents returned, got 1")
+	require.Len(t, fx.refReqs, 1)
+}
+
+// capableStepFixer is a stepFixer that only claims to fix from the versions.
+type capableStepFixer struct {
+	stepFixer
+	versions []int
+}
+
+func (f *capableStepFixer) CanFix(_ fixer.BlockType, _ string, version int) bool {
+	return slices.Contains(f.versions, version)
+}
+
+func TestProviderCanFix_Stepwise(t *testing.T) {
+	cases := []struct {
+		name     string
+		stepwise bool
+		versions []int
+		version  int
+		reason   string
+	}{
+		{
+			name:     "every step claimed",
+			stepwise: true,
+			versions: []int{0, 1},
+		},
+		{
+			name:     "a later step not claimed",
+			stepwise: true,
+			versions: []int{0},
+			reason:   "the fixer of registry.terraform.io/hashicorp/foo doesn't claim to fix the resource foo_resource at schema version 1",
+		},
+		{
+			name:     "the starting version not claimed",
+			stepwise: true,
+			versions: []int{1},
+			reason:   "the fixer of registry.terraform.io/hashicorp/foo doesn't claim to fix the resource foo_resource at schema version 0",
+		},
+		{
+			name:     "already at the target version",
+			stepwise: true,
+			versions: []int{2},
+			version:  2,
+		},
+		{
+			name:     "not stepwise",
+			versions: []int{0},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &provider{
+				addr:  tfaddr.MustParseProviderSource("registry.terraform.io/hashicorp/foo"),
+				fixer: &capableStepFixer{stepFixer: stepFixer{target: 2, stepwise: tt.stepwise}, versions: tt.versions},
+			}
+			ok, reason := p.canFix(fixer.BlockTypeResource, "foo_resource", tt.version)
+			require.Equal(t, tt.reason == "", ok)
+			require.Equal(t, tt.reason, reason)
+		})
+	}
+}
@@ -0,0 +1,8 @@
+resource "azurerm_resource_group" "test" {
+  name     = "terrafix"
+  location = "westus2"
+}
+
+module "missing" {
+  source = "./not_exist"
+}
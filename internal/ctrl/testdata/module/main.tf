@@ -28,9 +28,17 @@ resource "azurerm_container_registry" "test" {
   sku                 = "Basic"
 }
 
+resource "azurerm_resource_group" "multi" {
+  count    = 2
+  name     = "terrafix-ctrl-${count.index}"
+  location = "westus2"
+}
+
 locals {
   vnet_location = azurerm_virtual_network.test.location
   vnet_guid     = azurerm_virtual_network.test.guid
+  rg_names      = azurerm_resource_group.multi[*].name
+  rg_first_id   = azurerm_resource_group.multi[0].id
 }
 
 module "test" {
@@ -0,0 +1,14 @@
+locals {
+  a_name     = azurerm_resource_group.a.name
+  a_location = azurerm_resource_group.a.location
+  b_name     = azurerm_resource_group.b.name
+  b_location = azurerm_resource_group.b.location
+  c_name     = azurerm_resource_group.c.name
+  c_location = azurerm_resource_group.c.location
+  d_name     = azurerm_resource_group.d.name
+  d_location = azurerm_resource_group.d.location
+  e_name     = azurerm_resource_group.e.name
+  e_location = azurerm_resource_group.e.location
+  f_name     = azurerm_resource_group.f.name
+  f_location = azurerm_resource_group.f.location
+}
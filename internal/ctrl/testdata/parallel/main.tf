@@ -0,0 +1,29 @@
+resource "azurerm_resource_group" "a" {
+  name     = "a"
+  location = "westus2"
+}
+
+resource "azurerm_resource_group" "b" {
+  name     = "b"
+  location = "westus2"
+}
+
+resource "azurerm_resource_group" "c" {
+  name     = "c"
+  location = "westus2"
+}
+
+resource "azurerm_resource_group" "d" {
+  name     = "d"
+  location = "westus2"
+}
+
+resource "azurerm_resource_group" "e" {
+  name     = "e"
+  location = "westus2"
+}
+
+resource "azurerm_resource_group" "f" {
+  name     = "f"
+  location = "westus2"
+}
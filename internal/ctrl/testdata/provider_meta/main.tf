@@ -0,0 +1,21 @@
+resource "google_compute_instance" "ga" {
+  name = "ga"
+}
+
+resource "google_compute_instance" "beta" {
+  provider = google-beta
+  name     = google_compute_instance.ga.name
+}
+
+resource "google_compute_instance" "beta_alias" {
+  provider = google-beta.west
+  name     = google_compute_instance.beta.name
+}
+
+output "beta_alias" {
+  value = google_compute_instance.beta_alias[*].name
+}
+
+provider "google-beta" {
+  alias = "west"
+}
@@ -0,0 +1,13 @@
+resource "azurerm_resource_group" "a" {
+  name     = "a"
+  location = "westus2"
+}
+
+locals {
+  name = azurerm_resource_group.a.name
+}
+
+resource "azurerm_resource_group" "b" {
+  name     = "b"
+  location = "westus2"
+}
@@ -0,0 +1,62 @@
+package ctrl
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/magodo/terrafix/internal/fixer"
+	"github.com/magodo/terrafix/internal/jsonconfig"
+	"github.com/magodo/terrafix/internal/validate"
+)
+
+// validateDefinition validates the fixed content of the block against the schema of the new provider, if the fixer
+// knows it (i.e. a TargetSchemaFixer).
+//
+// The ranges of the violations are based on the position of the original block in the file, or relative to the
+// fixed content in native syntax for a block defined in JSON.
+func validateDefinition(blk definitionBlock, content []byte) error {
+	fx, ok := blk.provider.fixer.(fixer.TargetSchemaFixer)
+	if !ok {
+		return nil
+	}
+	filename, start := blk.Range.Filename, blk.Range.Start
+	if jsonconfig.IsJSONFilename(filename) {
+		filename, start = fmt.Sprintf("fixed content of %s", blk.DefRange), hcl.InitialPos
+	}
+	nblk, diags := validate.ParseBlock(content, filename, start)
+	if diags.HasErrors() {
+		return fmt.Errorf("invalid fixed content: %v", diags.Error())
+	}
+
+	var (
+		blockType fixer.BlockType
+		blockName string
+	)
+	switch nblk.Type {
+	case "provider":
+		blockType, blockName = fixer.BlockTypeProvider, blk.provider.addr.Type
+	case "resource":
+		blockType = fixer.BlockTypeResource
+	case "data":
+		blockType = fixer.BlockTypeDataSource
+	default:
+		return fmt.Errorf("invalid fixed content: unexpected block type %q", nblk.Type)
+	}
+	if blockType != fixer.BlockTypeProvider {
+		if len(nblk.Labels) != 2 {
+			return fmt.Errorf("invalid fixed content: label length is not 2")
+		}
+		blockName = nblk.Labels[0]
+	}
+	sch, ok := fx.TargetSchema(blockType, blockName)
+	if !ok {
+		return nil
+	}
+	if sch == nil || sch.Block == nil {
+		return fmt.Errorf("invalid fixed content: %s %q is not defined by the new provider", blockType, blockName)
+	}
+	if diags := validate.Block(nblk, sch.Block); diags.HasErrors() {
+		return fmt.Errorf("invalid fixed content: %v", diags.Error())
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package filesystem
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// BackupSuffix is the suffix of the backup files created by MemFS.WriteInPlace.
+const BackupSuffix = ".terrafix.bak"
+
+// RestoreBackups walks the directory at path (skipping any hidden directory), and moves each backup file
+// created by MemFS.WriteInPlace back to its origin path.
+// It returns the restored paths.
+func RestoreBackups(path string) ([]string, error) {
+	var restored []string
+	if err := filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if p != path && strings.HasPrefix(d.Name(), ".") {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || !strings.HasSuffix(d.Name(), BackupSuffix) {
+			return nil
+		}
+		op := strings.TrimSuffix(p, BackupSuffix)
+		if err := os.Rename(p, op); err != nil {
+			return err
+		}
+		restored = append(restored, op)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return restored, nil
+}
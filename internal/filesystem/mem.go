@@ -18,11 +18,24 @@ func tfFilter(d fs.DirEntry) bool {
 	if d.IsDir() {
 		return true
 	}
-	// Allows .tf files
-	return strings.HasSuffix(d.Name(), ".tf")
+	// Allows .tf and .tf.json files
+	return strings.HasSuffix(d.Name(), ".tf") || strings.HasSuffix(d.Name(), ".tf.json")
 }
 
+// moduleCacheDir is the directory (relative to the root module) where terraform installs the external modules.
+var moduleCacheDir = filepath.Join(".terraform", "modules")
+
 func NewMemFS(path string, w io.Writer) (*MemFS, error) {
+	return newMemFS(path, w, false)
+}
+
+// NewMemFSWithModuleCache is similar to NewMemFS, except it also loads the external modules installed
+// under the .terraform/modules directory.
+func NewMemFSWithModuleCache(path string, w io.Writer) (*MemFS, error) {
+	return newMemFS(path, w, true)
+}
+
+func newMemFS(path string, w io.Writer, withModuleCache bool) (*MemFS, error) {
 	info, err := os.Stat(path)
 	if err != nil {
 		return nil, err
@@ -39,22 +52,7 @@ func NewMemFS(path string, w io.Writer) (*MemFS, error) {
 		},
 	}
 
-	if err := filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
-		if path == p {
-			return nil
-		}
-
-		if !tfFilter(d) {
-			if d.IsDir() {
-				return fs.SkipDir
-			} else {
-				return nil
-			}
-		}
-
+	addEntry := func(p string, d fs.DirEntry) error {
 		info, err := d.Info()
 		if err != nil {
 			return err
@@ -73,9 +71,45 @@ func NewMemFS(path string, w io.Writer) (*MemFS, error) {
 			entry = &memFile{
 				fileinfo: NewFileInfo(info),
 				content:  b,
+				origin:   b,
 			}
 		}
 		return memfs.addEntry(p, entry)
+	}
+
+	if err := filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == p {
+			return nil
+		}
+
+		if withModuleCache && d.IsDir() {
+			rp, err := filepath.Rel(path, p)
+			if err != nil {
+				return err
+			}
+			// Allows the module cache directory (and its parent), which are hidden directories
+			if rp == filepath.Dir(moduleCacheDir) || rp == moduleCacheDir {
+				return addEntry(p, d)
+			}
+			// Skip other directories under the .terraform directory (e.g. the providers)
+			if strings.HasPrefix(rp, filepath.Dir(moduleCacheDir)+string(filepath.Separator)) &&
+				!strings.HasPrefix(rp, moduleCacheDir+string(filepath.Separator)) {
+				return fs.SkipDir
+			}
+		}
+
+		if !tfFilter(d) {
+			if d.IsDir() {
+				return fs.SkipDir
+			} else {
+				return nil
+			}
+		}
+
+		return addEntry(p, d)
 	}); err != nil {
 		return nil, err
 	}
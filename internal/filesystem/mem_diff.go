@@ -0,0 +1,61 @@
+package filesystem
+
+import (
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// Diff writes the unified diff between the origin and the current content of each
+// modified file to w. Unmodified files are omitted.
+// It returns whether there is any file modified.
+func (m *MemFS) Diff(w io.Writer) (bool, error) {
+	paths, err := m.ModifiedFiles()
+	if err != nil {
+		return false, err
+	}
+	for _, path := range paths {
+		ob, err := m.ReadOriginFile(path)
+		if err != nil {
+			return false, err
+		}
+		nb, err := m.ReadFile(path)
+		if err != nil {
+			return false, err
+		}
+		rp, err := filepath.Rel(m.basePath, path)
+		if err != nil {
+			return false, err
+		}
+		rp = filepath.ToSlash(rp)
+		if err := difflib.WriteUnifiedDiff(w, difflib.UnifiedDiff{
+			A:        splitLines(ob),
+			B:        splitLines(nb),
+			FromFile: "a/" + rp,
+			ToFile:   "b/" + rp,
+			Context:  3,
+		}); err != nil {
+			return false, err
+		}
+	}
+	return len(paths) != 0, nil
+}
+
+// noNewlineMarker is the marker that follows the last line without a trailing newline in a unified diff.
+const noNewlineMarker = "\\ No newline at end of file\n"
+
+// splitLines splits the content into lines, each ends with a newline.
+// Different from difflib.SplitLines, it doesn't introduce an extra empty line
+// for content that ends with a newline. The last line without a trailing newline
+// is followed by the noNewlineMarker, which also makes it differ from the same
+// line with a trailing newline.
+func splitLines(b []byte) []string {
+	lines := strings.SplitAfter(string(b), "\n")
+	if lines[len(lines)-1] == "" {
+		return lines[:len(lines)-1]
+	}
+	lines[len(lines)-1] += "\n" + noNewlineMarker
+	return lines
+}
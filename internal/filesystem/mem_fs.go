@@ -1,6 +1,7 @@
 package filesystem
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"io/fs"
@@ -94,6 +95,74 @@ func (m *MemFS) ReadFile(name string) ([]byte, error) {
 	return io.ReadAll(f.buildHandle())
 }
 
+// ReadOriginFile reads the content of the file as it was when the memfs is created.
+func (m *MemFS) ReadOriginFile(name string) ([]byte, error) {
+	entry, err := m.getEntry(name)
+	if err != nil {
+		return nil, err
+	}
+	f, ok := entry.(*memFile)
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+
+	f.mu.RLocker().Lock()
+	defer f.mu.RLocker().Unlock()
+	b := make([]byte, len(f.origin))
+	copy(b, f.origin)
+	return b, nil
+}
+
+// ModifiedFiles returns the paths of the files whose content differs from the origin,
+// in lexical order. The files of the external modules in the module cache are not included.
+func (m *MemFS) ModifiedFiles() ([]string, error) {
+	var out []string
+	if err := fs.WalkDir(m, m.basePath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && m.isModuleCacheDir(path) {
+			return fs.SkipDir
+		}
+		if f, ok := d.(*memFile); ok && f.isModified() {
+			out = append(out, path)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ModifiedModuleCacheFiles returns the paths of the files of the external modules in the module cache,
+// whose content differs from the origin, in lexical order.
+func (m *MemFS) ModifiedModuleCacheFiles() ([]string, error) {
+	cacheDir := filepath.Join(m.basePath, moduleCacheDir)
+	if _, err := m.getEntry(cacheDir); err != nil {
+		// The module cache is not loaded
+		return nil, nil
+	}
+	var out []string
+	if err := fs.WalkDir(m, cacheDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if f, ok := d.(*memFile); ok && f.isModified() {
+			out = append(out, path)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// isModuleCacheDir tells whether the path is the parent directory of the module cache (i.e. .terraform)
+// of the root module.
+func (m *MemFS) isModuleCacheDir(path string) bool {
+	return filepath.Clean(path) == filepath.Join(m.basePath, filepath.Dir(moduleCacheDir))
+}
+
 func (m *MemFS) Stat(name string) (fs.FileInfo, error) {
 	entry, err := m.getEntry(name)
 	if err != nil {
@@ -155,7 +224,10 @@ func (m *memDir) getChildren() []MemEntry {
 type memFile struct {
 	fileinfo FileInfo
 	content  []byte
-	mu       sync.RWMutex
+	// origin is the content read from the OS when the memfs is created.
+	// It is only updated when the content is written back to the OS in place.
+	origin []byte
+	mu     sync.RWMutex
 }
 
 func (*memFile) isMemDirEntry() {}
@@ -185,6 +257,13 @@ func (m *memFile) Info() (fs.FileInfo, error) {
 	return m.fileinfo, nil
 }
 
+// isModified tells whether the content differs from the origin
+func (m *memFile) isModified() bool {
+	m.mu.RLocker().Lock()
+	defer m.mu.RLocker().Unlock()
+	return !bytes.Equal(m.content, m.origin)
+}
+
 func (m *memFile) buildHandle() *memFileHandle {
 	m.mu.RLocker().Lock()
 	defer m.mu.RLocker().Unlock()
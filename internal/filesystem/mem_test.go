@@ -3,6 +3,8 @@ package filesystem_test
 import (
 	"bytes"
 	"io"
+	"io/fs"
+	"os"
 	"path/filepath"
 	"testing"
 
@@ -87,3 +89,155 @@ func TestMemFS(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, eb, b)
 }
+
+func TestMemFSDiff(t *testing.T) {
+	memfs, err := filesystem.NewMemFS("testdata", nil)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	changed, err := memfs.Diff(&buf)
+	require.NoError(t, err)
+	require.False(t, changed)
+	require.Empty(t, buf.String())
+
+	require.NoError(t, memfs.WriteFile("testdata/module/b.tf", []byte("locals {\n  foo = 1\n}\n"), 0))
+
+	files, err := memfs.ModifiedFiles()
+	require.NoError(t, err)
+	require.Equal(t, []string{"testdata/module/b.tf"}, files)
+
+	changed, err = memfs.Diff(&buf)
+	require.NoError(t, err)
+	require.True(t, changed)
+	require.Equal(t, `--- a/module/b.tf
++++ b/module/b.tf
+@@ -1 +1,3 @@
+-locals {}
++locals {
++  foo = 1
++}
+`, buf.String())
+
+	// The last line without a trailing newline is marked
+	buf.Reset()
+	require.NoError(t, memfs.WriteFile("testdata/module/b.tf", []byte("locals {\n  foo = 1\n}"), 0))
+	_, err = memfs.Diff(&buf)
+	require.NoError(t, err)
+	require.Equal(t, `--- a/module/b.tf
++++ b/module/b.tf
+@@ -1 +1,3 @@
+-locals {}
++locals {
++  foo = 1
++}
+\ No newline at end of file
+`, buf.String())
+
+	// Writing back the origin content is not regarded as a change
+	require.NoError(t, memfs.WriteFile("testdata/module/b.tf", []byte("locals {}\n"), 0))
+	files, err = memfs.ModifiedFiles()
+	require.NoError(t, err)
+	require.Empty(t, files)
+}
+
+func TestMemFSWriteInPlace(t *testing.T) {
+	// Copy the testdata to a tempdir, as it will be modified
+	tmpdir := t.TempDir()
+	memfs, err := filesystem.NewMemFS("testdata", nil)
+	require.NoError(t, err)
+	require.NoError(t, memfs.Write(&tmpdir))
+
+	memfs, err = filesystem.NewMemFS(tmpdir, nil)
+	require.NoError(t, err)
+
+	apath := filepath.Join(tmpdir, "a.tf")
+	bpath := filepath.Join(tmpdir, "module", "b.tf")
+	info, err := os.Stat(apath)
+	require.NoError(t, err)
+
+	newContent := []byte("locals {\n  foo = 1\n}\n")
+	require.NoError(t, memfs.WriteFile(apath, newContent, 0))
+
+	paths, err := memfs.WriteInPlace(true)
+	require.NoError(t, err)
+	require.Equal(t, []string{apath}, paths)
+
+	b, err := os.ReadFile(apath)
+	require.NoError(t, err)
+	require.Equal(t, newContent, b)
+	ninfo, err := os.Stat(apath)
+	require.NoError(t, err)
+	require.Equal(t, info.Mode(), ninfo.Mode())
+
+	b, err = os.ReadFile(apath + filesystem.BackupSuffix)
+	require.NoError(t, err)
+	require.Equal(t, []byte("locals {}\n"), b)
+
+	// The untouched file has no backup
+	_, err = os.Stat(bpath + filesystem.BackupSuffix)
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	// Nothing is written the second time
+	paths, err = memfs.WriteInPlace(true)
+	require.NoError(t, err)
+	require.Empty(t, paths)
+
+	// The backup of an earlier run is kept by a later run
+	memfs, err = filesystem.NewMemFS(tmpdir, nil)
+	require.NoError(t, err)
+	require.NoError(t, memfs.WriteFile(apath, []byte("locals {\n  foo = 2\n}\n"), 0))
+	paths, err = memfs.WriteInPlace(true)
+	require.NoError(t, err)
+	require.Equal(t, []string{apath}, paths)
+	b, err = os.ReadFile(apath + filesystem.BackupSuffix)
+	require.NoError(t, err)
+	require.Equal(t, []byte("locals {}\n"), b)
+
+	// Restore
+	paths, err = filesystem.RestoreBackups(tmpdir)
+	require.NoError(t, err)
+	require.Equal(t, []string{apath}, paths)
+	b, err = os.ReadFile(apath)
+	require.NoError(t, err)
+	require.Equal(t, []byte("locals {}\n"), b)
+	_, err = os.Stat(apath + filesystem.BackupSuffix)
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestMemFSModuleCache(t *testing.T) {
+	memfs, err := filesystem.NewMemFSWithModuleCache("testdata", nil)
+	require.NoError(t, err)
+
+	cpath := "testdata/.terraform/modules/foo/c.tf"
+	_, err = memfs.ReadFile(cpath)
+	require.NoError(t, err)
+
+	// Only the module cache is loaded from the .terraform directory
+	_, err = memfs.Stat("testdata/.terraform/providers")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	require.NoError(t, memfs.WriteFile(cpath, []byte("locals {\n  foo = 1\n}\n"), 0))
+	require.NoError(t, memfs.WriteFile("testdata/a.tf", []byte("locals {\n  foo = 1\n}\n"), 0))
+
+	files, err := memfs.ModifiedFiles()
+	require.NoError(t, err)
+	require.Equal(t, []string{"testdata/a.tf"}, files)
+
+	files, err = memfs.ModifiedModuleCacheFiles()
+	require.NoError(t, err)
+	require.Equal(t, []string{cpath}, files)
+
+	// The module cache is never written to the output
+	tmpdir := t.TempDir()
+	require.NoError(t, memfs.Write(&tmpdir))
+	_, err = os.Stat(filepath.Join(tmpdir, ".terraform"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	vendordir := t.TempDir()
+	dirs, err := memfs.WriteModuleCache(vendordir)
+	require.NoError(t, err)
+	require.Equal(t, []string{filepath.Join(vendordir, "foo")}, dirs)
+	b, err := os.ReadFile(filepath.Join(vendordir, "foo", "c.tf"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("locals {\n  foo = 1\n}\n"), b)
+}
@@ -6,6 +6,7 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 // This file contains additional write-related methods for the MemFS and its related types
@@ -41,7 +42,8 @@ func (m *MemFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
 }
 
 // Write writes the whole FS to the target path.
-// If the path is nil, it writes to the streamWriter
+// If the path is nil, it writes to the streamWriter.
+// The external modules in the module cache are never written.
 func (m *MemFS) Write(path *string) error {
 	var p string
 	if path == nil {
@@ -50,6 +52,9 @@ func (m *MemFS) Write(path *string) error {
 				return err
 			}
 			if d.IsDir() {
+				if m.isModuleCacheDir(path) {
+					return fs.SkipDir
+				}
 				return nil
 			}
 			ep := filepath.Join(p, path)
@@ -67,6 +72,9 @@ func (m *MemFS) Write(path *string) error {
 		if err != nil {
 			return err
 		}
+		if d.IsDir() && m.isModuleCacheDir(path) {
+			return fs.SkipDir
+		}
 		rp, err := filepath.Rel(m.basePath, path)
 		if err != nil {
 			return err
@@ -87,3 +95,124 @@ func (m *MemFS) Write(path *string) error {
 		}
 	})
 }
+
+// WriteInPlace writes the modified files back to their paths in the OS, with the file modes preserved.
+// Each file is written to a temporary file in the same directory first, and then renamed to the target path,
+// so that the target file is either fully updated or untouched.
+// If backup is true, the origin content of each modified file is saved alongside it, with the BackupSuffix appended.
+// An existing backup is kept as is, as it holds the content before an earlier run, which is the one to restore.
+// It returns the paths of the written files.
+func (m *MemFS) WriteInPlace(backup bool) ([]string, error) {
+	paths, err := m.ModifiedFiles()
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		entry, err := m.getEntry(path)
+		if err != nil {
+			return nil, err
+		}
+		f := entry.(*memFile)
+
+		f.mu.Lock()
+		mode := f.fileinfo.mode.Perm()
+		if backup {
+			_, err := os.Lstat(path + BackupSuffix)
+			if err != nil && !os.IsNotExist(err) {
+				f.mu.Unlock()
+				return nil, fmt.Errorf("backing up %s: %v", path, err)
+			}
+			if os.IsNotExist(err) {
+				if err := atomicWriteFile(path+BackupSuffix, f.origin, mode); err != nil {
+					f.mu.Unlock()
+					return nil, fmt.Errorf("backing up %s: %v", path, err)
+				}
+			}
+		}
+		if err := atomicWriteFile(path, f.content, mode); err != nil {
+			f.mu.Unlock()
+			return nil, fmt.Errorf("writing %s: %v", path, err)
+		}
+		// The content on the OS is now the same as in memory
+		f.origin = f.content
+		f.mu.Unlock()
+	}
+	return paths, nil
+}
+
+// WriteModuleCache writes each external module in the module cache, that has any file modified, to a
+// subdirectory of the dir named after the module's directory name in the module cache.
+// It returns the paths of the module directories that are written to.
+func (m *MemFS) WriteModuleCache(dir string) ([]string, error) {
+	paths, err := m.ModifiedModuleCacheFiles()
+	if err != nil {
+		return nil, err
+	}
+	cacheDir := filepath.Join(m.basePath, moduleCacheDir)
+	var modNames []string
+	for _, path := range paths {
+		rp, err := filepath.Rel(cacheDir, path)
+		if err != nil {
+			return nil, err
+		}
+		modName := strings.Split(rp, string(filepath.Separator))[0]
+		if len(modNames) == 0 || modNames[len(modNames)-1] != modName {
+			modNames = append(modNames, modName)
+		}
+	}
+
+	var out []string
+	for _, modName := range modNames {
+		modDir := filepath.Join(cacheDir, modName)
+		odir := filepath.Join(dir, modName)
+		if err := fs.WalkDir(m, modDir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rp, err := filepath.Rel(modDir, path)
+			if err != nil {
+				return err
+			}
+			ep := filepath.Join(odir, rp)
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				return os.MkdirAll(ep, info.Mode())
+			}
+			b, err := m.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			return os.WriteFile(ep, b, info.Mode())
+		}); err != nil {
+			return nil, fmt.Errorf("writing module %s: %v", modDir, err)
+		}
+		out = append(out, odir)
+	}
+	return out, nil
+}
+
+// atomicWriteFile writes the data to a temporary file in the same directory of the path,
+// and then renames it to the path.
+func atomicWriteFile(path string, data []byte, perm fs.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".terrafix-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
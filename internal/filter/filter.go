@@ -0,0 +1,126 @@
+// Package filter selects the blocks to be fixed, by the resource type, the address and the module path.
+package filter
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Target is a provider/resource/data source block to be matched by the filter.
+type Target struct {
+	// The module path relative to the root module, slash separated, e.g. "modules/net". It is "." for the root module.
+	ModulePath string
+	// The static addresses of the module calls that call the module, e.g. "module.net". It is "" for the root module.
+	ModuleAddrs []string
+	// The resource/data source type, e.g. "azurerm_subnet". It is empty for the provider block.
+	Type string
+	// The address of the block relative to the module, e.g. "azurerm_subnet.a", "data.azurerm_subnet.a", "provider.azurerm".
+	Address string
+}
+
+type kind int
+
+const (
+	kindType kind = iota
+	kindAddress
+	kindModulePath
+)
+
+type pattern struct {
+	kind kind
+	glob string
+}
+
+// Filter selects the targets by the include and exclude patterns. Each pattern is a glob (see path.Match) of:
+//
+//   - The module path, if it contains a "/" or is ".", e.g. "modules/*", "./modules/net"
+//   - The full address, if it contains a ".", e.g. "module.net.azurerm_subnet.a", "module.*.azurerm_subnet.*"
+//   - The resource/data source type otherwise, e.g. "azurerm_virtual_network*"
+//
+// A target is selected if it matches any of the include patterns (or there is none), and none of the exclude patterns.
+// The zero value selects every target.
+type Filter struct {
+	includes []pattern
+	excludes []pattern
+}
+
+// New returns a filter of the include and exclude patterns.
+func New(includes, excludes []string) (*Filter, error) {
+	var f Filter
+	for _, p := range includes {
+		pt, err := parsePattern(p)
+		if err != nil {
+			return nil, err
+		}
+		f.includes = append(f.includes, pt)
+	}
+	for _, p := range excludes {
+		pt, err := parsePattern(p)
+		if err != nil {
+			return nil, err
+		}
+		f.excludes = append(f.excludes, pt)
+	}
+	return &f, nil
+}
+
+func parsePattern(p string) (pattern, error) {
+	pt := pattern{kind: kindType, glob: p}
+	switch {
+	case p == "." || strings.Contains(p, "/"):
+		pt.kind = kindModulePath
+		pt.glob = path.Clean(p)
+	case strings.Contains(p, "."):
+		pt.kind = kindAddress
+	}
+	if _, err := path.Match(pt.glob, ""); err != nil {
+		return pattern{}, fmt.Errorf("invalid pattern %q: %v", p, err)
+	}
+	return pt, nil
+}
+
+// Match tells whether the target is selected by the filter.
+func (f *Filter) Match(t Target) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.includes) != 0 && !matchAny(f.includes, t) {
+		return false
+	}
+	return !matchAny(f.excludes, t)
+}
+
+func matchAny(patterns []pattern, t Target) bool {
+	for _, p := range patterns {
+		if p.match(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p pattern) match(t Target) bool {
+	switch p.kind {
+	case kindModulePath:
+		ok, _ := path.Match(p.glob, t.ModulePath)
+		return ok
+	case kindAddress:
+		for _, modAddr := range t.ModuleAddrs {
+			addr := t.Address
+			if modAddr != "" {
+				addr = modAddr + "." + addr
+			}
+			if ok, _ := path.Match(p.glob, addr); ok {
+				return true
+			}
+		}
+		return false
+	default:
+		if t.Type == "" {
+			return false
+		}
+		ok, _ := path.Match(p.glob, t.Type)
+		return ok
+	}
+}
@@ -0,0 +1,43 @@
+package filter_test
+
+import (
+	"testing"
+
+	"github.com/magodo/terrafix/internal/filter"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilterMatch(t *testing.T) {
+	root := filter.Target{ModulePath: ".", ModuleAddrs: []string{""}, Type: "azurerm_virtual_network", Address: "azurerm_virtual_network.a"}
+	subnet := filter.Target{ModulePath: "modules/net", ModuleAddrs: []string{"module.net", "module.net2"}, Type: "azurerm_subnet", Address: "azurerm_subnet.a"}
+	provider := filter.Target{ModulePath: ".", ModuleAddrs: []string{""}, Address: "provider.azurerm"}
+
+	cases := []struct {
+		name     string
+		includes []string
+		excludes []string
+		expect   []bool // root, subnet, provider
+	}{
+		{name: "no pattern", expect: []bool{true, true, true}},
+		{name: "include type", includes: []string{"azurerm_virtual_network*"}, expect: []bool{true, false, false}},
+		{name: "include address", includes: []string{"module.net2.azurerm_subnet.a"}, expect: []bool{false, true, false}},
+		{name: "include address glob", includes: []string{"module.*"}, expect: []bool{false, true, false}},
+		{name: "include provider", includes: []string{"provider.*"}, expect: []bool{false, false, true}},
+		{name: "include module path", includes: []string{"modules/*"}, expect: []bool{false, true, false}},
+		{name: "include root module path", includes: []string{"."}, expect: []bool{true, false, true}},
+		{name: "exclude type", excludes: []string{"azurerm_subnet"}, expect: []bool{true, false, true}},
+		{name: "exclude wins", includes: []string{"azurerm_*"}, excludes: []string{"./modules/net"}, expect: []bool{true, false, false}},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := filter.New(tt.includes, tt.excludes)
+			require.NoError(t, err)
+			require.Equal(t, tt.expect, []bool{f.Match(root), f.Match(subnet), f.Match(provider)})
+		})
+	}
+}
+
+func TestNewInvalidPattern(t *testing.T) {
+	_, err := filter.New([]string{"azurerm_["}, nil)
+	require.Error(t, err)
+}
@@ -0,0 +1,101 @@
+package fixer
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+)
+
+type Severity string
+
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+)
+
+// Diagnostic is a message from the fixer about a fix, e.g. "I migrated this, but please review attribute X".
+type Diagnostic struct {
+	Severity Severity
+	Summary  string
+	Detail   string
+	// The optional range within the fixed content that this diagnostic is about, whose positions are relative
+	// to the start of the fixed content.
+	Subject *hcl.Range
+}
+
+type Diagnostics []Diagnostic
+
+func (diags Diagnostics) HasErrors() bool {
+	for _, diag := range diags {
+		if diag.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// Err returns an error that summarizes the error diagnostics, or nil if there is no error.
+func (diags Diagnostics) Err() error {
+	var msgs []string
+	for _, diag := range diags {
+		if diag.Severity != SeverityError {
+			continue
+		}
+		msg := diag.Summary
+		if diag.Detail != "" {
+			msg += ": " + diag.Detail
+		}
+		msgs = append(msgs, msg)
+	}
+	switch len(msgs) {
+	case 0:
+		return nil
+	case 1:
+		return fmt.Errorf("%s", msgs[0])
+	default:
+		return fmt.Errorf("%d problems:\n- %s", len(msgs), strings.Join(msgs, "\n- "))
+	}
+}
+
+// AttributeRange returns the range of the attribute (or nested block) in the top-level block defined by content,
+// whose path is a dot separated names (e.g. "network_rule.ip_rules"). The nested blocks are matched by their types.
+// It returns nil if the content can't be parsed or the attribute is not found.
+func AttributeRange(content []byte, path string) *hcl.Range {
+	f, diags := hclsyntax.ParseConfig(content, "", hcl.InitialPos)
+	if diags.HasErrors() {
+		return nil
+	}
+	body := f.Body.(*hclsyntax.Body)
+	if len(body.Blocks) != 1 {
+		return nil
+	}
+	body = body.Blocks[0].Body
+	names := strings.Split(path, ".")
+	for i, name := range names {
+		if attr, ok := body.Attributes[name]; ok {
+			if i != len(names)-1 {
+				return nil
+			}
+			rng := attr.SrcRange
+			return &rng
+		}
+		var found *hclsyntax.Block
+		for _, blk := range body.Blocks {
+			if blk.Type == name {
+				found = blk
+				break
+			}
+		}
+		if found == nil {
+			return nil
+		}
+		if i == len(names)-1 {
+			rng := found.Range()
+			return &rng
+		}
+		body = found.Body
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package fixer_test
+
+import (
+	"testing"
+
+	"github.com/magodo/terrafix/internal/fixer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAttributeRange(t *testing.T) {
+	content := []byte(`resource "foo" "test" {
+  name = "test"
+  network_rule {
+    ip_rules = ["1.2.3.4"]
+  }
+}`)
+	rng := fixer.AttributeRange(content, "name")
+	require.NotNil(t, rng)
+	require.Equal(t, `name = "test"`, string(rng.SliceBytes(content)))
+
+	rng = fixer.AttributeRange(content, "network_rule.ip_rules")
+	require.NotNil(t, rng)
+	require.Equal(t, `ip_rules = ["1.2.3.4"]`, string(rng.SliceBytes(content)))
+
+	require.Nil(t, fixer.AttributeRange(content, "name.foo"))
+	require.Nil(t, fixer.AttributeRange(content, "not_exist"))
+}
+
+func TestDiagnosticsErr(t *testing.T) {
+	diags := fixer.Diagnostics{
+		{Severity: fixer.SeverityWarning, Summary: "review me"},
+	}
+	require.False(t, diags.HasErrors())
+	require.NoError(t, diags.Err())
+
+	diags = append(diags, fixer.Diagnostic{Severity: fixer.SeverityError, Summary: "bad", Detail: "detail"})
+	require.True(t, diags.HasErrors())
+	require.EqualError(t, diags.Err(), "bad: detail")
+}
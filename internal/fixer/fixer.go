@@ -1,12 +1,47 @@
 package fixer
 
-import "context"
+import (
+	"context"
 
+	tfjson "github.com/hashicorp/terraform-json"
+)
+
+// Fixer fixes the configurations to match the provider's schema.
+// A Fixer used with a parallelism larger than 1 must be safe for concurrent use.
 type Fixer interface {
 	FixReferenceOrigins(context.Context, FixReferenceOriginsRequest) (*FixReferenceOriginsResponse, error)
 	FixDefinition(context.Context, FixDefinitionRequest) (*FixDefinitionResponse, error)
 }
 
+// TargetSchemaFixer is a Fixer that knows the schema of the new provider, which is used to validate the fixed blocks.
+type TargetSchemaFixer interface {
+	Fixer
+	// TargetSchema returns the schema of the provider/resource/data source in the new provider, or nil if not found.
+	// The blockName is ignored for the provider.
+	// It returns false if the fixer doesn't know the schemas after all (e.g. a RecordingFixer wrapping a fixer that
+	// isn't a TargetSchemaFixer), in which case the fixed blocks are not validated.
+	TargetSchema(blockType BlockType, blockName string) (*tfjson.Schema, bool)
+}
+
+// StepwiseFixer is a Fixer that can upgrade the configurations by one schema version per call, i.e. from the
+// request's Version to its TargetVersion (which is always Version+1).
+// The caller drives it one version at a time, up to the schema version of the new provider.
+type StepwiseFixer interface {
+	Fixer
+	// TargetSchemaVersion returns the schema version of the provider/resource/data source in the new provider.
+	// It returns false if the fixer can't upgrade the block stepwise, in which case the block is fixed in one call.
+	TargetSchemaVersion(blockType BlockType, blockName string) (int, bool)
+}
+
+// CapableFixer is a Fixer that declares which blocks it can fix. The blocks (and the reference origins targeting to
+// them) that it doesn't claim are skipped, instead of being sent to it.
+type CapableFixer interface {
+	Fixer
+	// CanFix tells whether the fixer can fix the provider/resource/data source at the schema version.
+	// The blockName is the provider type for the provider.
+	CanFix(blockType BlockType, blockName string, version int) bool
+}
+
 type BlockType string
 
 const (
@@ -19,6 +54,8 @@ type FixReferenceOriginsRequest struct {
 	BlockType BlockType
 	BlockName string
 	Version   int
+	// The schema version to upgrade to, only set for a StepwiseFixer
+	TargetVersion int
 	// The raw HCL contents of each reference origin
 	RawContents [][]byte
 }
@@ -26,19 +63,30 @@ type FixReferenceOriginsRequest struct {
 type FixReferenceOriginsResponse struct {
 	// The updated raw HCL contents of each reference origin
 	RawContents [][]byte
+	// The (non-error) diagnostics of each reference origin, indexed as RawContents (optional)
+	Diagnostics []Diagnostics
 }
 
 type FixDefinitionRequest struct {
 	BlockType BlockType
 	BlockName string
 	Version   int
+	// The schema version to upgrade to, only set for a StepwiseFixer
+	TargetVersion int
 	// The raw HCL content of this block definition
 	RawContent []byte
 	// The Terraform state (only available for resource and data source)
 	RawState []byte
+	// The Terraform state of each instance (only available for resource and data source), keyed by the
+	// absolute instance address (e.g. module.foo["a"].azurerm_resource_group.test[0]).
+	// Different from RawState, this is also available when the resource or any of its containing
+	// modules uses "count"/"for_each".
+	RawStates map[string][]byte
 }
 
 type FixDefinitionResponse struct {
 	// The updated raw HCL content of this block definition
 	RawContent []byte
+	// The (non-error) diagnostics of this block definition, e.g. warnings about the attributes to be reviewed
+	Diagnostics Diagnostics
 }
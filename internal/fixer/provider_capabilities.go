@@ -0,0 +1,217 @@
+package fixer
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/magodo/terraform-client-go/tfclient/typ"
+	"github.com/zclconf/go-cty/cty"
+)
+
+const funcNameCapabilities = "terrafix_capabilities"
+
+// ProviderProtocolVersion is the latest version of the protocol between terrafix and the provider (i.e. the
+// signatures and the semantics of the terrafix_* provider functions) that is supported.
+const ProviderProtocolVersion = 1
+
+// The parameters of the provider functions, the ones after the required parameters are optional.
+var (
+	configDefinitionParams = []providerParam{
+		{"block_type", cty.String},
+		{"block_name", cty.String},
+		{"version", cty.Number},
+		{"raw_content", cty.String},
+		{"raw_state", cty.String},
+		{"raw_states", cty.String},
+		{"target_version", cty.Number},
+	}
+	configDefinitionRequiredParams = 5
+
+	configReferencesParams = []providerParam{
+		{"block_type", cty.String},
+		{"block_name", cty.String},
+		{"version", cty.Number},
+		{"raw_contents", cty.List(cty.String)},
+		{"target_version", cty.Number},
+	}
+	configReferencesRequiredParams = 4
+)
+
+type providerParam struct {
+	name string
+	typ  cty.Type
+}
+
+// checkFunctionSignature checks the parameters of the provider function against the expected ones, of which the
+// first required ones must be present.
+func checkFunctionSignature(name string, decl typ.FunctionDecl, expected []providerParam, required int) error {
+	if decl.VariadicParameter != nil {
+		return fmt.Errorf("function %s: unexpected variadic parameter", name)
+	}
+	if len(decl.Parameters) < required || len(decl.Parameters) > len(expected) {
+		return fmt.Errorf("function %s: expects %d to %d parameters (%s), got %d", name, required, len(expected), paramNames(expected), len(decl.Parameters))
+	}
+	for i, param := range decl.Parameters {
+		if !param.Type.Equals(expected[i].typ) {
+			return fmt.Errorf("function %s: the parameter %d (%s) expects to be %s, got %s", name, i, expected[i].name, expected[i].typ.FriendlyName(), param.Type.FriendlyName())
+		}
+	}
+	return nil
+}
+
+func paramNames(params []providerParam) string {
+	var names []string
+	for _, param := range params {
+		names = append(names, param.name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// checkReturnType checks the return type of the provider function, which is either the result type, or an object
+// that carries the result (in the resultAttr attribute) and the diagnostics.
+func checkReturnType(name string, decl typ.FunctionDecl, resultType cty.Type, resultAttr string) error {
+	ty := decl.ReturnType
+	if returnsDiagnostics(ty) {
+		if !ty.HasAttribute(resultAttr) || !ty.AttributeType(resultAttr).Equals(resultType) {
+			return fmt.Errorf("function %s: the returned object expects the %q attribute of %s", name, resultAttr, resultType.FriendlyName())
+		}
+		return nil
+	}
+	if !ty.Equals(resultType) {
+		return fmt.Errorf("function %s: expects to return %s or an object with diagnostics, got %s", name, resultType.FriendlyName(), ty.FriendlyName())
+	}
+	return nil
+}
+
+// checkFunctions checks that the provider implements the terrafix functions with the expected signatures.
+func checkFunctions(funcs map[string]typ.FunctionDecl) error {
+	defDecl, hasDef := funcs[funcNameConfigDefinition]
+	refDecl, hasRef := funcs[funcNameConfigReferences]
+	if !hasDef && !hasRef {
+		return fmt.Errorf("the provider doesn't implement the terrafix functions (%s, %s)", funcNameConfigDefinition, funcNameConfigReferences)
+	}
+	if !hasDef {
+		return fmt.Errorf("the provider doesn't implement the function %s", funcNameConfigDefinition)
+	}
+	if !hasRef {
+		return fmt.Errorf("the provider doesn't implement the function %s", funcNameConfigReferences)
+	}
+	if err := checkFunctionSignature(funcNameConfigDefinition, defDecl, configDefinitionParams, configDefinitionRequiredParams); err != nil {
+		return err
+	}
+	if err := checkReturnType(funcNameConfigDefinition, defDecl, cty.String, "content"); err != nil {
+		return err
+	}
+	if err := checkFunctionSignature(funcNameConfigReferences, refDecl, configReferencesParams, configReferencesRequiredParams); err != nil {
+		return err
+	}
+	if err := checkReturnType(funcNameConfigReferences, refDecl, cty.List(cty.String), "contents"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// providerCapability is a block that the provider claims to fix.
+type providerCapability struct {
+	blockType BlockType
+	blockName string
+	// The schema versions that can be fixed from, or any version if empty
+	versions []int
+}
+
+// getCapabilities calls the optional terrafix_capabilities function, which takes no parameter and returns an object
+// in form of:
+//
+//	{
+//	  protocol_version = 1
+//	  blocks = [
+//	    {
+//	      block_type = "resource"     # provider, resource or datasource
+//	      block_name = "azurerm_foo"  # the provider type for the provider block
+//	      versions   = [0, 1]         # optional, the schema versions that can be fixed from, or any version if null
+//	    },
+//	  ]
+//	}
+//
+// The protocol_version is the version of the protocol that the provider implements (1 if null), which must not be
+// newer than ProviderProtocolVersion. It returns false if the provider doesn't implement the function, or returns
+// null blocks, in which case every block can be fixed.
+func (p *ProviderFixer) getCapabilities(ctx context.Context) ([]providerCapability, bool, error) {
+	decl, ok := p.schema.Functions[funcNameCapabilities]
+	if !ok {
+		return nil, false, nil
+	}
+	if len(decl.Parameters) != 0 || decl.VariadicParameter != nil {
+		return nil, false, fmt.Errorf("function %s: expects no parameter, got %d", funcNameCapabilities, len(decl.Parameters))
+	}
+	if !decl.ReturnType.IsObjectType() || !decl.ReturnType.HasAttribute("blocks") {
+		return nil, false, fmt.Errorf("function %s: expects to return an object with the %q attribute, got %s", funcNameCapabilities, "blocks", decl.ReturnType.FriendlyName())
+	}
+	resp, diags := p.tfc.CallFunction(ctx, typ.CallFunctionRequest{FunctionName: funcNameCapabilities})
+	if diags.HasErrors() {
+		return nil, false, diags.Err()
+	}
+	if resp.Err != nil {
+		return nil, false, fmt.Errorf("function %s: %v", funcNameCapabilities, resp.Err)
+	}
+	result := resp.Result
+	if result.IsNull() || !result.IsWhollyKnown() {
+		return nil, false, fmt.Errorf("function %s: the provider returns null result, which is a provider bug.", funcNameCapabilities)
+	}
+
+	if result.Type().HasAttribute("protocol_version") {
+		if v := result.GetAttr("protocol_version"); !v.IsNull() {
+			version, _ := v.AsBigFloat().Int64()
+			if version > ProviderProtocolVersion {
+				return nil, false, fmt.Errorf("the provider implements the terrafix protocol version %d, while only up to %d is supported, please upgrade terrafix", version, ProviderProtocolVersion)
+			}
+		}
+	}
+
+	var caps []providerCapability
+	blocks := result.GetAttr("blocks")
+	if blocks.IsNull() {
+		// No restriction, the same as not implementing the function
+		return nil, false, nil
+	}
+	for _, blk := range blocks.AsValueSlice() {
+		if blk.IsNull() || !blk.Type().IsObjectType() {
+			continue
+		}
+		c := providerCapability{
+			blockType: BlockType(stringAttr(blk, "block_type")),
+			blockName: stringAttr(blk, "block_name"),
+		}
+		if blk.Type().HasAttribute("versions") {
+			if versions := blk.GetAttr("versions"); !versions.IsNull() {
+				for _, v := range versions.AsValueSlice() {
+					if v.IsNull() || v.Type() != cty.Number {
+						continue
+					}
+					i, _ := v.AsBigFloat().Int64()
+					c.versions = append(c.versions, int(i))
+				}
+			}
+		}
+		caps = append(caps, c)
+	}
+	return caps, true, nil
+}
+
+// CanFix implements CapableFixer. Every block can be fixed if the provider doesn't declare its capabilities.
+func (p ProviderFixer) CanFix(blockType BlockType, blockName string, version int) bool {
+	if !p.hasCapabilities {
+		return true
+	}
+	for _, c := range p.capabilities {
+		if c.blockType != blockType || c.blockName != blockName {
+			continue
+		}
+		if len(c.versions) == 0 || slices.Contains(c.versions, version) {
+			return true
+		}
+	}
+	return false
+}
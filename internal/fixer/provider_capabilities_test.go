@@ -0,0 +1,151 @@
+package fixer_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/magodo/terrafix/internal/fixer"
+	"github.com/magodo/terraform-client-go/tfclient"
+	"github.com/magodo/terraform-client-go/tfclient/typ"
+	"github.com/stretchr/testify/require"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// fakeClient is a provider client that only implements the provider schema and the function calls.
+type fakeClient struct {
+	tfclient.Client
+	funcs   map[string]typ.FunctionDecl
+	results map[string]cty.Value
+	// The (non-error) diagnostics of the function calls
+	diags map[string]typ.Diagnostics
+}
+
+func (c fakeClient) GetProviderSchema() (*typ.GetProviderSchemaResponse, typ.Diagnostics) {
+	return &typ.GetProviderSchemaResponse{Functions: c.funcs}, nil
+}
+
+func (c fakeClient) CallFunction(_ context.Context, req typ.CallFunctionRequest) (*typ.CallFunctionResponse, typ.Diagnostics) {
+	return &typ.CallFunctionResponse{Result: c.results[req.FunctionName]}, c.diags[req.FunctionName]
+}
+
+func params(types ...cty.Type) []typ.FunctionParam {
+	var out []typ.FunctionParam
+	for _, ty := range types {
+		out = append(out, typ.FunctionParam{Type: ty})
+	}
+	return out
+}
+
+func terrafixFuncs() map[string]typ.FunctionDecl {
+	return map[string]typ.FunctionDecl{
+		"terrafix_config_definition": {
+			Parameters: params(cty.String, cty.String, cty.Number, cty.String, cty.String),
+			ReturnType: cty.String,
+		},
+		"terrafix_config_references": {
+			Parameters: params(cty.String, cty.String, cty.Number, cty.List(cty.String)),
+			ReturnType: cty.List(cty.String),
+		},
+	}
+}
+
+func TestNewProviderFixerSignatures(t *testing.T) {
+	fx, err := fixer.NewProviderFixer(fakeClient{funcs: terrafixFuncs()})
+	require.NoError(t, err)
+	// Every block can be fixed without the capabilities declared
+	require.True(t, fx.CanFix(fixer.BlockTypeResource, "foo_account", 0))
+
+	_, err = fixer.NewProviderFixer(fakeClient{})
+	require.ErrorContains(t, err, "the provider doesn't implement the terrafix functions")
+
+	funcs := terrafixFuncs()
+	delete(funcs, "terrafix_config_references")
+	_, err = fixer.NewProviderFixer(fakeClient{funcs: funcs})
+	require.EqualError(t, err, "the provider doesn't implement the function terrafix_config_references")
+
+	funcs = terrafixFuncs()
+	funcs["terrafix_config_definition"] = typ.FunctionDecl{
+		Parameters: params(cty.String, cty.String, cty.String, cty.String, cty.String),
+		ReturnType: cty.String,
+	}
+	_, err = fixer.NewProviderFixer(fakeClient{funcs: funcs})
+	require.EqualError(t, err, "function terrafix_config_definition: the parameter 2 (version) expects to be number, got string")
+
+	funcs = terrafixFuncs()
+	funcs["terrafix_config_references"] = typ.FunctionDecl{
+		Parameters: params(cty.String, cty.String, cty.Number),
+		ReturnType: cty.List(cty.String),
+	}
+	_, err = fixer.NewProviderFixer(fakeClient{funcs: funcs})
+	require.ErrorContains(t, err, "function terrafix_config_references: expects 4 to 5 parameters")
+
+	funcs = terrafixFuncs()
+	funcs["terrafix_config_definition"] = typ.FunctionDecl{
+		Parameters: params(cty.String, cty.String, cty.Number, cty.String, cty.String),
+		ReturnType: cty.Object(map[string]cty.Type{"diagnostics": cty.List(cty.DynamicPseudoType)}),
+	}
+	_, err = fixer.NewProviderFixer(fakeClient{funcs: funcs})
+	require.ErrorContains(t, err, `the returned object expects the "content" attribute`)
+}
+
+func TestNewProviderFixerCapabilities(t *testing.T) {
+	capType := cty.Object(map[string]cty.Type{
+		"block_type": cty.String,
+		"block_name": cty.String,
+		"versions":   cty.List(cty.Number),
+	})
+	retType := cty.Object(map[string]cty.Type{
+		"protocol_version": cty.Number,
+		"blocks":           cty.List(capType),
+	})
+	funcs := terrafixFuncs()
+	funcs["terrafix_capabilities"] = typ.FunctionDecl{ReturnType: retType}
+
+	result := cty.ObjectVal(map[string]cty.Value{
+		"protocol_version": cty.NumberIntVal(1),
+		"blocks": cty.ListVal([]cty.Value{
+			cty.ObjectVal(map[string]cty.Value{
+				"block_type": cty.StringVal("resource"),
+				"block_name": cty.StringVal("foo_account"),
+				"versions":   cty.ListVal([]cty.Value{cty.NumberIntVal(0), cty.NumberIntVal(1)}),
+			}),
+			cty.ObjectVal(map[string]cty.Value{
+				"block_type": cty.StringVal("provider"),
+				"block_name": cty.StringVal("foo"),
+				"versions":   cty.NullVal(cty.List(cty.Number)),
+			}),
+		}),
+	})
+	fx, err := fixer.NewProviderFixer(fakeClient{funcs: funcs, results: map[string]cty.Value{"terrafix_capabilities": result}})
+	require.NoError(t, err)
+	require.True(t, fx.CanFix(fixer.BlockTypeResource, "foo_account", 1))
+	require.False(t, fx.CanFix(fixer.BlockTypeResource, "foo_account", 2))
+	require.False(t, fx.CanFix(fixer.BlockTypeDataSource, "foo_account", 0))
+	require.False(t, fx.CanFix(fixer.BlockTypeResource, "foo_other", 0))
+	require.True(t, fx.CanFix(fixer.BlockTypeProvider, "foo", 3))
+
+	// Null blocks mean no restriction
+	result = cty.ObjectVal(map[string]cty.Value{
+		"protocol_version": cty.NumberIntVal(1),
+		"blocks":           cty.NullVal(cty.List(capType)),
+	})
+	fx, err = fixer.NewProviderFixer(fakeClient{funcs: funcs, results: map[string]cty.Value{"terrafix_capabilities": result}})
+	require.NoError(t, err)
+	require.True(t, fx.CanFix(fixer.BlockTypeResource, "foo_other", 0))
+
+	// Empty blocks mean nothing can be fixed
+	result = cty.ObjectVal(map[string]cty.Value{
+		"protocol_version": cty.NumberIntVal(1),
+		"blocks":           cty.ListValEmpty(capType),
+	})
+	fx, err = fixer.NewProviderFixer(fakeClient{funcs: funcs, results: map[string]cty.Value{"terrafix_capabilities": result}})
+	require.NoError(t, err)
+	require.False(t, fx.CanFix(fixer.BlockTypeResource, "foo_account", 0))
+
+	result = cty.ObjectVal(map[string]cty.Value{
+		"protocol_version": cty.NumberIntVal(2),
+		"blocks":           cty.ListValEmpty(capType),
+	})
+	_, err = fixer.NewProviderFixer(fakeClient{funcs: funcs, results: map[string]cty.Value{"terrafix_capabilities": result}})
+	require.ErrorContains(t, err, "the provider implements the terrafix protocol version 2, while only up to 1 is supported")
+}
@@ -2,43 +2,164 @@ package fixer
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 
+	tfjson "github.com/hashicorp/terraform-json"
 	"github.com/magodo/terraform-client-go/tfclient"
 	"github.com/magodo/terraform-client-go/tfclient/typ"
 	"github.com/zclconf/go-cty/cty"
 )
 
+const (
+	funcNameConfigDefinition = "terrafix_config_definition"
+	funcNameConfigReferences = "terrafix_config_references"
+)
+
+// ProviderFixer fixes the configurations by calling the provider functions.
+// It is safe for concurrent use, as it is immutable once created, and the function calls
+// are made through the gRPC client that can be shared by multiple goroutines.
 type ProviderFixer struct {
 	tfc tfclient.Client
+	// The schema of the (new) provider
+	schema *typ.GetProviderSchemaResponse
+	// Whether the provider's definition function accepts the optional 6th parameter, which is the JSON encoded
+	// object of the terraform states of all the resource instances.
+	acceptRawStates bool
+	// Whether the provider's definition function returns an object with the fixed content and the diagnostics,
+	// instead of the fixed content only.
+	definitionWithDiags bool
+	// Whether the provider's references function returns an object with the fixed contents and the diagnostics,
+	// instead of the fixed contents only.
+	referencesWithDiags bool
+	// Whether the provider's functions accept the target schema version as the last parameter, i.e. the 7th one of
+	// the definition function and the 5th one of the references function, so that they can be driven stepwise.
+	stepwise bool
+	// Whether the provider declares the blocks that it can fix, via the optional terrafix_capabilities function.
+	hasCapabilities bool
+	capabilities    []providerCapability
 }
 
-var _ Fixer = ProviderFixer{}
+var (
+	_ StepwiseFixer     = ProviderFixer{}
+	_ TargetSchemaFixer = ProviderFixer{}
+	_ CapableFixer      = ProviderFixer{}
+)
 
+// NewProviderFixer creates the fixer after verifying that the provider implements the terrafix functions with the
+// expected signatures, and discovers the blocks that the provider can fix (see getCapabilities).
 func NewProviderFixer(c tfclient.Client) (*ProviderFixer, error) {
-	return &ProviderFixer{tfc: c}, nil
+	schResp, diags := c.GetProviderSchema()
+	if diags.HasErrors() {
+		return nil, fmt.Errorf("get provider schema: %v", diags.Err())
+	}
+	if err := checkFunctions(schResp.Functions); err != nil {
+		return nil, err
+	}
+	fixer := &ProviderFixer{tfc: c, schema: schResp}
+	defDecl := schResp.Functions[funcNameConfigDefinition]
+	fixer.acceptRawStates = len(defDecl.Parameters) > 5
+	fixer.definitionWithDiags = returnsDiagnostics(defDecl.ReturnType)
+	refDecl := schResp.Functions[funcNameConfigReferences]
+	fixer.referencesWithDiags = returnsDiagnostics(refDecl.ReturnType)
+	fixer.stepwise = len(defDecl.Parameters) > 6 && len(refDecl.Parameters) > 4
+
+	caps, ok, err := fixer.getCapabilities(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	fixer.hasCapabilities, fixer.capabilities = ok, caps
+	return fixer, nil
 }
 
-var _ Fixer = ProviderFixer{}
+// TargetSchemaVersion implements StepwiseFixer.
+func (p ProviderFixer) TargetSchemaVersion(blockType BlockType, blockName string) (int, bool) {
+	if !p.stepwise {
+		return 0, false
+	}
+	sch, _ := p.TargetSchema(blockType, blockName)
+	if sch == nil {
+		return 0, false
+	}
+	return int(sch.Version), true
+}
+
+// TargetSchema implements TargetSchemaFixer.
+func (p ProviderFixer) TargetSchema(blockType BlockType, blockName string) (*tfjson.Schema, bool) {
+	var (
+		sch tfjson.Schema
+		ok  bool
+	)
+	switch blockType {
+	case BlockTypeProvider:
+		sch, ok = p.schema.Provider, true
+	case BlockTypeResource:
+		sch, ok = p.schema.ResourceTypes[blockName]
+	case BlockTypeDataSource:
+		sch, ok = p.schema.DataSources[blockName]
+	}
+	if !ok {
+		return nil, true
+	}
+	return &sch, true
+}
 
 func (p ProviderFixer) FixDefinition(ctx context.Context, req FixDefinitionRequest) (*FixDefinitionResponse, error) {
+	args := []cty.Value{
+		cty.StringVal(string(req.BlockType)),
+		cty.StringVal(req.BlockName),
+		cty.NumberIntVal(int64(req.Version)),
+		cty.StringVal(string(req.RawContent)),
+		cty.StringVal(string(req.RawState)),
+	}
+	if p.acceptRawStates {
+		states := map[string]json.RawMessage{}
+		for addr, state := range req.RawStates {
+			states[addr] = state
+		}
+		b, err := json.Marshal(states)
+		if err != nil {
+			return nil, fmt.Errorf("marshal raw states: %v", err)
+		}
+		args = append(args, cty.StringVal(string(b)))
+	}
+	if p.stepwise {
+		args = append(args, cty.NumberIntVal(int64(req.TargetVersion)))
+	}
 	resp, diags := p.tfc.CallFunction(ctx, typ.CallFunctionRequest{
-		FunctionName: "terrafix_config_definition",
-		Arguments: []cty.Value{
-			cty.StringVal(string(req.BlockType)),
-			cty.StringVal(req.BlockName),
-			cty.NumberIntVal(int64(req.Version)),
-			cty.StringVal(string(req.RawContent)),
-			cty.StringVal(string(req.RawState)),
-		},
+		FunctionName: funcNameConfigDefinition,
+		Arguments:    args,
 	})
 	if diags.HasErrors() {
 		return nil, diags.Err()
 	}
 	if resp.Err != nil {
-		return nil, diags.Err()
+		return nil, fmt.Errorf("function %s: %v", funcNameConfigDefinition, resp.Err)
+	}
+	if resp.Result.IsNull() {
+		return nil, fmt.Errorf("the provider returns null result, which is a provider bug.")
+	}
+	fdiags := fromTFClientDiagnostics(diags)
+	if !p.definitionWithDiags {
+		return &FixDefinitionResponse{RawContent: []byte(resp.Result.AsString()), Diagnostics: fdiags}, nil
+	}
+
+	content := resp.Result.GetAttr("content")
+	if content.IsNull() {
+		return nil, fmt.Errorf("the provider returns null content, which is a provider bug.")
 	}
-	return &FixDefinitionResponse{RawContent: []byte(resp.Result.AsString())}, nil
+	rawContent := []byte(content.AsString())
+	for _, pdiag := range decodeDiagnostics(resp.Result.GetAttr("diagnostics")) {
+		diag := pdiag.Diagnostic
+		if pdiag.Attribute != "" {
+			diag.Subject = AttributeRange(rawContent, pdiag.Attribute)
+		}
+		fdiags = append(fdiags, diag)
+	}
+	if err := fdiags.Err(); err != nil {
+		return nil, err
+	}
+	return &FixDefinitionResponse{RawContent: rawContent, Diagnostics: fdiags}, nil
 }
 
 func (p ProviderFixer) FixReferenceOrigins(ctx context.Context, req FixReferenceOriginsRequest) (*FixReferenceOriginsResponse, error) {
@@ -46,25 +167,38 @@ func (p ProviderFixer) FixReferenceOrigins(ctx context.Context, req FixReference
 	for _, content := range req.RawContents {
 		contents = append(contents, cty.StringVal(string(content)))
 	}
+	args := []cty.Value{
+		cty.StringVal(string(req.BlockType)),
+		cty.StringVal(req.BlockName),
+		cty.NumberIntVal(int64(req.Version)),
+		cty.ListVal(contents),
+	}
+	if p.stepwise {
+		args = append(args, cty.NumberIntVal(int64(req.TargetVersion)))
+	}
 	resp, diags := p.tfc.CallFunction(ctx, typ.CallFunctionRequest{
-		FunctionName: "terrafix_config_references",
-		Arguments: []cty.Value{
-			cty.StringVal(string(req.BlockType)),
-			cty.StringVal(req.BlockName),
-			cty.NumberIntVal(int64(req.Version)),
-			cty.ListVal(contents),
-		},
+		FunctionName: funcNameConfigReferences,
+		Arguments:    args,
 	})
 	if diags.HasErrors() {
 		return nil, diags.Err()
 	}
 	if resp.Err != nil {
-		return nil, diags.Err()
+		return nil, fmt.Errorf("function %s: %v", funcNameConfigReferences, resp.Err)
 	}
 	if resp.Result.IsNull() {
 		return nil, fmt.Errorf("the provider returns null result, which is a provider bug.")
 	}
-	l := resp.Result.AsValueSlice()
+	result := resp.Result
+	var pdiags []providerDiagnostic
+	if p.referencesWithDiags {
+		result = resp.Result.GetAttr("contents")
+		if result.IsNull() {
+			return nil, fmt.Errorf("the provider returns null contents, which is a provider bug.")
+		}
+		pdiags = decodeDiagnostics(resp.Result.GetAttr("diagnostics"))
+	}
+	l := result.AsValueSlice()
 	if len(l) != len(req.RawContents) {
 		return nil, fmt.Errorf("the provider's response length doesn't match the request length %d, got=%d, which is a provider bug.", len(req.RawContents), len(l))
 	}
@@ -72,5 +206,114 @@ func (p ProviderFixer) FixReferenceOrigins(ctx context.Context, req FixReference
 	for _, content := range l {
 		updatedContents = append(updatedContents, []byte(content.AsString()))
 	}
-	return &FixReferenceOriginsResponse{RawContents: updatedContents}, nil
+
+	// The diagnostics not about a specific reference origin are attached to all of them.
+	odiags := make([]Diagnostics, len(l))
+	var errs Diagnostics
+	for _, diag := range fromTFClientDiagnostics(diags) {
+		for i := range odiags {
+			odiags[i] = append(odiags[i], diag)
+		}
+	}
+	for _, pdiag := range pdiags {
+		if pdiag.Severity == SeverityError {
+			errs = append(errs, pdiag.Diagnostic)
+			continue
+		}
+		if pdiag.Index == nil {
+			for i := range odiags {
+				odiags[i] = append(odiags[i], pdiag.Diagnostic)
+			}
+			continue
+		}
+		if *pdiag.Index < 0 || *pdiag.Index >= len(odiags) {
+			return nil, fmt.Errorf("the provider returns a diagnostic of an out of range index %d, which is a provider bug.", *pdiag.Index)
+		}
+		odiags[*pdiag.Index] = append(odiags[*pdiag.Index], pdiag.Diagnostic)
+	}
+	if err := errs.Err(); err != nil {
+		return nil, err
+	}
+	return &FixReferenceOriginsResponse{RawContents: updatedContents, Diagnostics: odiags}, nil
+}
+
+// returnsDiagnostics tells whether the function's return type is an object that carries the diagnostics.
+func returnsDiagnostics(ty cty.Type) bool {
+	return ty.IsObjectType() && ty.HasAttribute("diagnostics")
+}
+
+// providerDiagnostic is a diagnostic returned by the provider function, in form of:
+//
+//	{
+//	  severity  = "warning" # or "error"
+//	  summary   = "..."
+//	  detail    = "..."       # optional
+//	  attribute = "foo.bar"   # optional, only for the definition function
+//	  index     = 0           # optional, only for the references function
+//	}
+type providerDiagnostic struct {
+	Diagnostic
+	Attribute string
+	Index     *int
+}
+
+// decodeDiagnostics decodes the list of diagnostics returned by the provider function.
+func decodeDiagnostics(v cty.Value) []providerDiagnostic {
+	if v.IsNull() || !v.IsKnown() {
+		return nil
+	}
+	var out []providerDiagnostic
+	for _, elem := range v.AsValueSlice() {
+		if elem.IsNull() || !elem.Type().IsObjectType() {
+			continue
+		}
+		diag := providerDiagnostic{
+			Diagnostic: Diagnostic{
+				Severity: SeverityWarning,
+				Summary:  stringAttr(elem, "summary"),
+				Detail:   stringAttr(elem, "detail"),
+			},
+			Attribute: stringAttr(elem, "attribute"),
+		}
+		if stringAttr(elem, "severity") == string(SeverityError) {
+			diag.Severity = SeverityError
+		}
+		if elem.Type().HasAttribute("index") {
+			if idx := elem.GetAttr("index"); !idx.IsNull() && idx.Type() == cty.Number {
+				i, _ := idx.AsBigFloat().Int64()
+				n := int(i)
+				diag.Index = &n
+			}
+		}
+		out = append(out, diag)
+	}
+	return out
+}
+
+// stringAttr returns the string attribute of the object, or "" if it is absent or null.
+func stringAttr(obj cty.Value, name string) string {
+	if !obj.Type().HasAttribute(name) {
+		return ""
+	}
+	v := obj.GetAttr(name)
+	if v.IsNull() || !v.IsKnown() || v.Type() != cty.String {
+		return ""
+	}
+	return v.AsString()
+}
+
+// fromTFClientDiagnostics converts the (non-error) diagnostics of the provider function call.
+func fromTFClientDiagnostics(diags typ.Diagnostics) Diagnostics {
+	var out Diagnostics
+	for _, diag := range diags {
+		if diag.Severity == typ.Error {
+			continue
+		}
+		out = append(out, Diagnostic{
+			Severity: SeverityWarning,
+			Summary:  diag.Summary,
+			Detail:   diag.Detail,
+		})
+	}
+	return out
 }
@@ -0,0 +1,272 @@
+package fixer_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/magodo/terrafix/internal/fixer"
+	"github.com/magodo/terraform-client-go/tfclient/typ"
+	"github.com/stretchr/testify/require"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// diagnosticsFuncs returns the terrafix functions that return the objects with the diagnostics.
+func diagnosticsFuncs() map[string]typ.FunctionDecl {
+	funcs := terrafixFuncs()
+	funcs["terrafix_config_definition"] = typ.FunctionDecl{
+		Parameters: funcs["terrafix_config_definition"].Parameters,
+		ReturnType: cty.Object(map[string]cty.Type{
+			"content":     cty.String,
+			"diagnostics": cty.DynamicPseudoType,
+		}),
+	}
+	funcs["terrafix_config_references"] = typ.FunctionDecl{
+		Parameters: funcs["terrafix_config_references"].Parameters,
+		ReturnType: cty.Object(map[string]cty.Type{
+			"contents":    cty.List(cty.String),
+			"diagnostics": cty.DynamicPseudoType,
+		}),
+	}
+	return funcs
+}
+
+func TestProviderFixer_FixDefinitionDiagnostics(t *testing.T) {
+	content := "resource \"foo_account\" \"test\" {\n  name = \"foo\"\n  network {\n    ip = \"1.2.3.4\"\n  }\n}"
+	clientDiags := typ.Diagnostics{
+		{Severity: typ.Warning, Summary: "call warning", Detail: "from the call"},
+	}
+
+	cases := []struct {
+		name    string
+		result  cty.Value
+		diags   typ.Diagnostics
+		expect  fixer.Diagnostics
+		content string
+		err     string
+	}{
+		{
+			name:   "plain string return type",
+			result: cty.StringVal(content),
+			diags:  clientDiags,
+			expect: fixer.Diagnostics{
+				{Severity: fixer.SeverityWarning, Summary: "call warning", Detail: "from the call"},
+			},
+		},
+		{
+			name: "no diagnostics",
+			result: cty.ObjectVal(map[string]cty.Value{
+				"content":     cty.StringVal(content),
+				"diagnostics": cty.NullVal(cty.DynamicPseudoType),
+			}),
+		},
+		{
+			name: "diagnostics with and without attribute",
+			result: cty.ObjectVal(map[string]cty.Value{
+				"content": cty.StringVal(content),
+				"diagnostics": cty.TupleVal([]cty.Value{
+					cty.ObjectVal(map[string]cty.Value{
+						"severity": cty.StringVal("warning"),
+						"summary":  cty.StringVal("review the block"),
+					}),
+					cty.ObjectVal(map[string]cty.Value{
+						"severity":  cty.StringVal("warning"),
+						"summary":   cty.StringVal("review the ip"),
+						"detail":    cty.StringVal("the ip is moved"),
+						"attribute": cty.StringVal("network.ip"),
+					}),
+					cty.ObjectVal(map[string]cty.Value{
+						"severity":  cty.StringVal("warning"),
+						"summary":   cty.StringVal("unknown attribute"),
+						"attribute": cty.StringVal("not_exist"),
+					}),
+				}),
+			}),
+			diags: clientDiags,
+			expect: fixer.Diagnostics{
+				{Severity: fixer.SeverityWarning, Summary: "call warning", Detail: "from the call"},
+				{Severity: fixer.SeverityWarning, Summary: "review the block"},
+				{
+					Severity: fixer.SeverityWarning,
+					Summary:  "review the ip",
+					Detail:   "the ip is moved",
+					Subject: &hcl.Range{
+						Start: hcl.Pos{Line: 4, Column: 5, Byte: 63},
+						End:   hcl.Pos{Line: 4, Column: 19, Byte: 77},
+					},
+				},
+				{Severity: fixer.SeverityWarning, Summary: "unknown attribute"},
+			},
+		},
+		{
+			name: "error severity fails the fix",
+			result: cty.ObjectVal(map[string]cty.Value{
+				"content": cty.StringVal(content),
+				"diagnostics": cty.TupleVal([]cty.Value{
+					cty.ObjectVal(map[string]cty.Value{
+						"severity": cty.StringVal("warning"),
+						"summary":  cty.StringVal("review the block"),
+					}),
+					cty.ObjectVal(map[string]cty.Value{
+						"severity": cty.StringVal("error"),
+						"summary":  cty.StringVal("can't fix"),
+						"detail":   cty.StringVal("unsupported"),
+					}),
+				}),
+			}),
+			err: "can't fix: unsupported",
+		},
+		{
+			name: "null content",
+			result: cty.ObjectVal(map[string]cty.Value{
+				"content":     cty.NullVal(cty.String),
+				"diagnostics": cty.NullVal(cty.DynamicPseudoType),
+			}),
+			err: "the provider returns null content, which is a provider bug.",
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			funcs := diagnosticsFuncs()
+			if tt.result.Type() == cty.String {
+				funcs = terrafixFuncs()
+			}
+			fx, err := fixer.NewProviderFixer(fakeClient{
+				funcs:   funcs,
+				results: map[string]cty.Value{"terrafix_config_definition": tt.result},
+				diags:   map[string]typ.Diagnostics{"terrafix_config_definition": tt.diags},
+			})
+			require.NoError(t, err)
+			resp, err := fx.FixDefinition(context.Background(), fixer.FixDefinitionRequest{
+				BlockType:  fixer.BlockTypeResource,
+				BlockName:  "foo_account",
+				RawContent: []byte(content),
+			})
+			if tt.err != "" {
+				require.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, content, string(resp.RawContent))
+			require.Equal(t, tt.expect, resp.Diagnostics)
+		})
+	}
+}
+
+func TestProviderFixer_FixReferenceOriginsDiagnostics(t *testing.T) {
+	contents := []string{"foo_account.test.name", "foo_account.test.network"}
+	contentsVal := cty.ListVal([]cty.Value{cty.StringVal(contents[0]), cty.StringVal(contents[1])})
+	clientDiags := typ.Diagnostics{
+		{Severity: typ.Warning, Summary: "call warning"},
+	}
+
+	cases := []struct {
+		name   string
+		result cty.Value
+		diags  typ.Diagnostics
+		expect []fixer.Diagnostics
+		err    string
+	}{
+		{
+			name:   "plain list return type",
+			result: contentsVal,
+			diags:  clientDiags,
+			expect: []fixer.Diagnostics{
+				{{Severity: fixer.SeverityWarning, Summary: "call warning"}},
+				{{Severity: fixer.SeverityWarning, Summary: "call warning"}},
+			},
+		},
+		{
+			name: "diagnostics with and without index",
+			result: cty.ObjectVal(map[string]cty.Value{
+				"contents": contentsVal,
+				"diagnostics": cty.TupleVal([]cty.Value{
+					cty.ObjectVal(map[string]cty.Value{
+						"severity": cty.StringVal("warning"),
+						"summary":  cty.StringVal("review all"),
+					}),
+					cty.ObjectVal(map[string]cty.Value{
+						"severity": cty.StringVal("warning"),
+						"summary":  cty.StringVal("review the network"),
+						"detail":   cty.StringVal("the network is moved"),
+						"index":    cty.NumberIntVal(1),
+					}),
+				}),
+			}),
+			diags: clientDiags,
+			expect: []fixer.Diagnostics{
+				{
+					{Severity: fixer.SeverityWarning, Summary: "call warning"},
+					{Severity: fixer.SeverityWarning, Summary: "review all"},
+				},
+				{
+					{Severity: fixer.SeverityWarning, Summary: "call warning"},
+					{Severity: fixer.SeverityWarning, Summary: "review all"},
+					{Severity: fixer.SeverityWarning, Summary: "review the network", Detail: "the network is moved"},
+				},
+			},
+		},
+		{
+			name: "out of range index",
+			result: cty.ObjectVal(map[string]cty.Value{
+				"contents": contentsVal,
+				"diagnostics": cty.TupleVal([]cty.Value{
+					cty.ObjectVal(map[string]cty.Value{
+						"severity": cty.StringVal("warning"),
+						"summary":  cty.StringVal("review"),
+						"index":    cty.NumberIntVal(2),
+					}),
+				}),
+			}),
+			err: "the provider returns a diagnostic of an out of range index 2, which is a provider bug.",
+		},
+		{
+			name: "error severity fails the fix",
+			result: cty.ObjectVal(map[string]cty.Value{
+				"contents": contentsVal,
+				"diagnostics": cty.TupleVal([]cty.Value{
+					cty.ObjectVal(map[string]cty.Value{
+						"severity": cty.StringVal("error"),
+						"summary":  cty.StringVal("can't fix"),
+						"index":    cty.NumberIntVal(0),
+					}),
+				}),
+			}),
+			err: "can't fix",
+		},
+		{
+			name: "null contents",
+			result: cty.ObjectVal(map[string]cty.Value{
+				"contents":    cty.NullVal(cty.List(cty.String)),
+				"diagnostics": cty.NullVal(cty.DynamicPseudoType),
+			}),
+			err: "the provider returns null contents, which is a provider bug.",
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			funcs := diagnosticsFuncs()
+			if tt.result.Type().IsListType() {
+				funcs = terrafixFuncs()
+			}
+			fx, err := fixer.NewProviderFixer(fakeClient{
+				funcs:   funcs,
+				results: map[string]cty.Value{"terrafix_config_references": tt.result},
+				diags:   map[string]typ.Diagnostics{"terrafix_config_references": tt.diags},
+			})
+			require.NoError(t, err)
+			resp, err := fx.FixReferenceOrigins(context.Background(), fixer.FixReferenceOriginsRequest{
+				BlockType:   fixer.BlockTypeResource,
+				BlockName:   "foo_account",
+				RawContents: [][]byte{[]byte(contents[0]), []byte(contents[1])},
+			})
+			if tt.err != "" {
+				require.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, [][]byte{[]byte(contents[0]), []byte(contents[1])}, resp.RawContents)
+			require.Equal(t, tt.expect, resp.Diagnostics)
+		})
+	}
+}
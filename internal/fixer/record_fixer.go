@@ -0,0 +1,453 @@
+package fixer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/hashicorp/hcl/v2"
+	tfjson "github.com/hashicorp/terraform-json"
+)
+
+// The methods of the records, which are the methods of the Fixer and its optional interfaces
+const (
+	RecordMethodFixDefinition       = "fix_definition"
+	RecordMethodFixReferenceOrigins = "fix_reference_origins"
+	RecordMethodTargetSchemaVersion = "target_schema_version"
+	RecordMethodTargetSchema        = "target_schema"
+	RecordMethodCanFix              = "can_fix"
+)
+
+// record is a request/response pair of a fixer call, which is one line of the JSONL file, e.g.
+//
+//	{"method": "fix_definition", "request": {"block_type": "resource", ...}, "response": {"raw_content": "...", ...}}
+//	{"method": "fix_reference_origins", "request": {...}, "error": "..."}
+type record struct {
+	Method   string          `json:"method"`
+	Request  json.RawMessage `json:"request"`
+	Response json.RawMessage `json:"response,omitempty"`
+	// The error returned by the call, in which case there is no response
+	Error string `json:"error,omitempty"`
+}
+
+type recordedDefinitionRequest struct {
+	BlockType     BlockType                  `json:"block_type"`
+	BlockName     string                     `json:"block_name"`
+	Version       int                        `json:"version"`
+	TargetVersion int                        `json:"target_version,omitempty"`
+	RawContent    string                     `json:"raw_content"`
+	RawState      json.RawMessage            `json:"raw_state,omitempty"`
+	RawStates     map[string]json.RawMessage `json:"raw_states,omitempty"`
+}
+
+type recordedDefinitionResponse struct {
+	RawContent  string               `json:"raw_content"`
+	Diagnostics []recordedDiagnostic `json:"diagnostics,omitempty"`
+}
+
+type recordedReferencesRequest struct {
+	BlockType     BlockType `json:"block_type"`
+	BlockName     string    `json:"block_name"`
+	Version       int       `json:"version"`
+	TargetVersion int       `json:"target_version,omitempty"`
+	RawContents   []string  `json:"raw_contents"`
+}
+
+type recordedReferencesResponse struct {
+	RawContents []string               `json:"raw_contents"`
+	Diagnostics [][]recordedDiagnostic `json:"diagnostics,omitempty"`
+}
+
+type recordedDiagnostic struct {
+	Severity Severity   `json:"severity"`
+	Summary  string     `json:"summary"`
+	Detail   string     `json:"detail,omitempty"`
+	Subject  *hcl.Range `json:"subject,omitempty"`
+}
+
+// recordedBlockRequest is the request of the target_schema_version, target_schema and can_fix methods.
+type recordedBlockRequest struct {
+	BlockType BlockType `json:"block_type"`
+	BlockName string    `json:"block_name"`
+	// Only for the can_fix method
+	Version *int `json:"version,omitempty"`
+}
+
+// recordedBlockResponse is the response of the target_schema_version, target_schema and can_fix methods.
+type recordedBlockResponse struct {
+	OK bool `json:"ok"`
+	// Only for the target_schema_version method
+	Version int `json:"version,omitempty"`
+	// Only for the target_schema method
+	Schema *tfjson.Schema `json:"schema,omitempty"`
+}
+
+func newRecordedDefinitionRequest(req FixDefinitionRequest) recordedDefinitionRequest {
+	out := recordedDefinitionRequest{
+		BlockType:     req.BlockType,
+		BlockName:     req.BlockName,
+		Version:       req.Version,
+		TargetVersion: req.TargetVersion,
+		RawContent:    string(req.RawContent),
+	}
+	if len(req.RawState) != 0 {
+		out.RawState = req.RawState
+	}
+	if len(req.RawStates) != 0 {
+		out.RawStates = map[string]json.RawMessage{}
+		for addr, state := range req.RawStates {
+			out.RawStates[addr] = state
+		}
+	}
+	return out
+}
+
+func newRecordedReferencesRequest(req FixReferenceOriginsRequest) recordedReferencesRequest {
+	out := recordedReferencesRequest{
+		BlockType:     req.BlockType,
+		BlockName:     req.BlockName,
+		Version:       req.Version,
+		TargetVersion: req.TargetVersion,
+		RawContents:   []string{},
+	}
+	for _, content := range req.RawContents {
+		out.RawContents = append(out.RawContents, string(content))
+	}
+	return out
+}
+
+func newRecordedDiagnostics(diags Diagnostics) []recordedDiagnostic {
+	var out []recordedDiagnostic
+	for _, diag := range diags {
+		out = append(out, recordedDiagnostic{Severity: diag.Severity, Summary: diag.Summary, Detail: diag.Detail, Subject: diag.Subject})
+	}
+	return out
+}
+
+type recordedDiagnostics []recordedDiagnostic
+
+func (diags recordedDiagnostics) diagnostics() Diagnostics {
+	var out Diagnostics
+	for _, diag := range diags {
+		out = append(out, Diagnostic{Severity: diag.Severity, Summary: diag.Summary, Detail: diag.Detail, Subject: diag.Subject})
+	}
+	return out
+}
+
+// Recorder writes the records of the RecordingFixers to a JSONL file, one request/response pair per line.
+// It is safe for concurrent use, and can be shared by multiple RecordingFixers.
+type Recorder struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// NewRecorder creates (or truncates) the JSONL file at path to write the records to.
+func NewRecorder(path string) (*Recorder, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{f: f}, nil
+}
+
+// Close closes the JSONL file.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
+
+func (r *Recorder) record(method string, req, resp any, callErr error) error {
+	rec := record{Method: method}
+	var err error
+	if rec.Request, err = json.Marshal(req); err != nil {
+		return fmt.Errorf("marshal %s request: %v", method, err)
+	}
+	if callErr != nil {
+		rec.Error = callErr.Error()
+	} else if rec.Response, err = json.Marshal(resp); err != nil {
+		return fmt.Errorf("marshal %s response: %v", method, err)
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err := r.f.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("writing %s record: %v", method, err)
+	}
+	return nil
+}
+
+// RecordingFixer is a Fixer that records every request/response pair of the wrapped fixer, so that the session can
+// be replayed by a ReplayFixer, e.g. to reproduce a fixer bug offline.
+// It implements the optional interfaces (e.g. StepwiseFixer) the same way as the wrapped fixer.
+// It is safe for concurrent use if the wrapped fixer is.
+type RecordingFixer struct {
+	fixer    Fixer
+	recorder *Recorder
+
+	mu sync.Mutex
+	// The keys of the records of the methods other than fix_definition and fix_reference_origins, which are only
+	// recorded once, as their results don't change.
+	recorded map[string]bool
+}
+
+var (
+	_ StepwiseFixer     = &RecordingFixer{}
+	_ TargetSchemaFixer = &RecordingFixer{}
+	_ CapableFixer      = &RecordingFixer{}
+)
+
+// NewRecordingFixer wraps the fixer, whose calls are recorded by the recorder.
+func NewRecordingFixer(fx Fixer, recorder *Recorder) *RecordingFixer {
+	return &RecordingFixer{fixer: fx, recorder: recorder, recorded: map[string]bool{}}
+}
+
+func (f *RecordingFixer) FixDefinition(ctx context.Context, req FixDefinitionRequest) (*FixDefinitionResponse, error) {
+	resp, err := f.fixer.FixDefinition(ctx, req)
+	var rresp *recordedDefinitionResponse
+	if err == nil {
+		rresp = &recordedDefinitionResponse{RawContent: string(resp.RawContent), Diagnostics: newRecordedDiagnostics(resp.Diagnostics)}
+	}
+	if rerr := f.recorder.record(RecordMethodFixDefinition, newRecordedDefinitionRequest(req), rresp, err); rerr != nil {
+		return nil, rerr
+	}
+	return resp, err
+}
+
+func (f *RecordingFixer) FixReferenceOrigins(ctx context.Context, req FixReferenceOriginsRequest) (*FixReferenceOriginsResponse, error) {
+	resp, err := f.fixer.FixReferenceOrigins(ctx, req)
+	var rresp *recordedReferencesResponse
+	if err == nil {
+		rresp = &recordedReferencesResponse{RawContents: []string{}}
+		for _, content := range resp.RawContents {
+			rresp.RawContents = append(rresp.RawContents, string(content))
+		}
+		for _, diags := range resp.Diagnostics {
+			rresp.Diagnostics = append(rresp.Diagnostics, newRecordedDiagnostics(diags))
+		}
+	}
+	if rerr := f.recorder.record(RecordMethodFixReferenceOrigins, newRecordedReferencesRequest(req), rresp, err); rerr != nil {
+		return nil, rerr
+	}
+	return resp, err
+}
+
+// recordOnce records the request/response pair of the method, if it isn't recorded yet.
+// The recording errors are ignored, as these methods can't return errors.
+func (f *RecordingFixer) recordOnce(method string, req recordedBlockRequest, resp recordedBlockResponse) {
+	b, _ := json.Marshal(req)
+	key := method + string(b)
+	f.mu.Lock()
+	if f.recorded[key] {
+		f.mu.Unlock()
+		return
+	}
+	f.recorded[key] = true
+	f.mu.Unlock()
+	f.recorder.record(method, req, resp, nil)
+}
+
+// TargetSchemaVersion implements StepwiseFixer.
+func (f *RecordingFixer) TargetSchemaVersion(blockType BlockType, blockName string) (int, bool) {
+	sfx, ok := f.fixer.(StepwiseFixer)
+	if !ok {
+		return 0, false
+	}
+	version, ok := sfx.TargetSchemaVersion(blockType, blockName)
+	f.recordOnce(RecordMethodTargetSchemaVersion, recordedBlockRequest{BlockType: blockType, BlockName: blockName}, recordedBlockResponse{OK: ok, Version: version})
+	return version, ok
+}
+
+// TargetSchema implements TargetSchemaFixer.
+func (f *RecordingFixer) TargetSchema(blockType BlockType, blockName string) (*tfjson.Schema, bool) {
+	tfx, ok := f.fixer.(TargetSchemaFixer)
+	if !ok {
+		return nil, false
+	}
+	sch, ok := tfx.TargetSchema(blockType, blockName)
+	f.recordOnce(RecordMethodTargetSchema, recordedBlockRequest{BlockType: blockType, BlockName: blockName}, recordedBlockResponse{OK: ok, Schema: sch})
+	return sch, ok
+}
+
+// CanFix implements CapableFixer.
+func (f *RecordingFixer) CanFix(blockType BlockType, blockName string, version int) bool {
+	cfx, ok := f.fixer.(CapableFixer)
+	if !ok {
+		return true
+	}
+	ok = cfx.CanFix(blockType, blockName, version)
+	f.recordOnce(RecordMethodCanFix, recordedBlockRequest{BlockType: blockType, BlockName: blockName, Version: &version}, recordedBlockResponse{OK: ok})
+	return ok
+}
+
+// ReplayFixer is a Fixer that serves the responses from the records of a RecordingFixer, without the original fixer.
+//
+// The requests are matched against the recorded ones exactly, and each recorded fix_definition or
+// fix_reference_origins record is served once, in the recorded order for the identical requests. A request that is
+// not recorded results in an error, which usually means the configurations (or terrafix) have changed since the
+// session was recorded.
+// It is safe for concurrent use.
+type ReplayFixer struct {
+	mu sync.Mutex
+	// The records keyed by the method and the (compact) request
+	records map[string][]record
+}
+
+var (
+	_ StepwiseFixer     = &ReplayFixer{}
+	_ TargetSchemaFixer = &ReplayFixer{}
+	_ CapableFixer      = &ReplayFixer{}
+)
+
+// NewReplayFixer loads the records from the JSONL file at path.
+func NewReplayFixer(path string) (*ReplayFixer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	records := map[string][]record{}
+	scanner := bufio.NewScanner(f)
+	// The block contents and the states can be large
+	scanner.Buffer(nil, 64*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var rec record
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return nil, fmt.Errorf("loading records from %q: line %d: %v", path, n, err)
+		}
+		key, err := recordKey(rec.Method, rec.Request)
+		if err != nil {
+			return nil, fmt.Errorf("loading records from %q: line %d: %v", path, n, err)
+		}
+		records[key] = append(records[key], rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("loading records from %q: %v", path, err)
+	}
+	return &ReplayFixer{records: records}, nil
+}
+
+func recordKey(method string, req json.RawMessage) (string, error) {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, req); err != nil {
+		return "", fmt.Errorf("invalid %s request: %v", method, err)
+	}
+	return method + buf.String(), nil
+}
+
+// lookup returns the record of the method and the request, which is removed from the records if pop is true.
+func (f *ReplayFixer) lookup(method string, req any, pop bool) (*record, bool) {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return nil, false
+	}
+	key, err := recordKey(method, b)
+	if err != nil {
+		return nil, false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	recs := f.records[key]
+	if len(recs) == 0 {
+		return nil, false
+	}
+	rec := recs[0]
+	if pop {
+		f.records[key] = recs[1:]
+	}
+	return &rec, true
+}
+
+func (f *ReplayFixer) FixDefinition(_ context.Context, req FixDefinitionRequest) (*FixDefinitionResponse, error) {
+	rec, ok := f.lookup(RecordMethodFixDefinition, newRecordedDefinitionRequest(req), true)
+	if !ok {
+		return nil, fmt.Errorf("no recorded %s response for %s %s (version %d)", RecordMethodFixDefinition, req.BlockType, req.BlockName, req.Version)
+	}
+	if rec.Error != "" {
+		return nil, errors.New(rec.Error)
+	}
+	var resp recordedDefinitionResponse
+	if err := json.Unmarshal(rec.Response, &resp); err != nil {
+		return nil, fmt.Errorf("invalid recorded %s response: %v", RecordMethodFixDefinition, err)
+	}
+	return &FixDefinitionResponse{
+		RawContent:  []byte(resp.RawContent),
+		Diagnostics: recordedDiagnostics(resp.Diagnostics).diagnostics(),
+	}, nil
+}
+
+func (f *ReplayFixer) FixReferenceOrigins(_ context.Context, req FixReferenceOriginsRequest) (*FixReferenceOriginsResponse, error) {
+	rec, ok := f.lookup(RecordMethodFixReferenceOrigins, newRecordedReferencesRequest(req), true)
+	if !ok {
+		return nil, fmt.Errorf("no recorded %s response for %s %s (version %d)", RecordMethodFixReferenceOrigins, req.BlockType, req.BlockName, req.Version)
+	}
+	if rec.Error != "" {
+		return nil, errors.New(rec.Error)
+	}
+	var resp recordedReferencesResponse
+	if err := json.Unmarshal(rec.Response, &resp); err != nil {
+		return nil, fmt.Errorf("invalid recorded %s response: %v", RecordMethodFixReferenceOrigins, err)
+	}
+	out := &FixReferenceOriginsResponse{}
+	for _, content := range resp.RawContents {
+		out.RawContents = append(out.RawContents, []byte(content))
+	}
+	for _, diags := range resp.Diagnostics {
+		out.Diagnostics = append(out.Diagnostics, recordedDiagnostics(diags).diagnostics())
+	}
+	return out, nil
+}
+
+// blockResponse returns the recorded response of the method for the block, or false if not recorded.
+func (f *ReplayFixer) blockResponse(method string, req recordedBlockRequest) (*recordedBlockResponse, bool) {
+	rec, ok := f.lookup(method, req, false)
+	if !ok {
+		return nil, false
+	}
+	var resp recordedBlockResponse
+	if err := json.Unmarshal(rec.Response, &resp); err != nil {
+		return nil, false
+	}
+	return &resp, true
+}
+
+// TargetSchemaVersion implements StepwiseFixer. It returns false if not recorded.
+func (f *ReplayFixer) TargetSchemaVersion(blockType BlockType, blockName string) (int, bool) {
+	resp, ok := f.blockResponse(RecordMethodTargetSchemaVersion, recordedBlockRequest{BlockType: blockType, BlockName: blockName})
+	if !ok {
+		return 0, false
+	}
+	return resp.Version, resp.OK
+}
+
+// TargetSchema implements TargetSchemaFixer. It returns false if not recorded.
+func (f *ReplayFixer) TargetSchema(blockType BlockType, blockName string) (*tfjson.Schema, bool) {
+	resp, ok := f.blockResponse(RecordMethodTargetSchema, recordedBlockRequest{BlockType: blockType, BlockName: blockName})
+	if !ok {
+		return nil, false
+	}
+	return resp.Schema, resp.OK
+}
+
+// CanFix implements CapableFixer. It returns true if not recorded.
+func (f *ReplayFixer) CanFix(blockType BlockType, blockName string, version int) bool {
+	resp, ok := f.blockResponse(RecordMethodCanFix, recordedBlockRequest{BlockType: blockType, BlockName: blockName, Version: &version})
+	if !ok {
+		return true
+	}
+	return resp.OK
+}
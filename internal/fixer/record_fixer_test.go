@@ -0,0 +1,101 @@
+package fixer_test
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/magodo/terrafix/internal/fixer"
+	"github.com/stretchr/testify/require"
+)
+
+// stepwiseFixer is a StepwiseFixer that warns about every fixed block, and fails on the "bad" block.
+type stepwiseFixer struct {
+	fixer.DummyFixer
+}
+
+func (f stepwiseFixer) FixDefinition(ctx context.Context, req fixer.FixDefinitionRequest) (*fixer.FixDefinitionResponse, error) {
+	if req.BlockName == "bad" {
+		return nil, fmt.Errorf("bad block")
+	}
+	resp, err := f.DummyFixer.FixDefinition(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Diagnostics = fixer.Diagnostics{{
+		Severity: fixer.SeverityWarning,
+		Summary:  "review",
+		Subject:  &hcl.Range{Start: hcl.Pos{Line: 1, Column: 1}, End: hcl.Pos{Line: 1, Column: 2, Byte: 1}},
+	}}
+	return resp, nil
+}
+
+func (f stepwiseFixer) TargetSchemaVersion(fixer.BlockType, string) (int, bool) {
+	return 2, true
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.jsonl")
+	recorder, err := fixer.NewRecorder(path)
+	require.NoError(t, err)
+	fx := fixer.NewRecordingFixer(stepwiseFixer{}, recorder)
+
+	ctx := context.Background()
+	defReq := fixer.FixDefinitionRequest{
+		BlockType:     fixer.BlockTypeResource,
+		BlockName:     "foo_account",
+		Version:       0,
+		TargetVersion: 1,
+		RawContent:    []byte(`resource "foo_account" "test" {}`),
+		RawState:      []byte(`{"values": {"id": "123"}}`),
+	}
+	refReq := fixer.FixReferenceOriginsRequest{
+		BlockType:   fixer.BlockTypeResource,
+		BlockName:   "foo_account",
+		RawContents: [][]byte{[]byte("foo_account.test.name")},
+	}
+	badReq := fixer.FixDefinitionRequest{BlockType: fixer.BlockTypeResource, BlockName: "bad"}
+
+	defResp, err := fx.FixDefinition(ctx, defReq)
+	require.NoError(t, err)
+	refResp, err := fx.FixReferenceOrigins(ctx, refReq)
+	require.NoError(t, err)
+	_, err = fx.FixDefinition(ctx, badReq)
+	require.EqualError(t, err, "bad block")
+	version, ok := fx.TargetSchemaVersion(fixer.BlockTypeResource, "foo_account")
+	require.True(t, ok)
+	require.Equal(t, 2, version)
+	// The wrapped fixer doesn't implement them
+	_, ok = fx.TargetSchema(fixer.BlockTypeResource, "foo_account")
+	require.False(t, ok)
+	require.True(t, fx.CanFix(fixer.BlockTypeResource, "foo_account", 0))
+	require.NoError(t, recorder.Close())
+
+	rfx, err := fixer.NewReplayFixer(path)
+	require.NoError(t, err)
+
+	resp, err := rfx.FixDefinition(ctx, defReq)
+	require.NoError(t, err)
+	require.Equal(t, defResp, resp)
+	rresp, err := rfx.FixReferenceOrigins(ctx, refReq)
+	require.NoError(t, err)
+	require.Equal(t, refResp, rresp)
+	_, err = rfx.FixDefinition(ctx, badReq)
+	require.EqualError(t, err, "bad block")
+	version, ok = rfx.TargetSchemaVersion(fixer.BlockTypeResource, "foo_account")
+	require.True(t, ok)
+	require.Equal(t, 2, version)
+	_, ok = rfx.TargetSchema(fixer.BlockTypeResource, "foo_account")
+	require.False(t, ok)
+	require.True(t, rfx.CanFix(fixer.BlockTypeResource, "foo_account", 0))
+
+	// Each recorded call is served once
+	_, err = rfx.FixDefinition(ctx, defReq)
+	require.EqualError(t, err, "no recorded fix_definition response for resource foo_account (version 0)")
+	// Unrecorded requests
+	defReq.RawContent = []byte(`resource "foo_account" "test" { name = "foo" }`)
+	_, err = rfx.FixDefinition(ctx, defReq)
+	require.ErrorContains(t, err, "no recorded fix_definition response")
+}
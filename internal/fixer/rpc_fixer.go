@@ -0,0 +1,330 @@
+package fixer
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// The methods of the JSON-RPC protocol of the RPCFixer
+const (
+	RPCMethodFixDefinition       = "fix_definition"
+	RPCMethodFixReferenceOrigins = "fix_reference_origins"
+)
+
+// rpcShutdownTimeout is how long to wait for the fixer process to exit after its stdin is closed, before killing it.
+const rpcShutdownTimeout = 5 * time.Second
+
+// RPCFixer fixes the configurations by an executable that speaks JSON-RPC 2.0 over the stdio, so that the fixer can be
+// written in any language, without being embedded into a terraform provider.
+//
+// The executable is launched once, and receives one request per line from its stdin, and writes one response per
+// line to its stdout (i.e. each JSON message must not contain a newline). The stderr is passed through for logging.
+// The requests are sent one at a time, so the executable can handle them sequentially. It should exit once the
+// stdin is closed.
+//
+// The requests and responses of the fix_definition method are in form of:
+//
+//	--> {"jsonrpc": "2.0", "id": 1, "method": "fix_definition", "params": {
+//	      "block_type": "resource",                 // "provider", "resource" or "datasource"
+//	      "block_name": "azurerm_foo",              // the provider type for the provider block
+//	      "version": 0,                             // the schema version of the block
+//	      "raw_content": "resource \"azurerm_foo\" \"test\" {\n  ...\n}",
+//	      "raw_state": {...},                       // the terraform state of the resource, or null
+//	      "raw_states": {"azurerm_foo.test": {...}} // the terraform state of each instance
+//	    }}
+//	<-- {"jsonrpc": "2.0", "id": 1, "result": {
+//	      "raw_content": "resource \"azurerm_foo\" \"test\" {\n  ...\n}",
+//	      "diagnostics": [{"severity": "warning", "summary": "...", "detail": "...", "attribute": "foo.bar"}]
+//	    }}
+//
+// The requests and responses of the fix_reference_origins method are in form of:
+//
+//	--> {"jsonrpc": "2.0", "id": 2, "method": "fix_reference_origins", "params": {
+//	      "block_type": "resource",
+//	      "block_name": "azurerm_foo",
+//	      "version": 0,
+//	      "raw_contents": ["azurerm_foo.test.old_name"]
+//	    }}
+//	<-- {"jsonrpc": "2.0", "id": 2, "result": {
+//	      "raw_contents": ["azurerm_foo.test.new_name"],
+//	      "diagnostics": [{"severity": "warning", "summary": "...", "detail": "...", "index": 0}]
+//	    }}
+//
+// The diagnostics are optional, and are the same as the ones returned by the provider functions (see ProviderFixer).
+// A failed fix is responded with a JSON-RPC error, e.g. {"jsonrpc": "2.0", "id": 1, "error": {"code": 1, "message": "..."}}.
+//
+// It is safe for concurrent use, as the requests are serialized.
+type RPCFixer struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+
+	mu     sync.Mutex
+	nextID int
+	// The error that breaks the connection (e.g. a cancelled call), after which no more call can be made
+	err error
+}
+
+var _ Fixer = &RPCFixer{}
+
+// NewRPCFixer launches the fixer executable at path with the args.
+func NewRPCFixer(path string, args ...string) (*RPCFixer, error) {
+	cmd := exec.Command(path, args...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("starting fixer %q: %v", path, err)
+	}
+	return &RPCFixer{cmd: cmd, stdin: stdin, stdout: bufio.NewReader(stdout)}, nil
+}
+
+// Close closes the stdin of the fixer process and waits for it to exit, or kills it after a timeout.
+func (f *RPCFixer) Close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err == nil {
+		f.err = fmt.Errorf("fixer is closed")
+	}
+	f.stdin.Close()
+	done := make(chan struct{})
+	go func() {
+		f.cmd.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(rpcShutdownTimeout):
+		f.cmd.Process.Kill()
+		<-done
+	}
+}
+
+type rpcRequest struct {
+	JSONRPC string `json:"jsonrpc"`
+	ID      int    `json:"id"`
+	Method  string `json:"method"`
+	Params  any    `json:"params"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      *int            `json:"id"`
+	Result  json.RawMessage `json:"result"`
+	Error   *rpcError       `json:"error"`
+}
+
+type rpcError struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// call sends the request of the method with the params, and decodes the result of the response into result.
+// A cancelled ctx kills the fixer process, as there is no way to tell how the process would respond afterwards.
+func (f *RPCFixer) call(ctx context.Context, method string, params, result any) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	f.nextID++
+	id := f.nextID
+	b, err := json.Marshal(rpcRequest{JSONRPC: "2.0", ID: id, Method: method, Params: params})
+	if err != nil {
+		return fmt.Errorf("marshal %s request: %v", method, err)
+	}
+
+	type readResult struct {
+		line []byte
+		err  error
+	}
+	ch := make(chan readResult, 1)
+	go func() {
+		if _, err := f.stdin.Write(append(b, '\n')); err != nil {
+			ch <- readResult{err: fmt.Errorf("writing %s request: %v", method, err)}
+			return
+		}
+		line, err := f.stdout.ReadBytes('\n')
+		if err != nil {
+			ch <- readResult{err: fmt.Errorf("reading %s response: %v", method, err)}
+			return
+		}
+		ch <- readResult{line: line}
+	}()
+
+	var res readResult
+	select {
+	case <-ctx.Done():
+		f.err = ctx.Err()
+		f.cmd.Process.Kill()
+		return ctx.Err()
+	case res = <-ch:
+	}
+	if res.err != nil {
+		f.err = res.err
+		return res.err
+	}
+
+	var resp rpcResponse
+	if err := json.Unmarshal(res.line, &resp); err != nil {
+		f.err = fmt.Errorf("invalid %s response %q: %v", method, res.line, err)
+		return f.err
+	}
+	if resp.ID == nil || *resp.ID != id {
+		f.err = fmt.Errorf("mismatched id of the %s response %q, expects %d", method, res.line, id)
+		return f.err
+	}
+	if resp.Error != nil {
+		return fmt.Errorf("%s: %s", method, resp.Error.Message)
+	}
+	if err := json.Unmarshal(resp.Result, result); err != nil {
+		return fmt.Errorf("decoding %s result: %v", method, err)
+	}
+	return nil
+}
+
+type rpcFixDefinitionParams struct {
+	BlockType  BlockType                  `json:"block_type"`
+	BlockName  string                     `json:"block_name"`
+	Version    int                        `json:"version"`
+	RawContent string                     `json:"raw_content"`
+	RawState   json.RawMessage            `json:"raw_state"`
+	RawStates  map[string]json.RawMessage `json:"raw_states"`
+}
+
+type rpcFixDefinitionResult struct {
+	RawContent  *string         `json:"raw_content"`
+	Diagnostics []rpcDiagnostic `json:"diagnostics"`
+}
+
+type rpcFixReferenceOriginsParams struct {
+	BlockType   BlockType `json:"block_type"`
+	BlockName   string    `json:"block_name"`
+	Version     int       `json:"version"`
+	RawContents []string  `json:"raw_contents"`
+}
+
+type rpcFixReferenceOriginsResult struct {
+	RawContents []string        `json:"raw_contents"`
+	Diagnostics []rpcDiagnostic `json:"diagnostics"`
+}
+
+type rpcDiagnostic struct {
+	Severity  Severity `json:"severity"`
+	Summary   string   `json:"summary"`
+	Detail    string   `json:"detail"`
+	Attribute string   `json:"attribute"`
+	Index     *int     `json:"index"`
+}
+
+func (d rpcDiagnostic) diagnostic() Diagnostic {
+	diag := Diagnostic{Severity: SeverityWarning, Summary: d.Summary, Detail: d.Detail}
+	if d.Severity == SeverityError {
+		diag.Severity = SeverityError
+	}
+	return diag
+}
+
+func (f *RPCFixer) FixDefinition(ctx context.Context, req FixDefinitionRequest) (*FixDefinitionResponse, error) {
+	params := rpcFixDefinitionParams{
+		BlockType:  req.BlockType,
+		BlockName:  req.BlockName,
+		Version:    req.Version,
+		RawContent: string(req.RawContent),
+		RawState:   json.RawMessage("null"),
+		RawStates:  map[string]json.RawMessage{},
+	}
+	if len(req.RawState) != 0 {
+		params.RawState = req.RawState
+	}
+	for addr, state := range req.RawStates {
+		params.RawStates[addr] = state
+	}
+	var result rpcFixDefinitionResult
+	if err := f.call(ctx, RPCMethodFixDefinition, params, &result); err != nil {
+		return nil, err
+	}
+	if result.RawContent == nil {
+		return nil, fmt.Errorf("the fixer returns null raw_content, which is a fixer bug.")
+	}
+
+	rawContent := []byte(*result.RawContent)
+	var diags Diagnostics
+	for _, rdiag := range result.Diagnostics {
+		diag := rdiag.diagnostic()
+		if rdiag.Attribute != "" {
+			diag.Subject = AttributeRange(rawContent, rdiag.Attribute)
+		}
+		diags = append(diags, diag)
+	}
+	if err := diags.Err(); err != nil {
+		return nil, err
+	}
+	return &FixDefinitionResponse{RawContent: rawContent, Diagnostics: diags}, nil
+}
+
+func (f *RPCFixer) FixReferenceOrigins(ctx context.Context, req FixReferenceOriginsRequest) (*FixReferenceOriginsResponse, error) {
+	params := rpcFixReferenceOriginsParams{
+		BlockType:   req.BlockType,
+		BlockName:   req.BlockName,
+		Version:     req.Version,
+		RawContents: []string{},
+	}
+	for _, content := range req.RawContents {
+		params.RawContents = append(params.RawContents, string(content))
+	}
+	var result rpcFixReferenceOriginsResult
+	if err := f.call(ctx, RPCMethodFixReferenceOrigins, params, &result); err != nil {
+		return nil, err
+	}
+	if len(result.RawContents) != len(req.RawContents) {
+		return nil, fmt.Errorf("the fixer's response length doesn't match the request length %d, got=%d, which is a fixer bug.", len(req.RawContents), len(result.RawContents))
+	}
+	var contents [][]byte
+	for _, content := range result.RawContents {
+		contents = append(contents, []byte(content))
+	}
+
+	// The diagnostics not about a specific reference origin are attached to all of them.
+	odiags := make([]Diagnostics, len(contents))
+	var errs Diagnostics
+	for _, rdiag := range result.Diagnostics {
+		diag := rdiag.diagnostic()
+		if diag.Severity == SeverityError {
+			errs = append(errs, diag)
+			continue
+		}
+		if rdiag.Index == nil {
+			for i := range odiags {
+				odiags[i] = append(odiags[i], diag)
+			}
+			continue
+		}
+		if *rdiag.Index < 0 || *rdiag.Index >= len(odiags) {
+			return nil, fmt.Errorf("the fixer returns a diagnostic of an out of range index %d, which is a fixer bug.", *rdiag.Index)
+		}
+		odiags[*rdiag.Index] = append(odiags[*rdiag.Index], diag)
+	}
+	if err := errs.Err(); err != nil {
+		return nil, err
+	}
+	return &FixReferenceOriginsResponse{RawContents: contents, Diagnostics: odiags}, nil
+}
@@ -0,0 +1,149 @@
+package fixer_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/magodo/terrafix/internal/fixer"
+	"github.com/stretchr/testify/require"
+)
+
+// TestRPCFixerHelperProcess is not a real test, but the fixer process launched by the RPCFixer tests, which renames
+// the attribute "old_name" to "new_name", and hangs on the references to the "hang" blocks.
+func TestRPCFixerHelperProcess(t *testing.T) {
+	if os.Getenv("TERRAFIX_RPC_FIXER_HELPER") != "1" {
+		t.Skip("not a real test")
+	}
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		var req struct {
+			ID     int             `json:"id"`
+			Method string          `json:"method"`
+			Params json.RawMessage `json:"params"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		resp := map[string]any{"jsonrpc": "2.0", "id": req.ID}
+		switch req.Method {
+		case fixer.RPCMethodFixDefinition:
+			var params struct {
+				RawContent string `json:"raw_content"`
+				RawState   *struct {
+					ID string `json:"id"`
+				} `json:"raw_state"`
+			}
+			json.Unmarshal(req.Params, &params)
+			if strings.Contains(params.RawContent, "invalid") {
+				resp["error"] = map[string]any{"code": 1, "message": "invalid block"}
+				break
+			}
+			content := strings.ReplaceAll(params.RawContent, "old_name", "new_name")
+			if params.RawState != nil {
+				content = strings.Replace(content, "}", fmt.Sprintf("  id = %q\n}", params.RawState.ID), 1)
+			}
+			resp["result"] = map[string]any{
+				"raw_content": content,
+				"diagnostics": []map[string]any{{"severity": "warning", "summary": "review me", "attribute": "new_name"}},
+			}
+		case fixer.RPCMethodFixReferenceOrigins:
+			var params struct {
+				BlockName   string   `json:"block_name"`
+				RawContents []string `json:"raw_contents"`
+			}
+			json.Unmarshal(req.Params, &params)
+			if params.BlockName == "hang" {
+				time.Sleep(time.Hour)
+			}
+			var contents []string
+			for _, content := range params.RawContents {
+				contents = append(contents, strings.ReplaceAll(content, "old_name", "new_name"))
+			}
+			resp["result"] = map[string]any{
+				"raw_contents": contents,
+				"diagnostics":  []map[string]any{{"severity": "warning", "summary": "review me", "index": 1}},
+			}
+		default:
+			resp["error"] = map[string]any{"code": -32601, "message": "method not found"}
+		}
+		b, _ := json.Marshal(resp)
+		fmt.Println(string(b))
+	}
+	os.Exit(0)
+}
+
+func newTestRPCFixer(t *testing.T) *fixer.RPCFixer {
+	t.Setenv("TERRAFIX_RPC_FIXER_HELPER", "1")
+	fx, err := fixer.NewRPCFixer(os.Args[0], "-test.run=^TestRPCFixerHelperProcess$")
+	require.NoError(t, err)
+	t.Cleanup(fx.Close)
+	return fx
+}
+
+func TestRPCFixer(t *testing.T) {
+	fx := newTestRPCFixer(t)
+	ctx := context.Background()
+
+	resp, err := fx.FixDefinition(ctx, fixer.FixDefinitionRequest{
+		BlockType: fixer.BlockTypeResource,
+		BlockName: "foo_account",
+		RawContent: []byte(`resource "foo_account" "test" {
+  old_name = "foo"
+}`),
+		RawState: []byte(`{"id": "/foo/bar"}`),
+	})
+	require.NoError(t, err)
+	require.Equal(t, `resource "foo_account" "test" {
+  new_name = "foo"
+  id = "/foo/bar"
+}`, string(resp.RawContent))
+	require.Len(t, resp.Diagnostics, 1)
+	require.Equal(t, `new_name = "foo"`, string(resp.Diagnostics[0].Subject.SliceBytes(resp.RawContent)))
+
+	_, err = fx.FixDefinition(ctx, fixer.FixDefinitionRequest{
+		BlockType:  fixer.BlockTypeResource,
+		BlockName:  "foo_account",
+		RawContent: []byte(`resource "foo_account" "invalid" {}`),
+	})
+	require.EqualError(t, err, "fix_definition: invalid block")
+
+	// The fixer is still usable after an error response
+	rresp, err := fx.FixReferenceOrigins(ctx, fixer.FixReferenceOriginsRequest{
+		BlockType:   fixer.BlockTypeResource,
+		BlockName:   "foo_account",
+		RawContents: [][]byte{[]byte("foo_account.test.old_name"), []byte("foo_account.test.id")},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "foo_account.test.new_name", string(rresp.RawContents[0]))
+	require.Equal(t, "foo_account.test.id", string(rresp.RawContents[1]))
+	require.Empty(t, rresp.Diagnostics[0])
+	require.Len(t, rresp.Diagnostics[1], 1)
+}
+
+func TestRPCFixerCancelled(t *testing.T) {
+	fx := newTestRPCFixer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := fx.FixReferenceOrigins(ctx, fixer.FixReferenceOriginsRequest{
+		BlockType:   fixer.BlockTypeResource,
+		BlockName:   "hang",
+		RawContents: [][]byte{[]byte("hang.test.old_name")},
+	})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// The fixer process is killed
+	_, err = fx.FixReferenceOrigins(context.Background(), fixer.FixReferenceOriginsRequest{
+		BlockType:   fixer.BlockTypeResource,
+		BlockName:   "foo_account",
+		RawContents: [][]byte{[]byte("foo_account.test.old_name")},
+	})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
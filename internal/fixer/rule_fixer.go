@@ -0,0 +1,567 @@
+package fixer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/magodo/terrafix/internal/writer"
+	"github.com/zclconf/go-cty/cty"
+	"gopkg.in/yaml.v3"
+)
+
+// The actions of the rules
+const (
+	RuleActionRenameAttribute = "rename_attribute"
+	RuleActionMoveAttribute   = "move_attribute"
+	RuleActionSetDefault      = "set_default"
+	RuleActionDeleteAttribute = "delete_attribute"
+	RuleActionRenameBlock     = "rename_block"
+	RuleActionMapValue        = "map_value"
+)
+
+// RuleFixer fixes the configurations by a list of declarative rules, which are loaded from a YAML or HCL file.
+// Each rule is scoped by the block type, the block name and optionally the schema version, and is applied to both
+// the definitions and the reference origins consistently, in the order of the file.
+//
+// The rules file in YAML is in form of:
+//
+//	rules:
+//	  - action: rename_attribute
+//	    block_type: resource     # provider, resource or datasource
+//	    block_name: azurerm_foo  # the provider type for the provider block
+//	    version: 0               # optional, the rule applies to any schema version if absent
+//	    path: settings.old_name  # dot separated path of the attribute (or the nested block for rename_block)
+//	    to: new_name
+//
+// The same in HCL is in form of:
+//
+//	rule "rename_attribute" {
+//	  block_type = "resource"
+//	  block_name = "azurerm_foo"
+//	  version    = 0
+//	  path       = "settings.old_name"
+//	  to         = "new_name"
+//	}
+//
+// The actions are:
+//
+//   - rename_attribute: renames the attribute at path to the name of "to"
+//   - move_attribute: moves the attribute at path into the nested block of "to" (a path relative to the block
+//     containing the attribute), which is created if absent. The references are assumed to index the nested block
+//     by [0], i.e. it is a list nested block.
+//   - set_default: sets the attribute at path to the "value" (an HCL expression, e.g. "\"Standard\"" in YAML, or
+//     "Standard" in HCL) if absent. The nested blocks are not created.
+//   - delete_attribute: deletes the attribute at path. The references to it are left unchanged with a warning.
+//   - rename_block: renames the nested block (including the dynamic block) at path to the name of "to"
+//   - map_value: maps the literal value of the attribute at path via the "values", whose keys and values are HCL
+//     expressions in YAML (e.g. '"Basic"': '"Standard"'), or a map of them in HCL (e.g. { "Basic" = "Standard" })
+//
+// It is safe for concurrent use, as it is immutable once created.
+type RuleFixer struct {
+	rules []rule
+}
+
+var _ Fixer = RuleFixer{}
+
+type rule struct {
+	action    string
+	blockType BlockType
+	blockName string
+	version   *int
+	path      []string
+	to        string
+	// The source of the HCL expression, for set_default
+	value []byte
+	// The literal value mappings, for map_value
+	values []valueMapping
+}
+
+type valueMapping struct {
+	from cty.Value
+	// The source of the HCL expression
+	to []byte
+}
+
+type yamlRules struct {
+	Rules []yamlRule `yaml:"rules"`
+}
+
+type yamlRule struct {
+	Action    string            `yaml:"action"`
+	BlockType string            `yaml:"block_type"`
+	BlockName string            `yaml:"block_name"`
+	Version   *int              `yaml:"version"`
+	Path      string            `yaml:"path"`
+	To        string            `yaml:"to"`
+	Value     string            `yaml:"value"`
+	Values    map[string]string `yaml:"values"`
+}
+
+type hclRules struct {
+	Rules []hclRule `hcl:"rule,block"`
+}
+
+type hclRule struct {
+	Action    string         `hcl:"action,label"`
+	BlockType string         `hcl:"block_type"`
+	BlockName string         `hcl:"block_name"`
+	Version   *int           `hcl:"version,optional"`
+	Path      string         `hcl:"path"`
+	To        string         `hcl:"to,optional"`
+	Value     hcl.Expression `hcl:"value,optional"`
+	Values    hcl.Expression `hcl:"values,optional"`
+}
+
+// NewRuleFixer loads the rules from the file at path, which is in YAML (.yaml, .yml) or HCL (.hcl).
+func NewRuleFixer(path string) (*RuleFixer, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []rule
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		rules, err = parseYAMLRules(b)
+	case ".hcl":
+		rules, err = parseHCLRules(b, path)
+	default:
+		return nil, fmt.Errorf("unsupported rules file %q, expects a .yaml, .yml or .hcl file", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("loading rules from %q: %v", path, err)
+	}
+	return &RuleFixer{rules: rules}, nil
+}
+
+func parseYAMLRules(b []byte) ([]rule, error) {
+	var file yamlRules
+	if err := yaml.Unmarshal(b, &file); err != nil {
+		return nil, err
+	}
+	var out []rule
+	for i, yr := range file.Rules {
+		r := rule{
+			action:    yr.Action,
+			blockType: BlockType(yr.BlockType),
+			blockName: yr.BlockName,
+			version:   yr.Version,
+			to:        yr.To,
+		}
+		if yr.Path != "" {
+			r.path = strings.Split(yr.Path, ".")
+		}
+		if yr.Value != "" {
+			r.value = []byte(yr.Value)
+		}
+		// Sort the mappings so that the first match is deterministic.
+		for _, from := range slices.Sorted(maps.Keys(yr.Values)) {
+			v, err := literalValue([]byte(from))
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: invalid value %q: %v", i, from, err)
+			}
+			r.values = append(r.values, valueMapping{from: v, to: []byte(yr.Values[from])})
+		}
+		if err := r.validate(); err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i, err)
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+func parseHCLRules(b []byte, filename string) ([]rule, error) {
+	f, diags := hclsyntax.ParseConfig(b, filename, hcl.InitialPos)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	var file hclRules
+	if diags := gohcl.DecodeBody(f.Body, nil, &file); diags.HasErrors() {
+		return nil, diags
+	}
+	var out []rule
+	for i, hr := range file.Rules {
+		r := rule{
+			action:    hr.Action,
+			blockType: BlockType(hr.BlockType),
+			blockName: hr.BlockName,
+			version:   hr.Version,
+			path:      strings.Split(hr.Path, "."),
+			to:        hr.To,
+		}
+		if isSetExpr(hr.Value) {
+			r.value = hr.Value.Range().SliceBytes(b)
+		}
+		if isSetExpr(hr.Values) {
+			pairs, diags := hcl.ExprMap(hr.Values)
+			if diags.HasErrors() {
+				return nil, fmt.Errorf("rule %d: %v", i, diags.Error())
+			}
+			for _, pair := range pairs {
+				v, diags := pair.Key.Value(nil)
+				if diags.HasErrors() {
+					return nil, fmt.Errorf("rule %d: %v", i, diags.Error())
+				}
+				r.values = append(r.values, valueMapping{from: v, to: pair.Value.Range().SliceBytes(b)})
+			}
+		}
+		if err := r.validate(); err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i, err)
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+// isSetExpr tells whether the optional attribute decoded as an hcl.Expression is set.
+func isSetExpr(expr hcl.Expression) bool {
+	if expr == nil {
+		return false
+	}
+	v, diags := expr.Value(nil)
+	return diags.HasErrors() || !v.IsNull()
+}
+
+func (r rule) validate() error {
+	switch r.blockType {
+	case BlockTypeProvider, BlockTypeResource, BlockTypeDataSource:
+	default:
+		return fmt.Errorf("invalid block type %q", r.blockType)
+	}
+	if r.blockName == "" {
+		return fmt.Errorf("missing block name")
+	}
+	if len(r.path) == 0 || r.path[0] == "" {
+		return fmt.Errorf("missing path")
+	}
+	switch r.action {
+	case RuleActionRenameAttribute, RuleActionMoveAttribute, RuleActionRenameBlock:
+		if r.to == "" {
+			return fmt.Errorf("missing %q for %s", "to", r.action)
+		}
+	case RuleActionSetDefault:
+		if r.value == nil {
+			return fmt.Errorf("missing %q for %s", "value", r.action)
+		}
+		if _, diags := hclsyntax.ParseExpression(r.value, "", hcl.InitialPos); diags.HasErrors() {
+			return fmt.Errorf("invalid value %q: %v", r.value, diags.Error())
+		}
+	case RuleActionMapValue:
+		if len(r.values) == 0 {
+			return fmt.Errorf("missing %q for %s", "values", r.action)
+		}
+		for _, m := range r.values {
+			if _, diags := hclsyntax.ParseExpression(m.to, "", hcl.InitialPos); diags.HasErrors() {
+				return fmt.Errorf("invalid value %q: %v", m.to, diags.Error())
+			}
+		}
+	case RuleActionDeleteAttribute:
+	default:
+		return fmt.Errorf("unknown action %q", r.action)
+	}
+	return nil
+}
+
+func (r rule) matches(blockType BlockType, blockName string, version int) bool {
+	return r.blockType == blockType && r.blockName == blockName && (r.version == nil || *r.version == version)
+}
+
+func (f RuleFixer) FixDefinition(_ context.Context, req FixDefinitionRequest) (*FixDefinitionResponse, error) {
+	content := req.RawContent
+	for i, r := range f.rules {
+		if !r.matches(req.BlockType, req.BlockName, req.Version) {
+			continue
+		}
+		blk, err := parseBlock(content)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d (%s): %v", i, r.action, err)
+		}
+		updates := r.definitionUpdates(content, blk.Body)
+		if len(updates) == 0 {
+			continue
+		}
+		nc, err := writer.UpdateContent(content, updates)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d (%s): %v", i, r.action, err)
+		}
+		if _, err := parseBlock(nc); err != nil {
+			return nil, fmt.Errorf("rule %d (%s) results in invalid content: %v", i, r.action, err)
+		}
+		content = nc
+	}
+	return &FixDefinitionResponse{RawContent: content}, nil
+}
+
+func (f RuleFixer) FixReferenceOrigins(_ context.Context, req FixReferenceOriginsRequest) (*FixReferenceOriginsResponse, error) {
+	resp := &FixReferenceOriginsResponse{
+		RawContents: make([][]byte, len(req.RawContents)),
+		Diagnostics: make([]Diagnostics, len(req.RawContents)),
+	}
+	for i, content := range req.RawContents {
+		for _, r := range f.rules {
+			if !r.matches(req.BlockType, req.BlockName, req.Version) {
+				continue
+			}
+			var diag *Diagnostic
+			content, diag = r.fixReferenceOrigin(content, req.BlockType)
+			if diag != nil {
+				resp.Diagnostics[i] = append(resp.Diagnostics[i], *diag)
+			}
+		}
+		resp.RawContents[i] = content
+	}
+	return resp, nil
+}
+
+// parseBlock parses the content of a single top-level block.
+func parseBlock(content []byte) (*hclsyntax.Block, error) {
+	f, diags := hclsyntax.ParseConfig(content, "", hcl.InitialPos)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	body := f.Body.(*hclsyntax.Body)
+	if len(body.Blocks) != 1 {
+		return nil, fmt.Errorf("expects exactly one block, got %d", len(body.Blocks))
+	}
+	return body.Blocks[0], nil
+}
+
+// definitionUpdates returns the updates to the block content b, whose body is body.
+func (r rule) definitionUpdates(b []byte, body *hclsyntax.Body) writer.Updates {
+	var updates writer.Updates
+	parentPath, name := r.path[:len(r.path)-1], r.path[len(r.path)-1]
+
+	if r.action == RuleActionRenameBlock {
+		for _, parent := range nestedBodies(body, parentPath) {
+			for _, blk := range parent.Blocks {
+				switch {
+				case blk.Type == name:
+					updates = append(updates, writer.Update{Range: blk.TypeRange, Content: []byte(r.to)})
+				case blk.Type == "dynamic" && len(blk.Labels) == 1 && blk.Labels[0] == name:
+					updates = append(updates, writer.Update{Range: blk.LabelRanges[0], Content: []byte(strconv.Quote(r.to))})
+				}
+			}
+		}
+		return updates
+	}
+
+	for _, parent := range nestedBodies(body, parentPath) {
+		attr, ok := parent.Attributes[name]
+		switch r.action {
+		case RuleActionRenameAttribute:
+			if _, exists := parent.Attributes[r.to]; ok && !exists {
+				updates = append(updates, writer.Update{Range: attr.NameRange, Content: []byte(r.to)})
+			}
+		case RuleActionDeleteAttribute:
+			if ok {
+				updates = append(updates, writer.Update{Range: lineRange(b, attr.SrcRange), Content: nil})
+			}
+		case RuleActionSetDefault:
+			if !ok && !hasBlock(parent, name) {
+				updates = append(updates, insertAtBodyEnd(b, parent, fmt.Sprintf("%s = %s", name, r.value)))
+			}
+		case RuleActionMapValue:
+			if !ok {
+				continue
+			}
+			v, diags := attr.Expr.Value(nil)
+			if diags.HasErrors() || !v.IsWhollyKnown() {
+				continue
+			}
+			for _, m := range r.values {
+				if v.Type().Equals(m.from.Type()) && v.Equals(m.from).True() {
+					updates = append(updates, writer.Update{Range: attr.Expr.Range(), Content: m.to})
+					break
+				}
+			}
+		case RuleActionMoveAttribute:
+			if !ok {
+				continue
+			}
+			updates = append(updates, writer.Update{Range: lineRange(b, attr.SrcRange), Content: nil})
+			toPath := strings.Split(r.to, ".")
+			text := string(attr.SrcRange.SliceBytes(b))
+			if targets := nestedBodies(parent, toPath); len(targets) != 0 {
+				updates = append(updates, insertAtBodyEnd(b, targets[0], text))
+				continue
+			}
+			for i := len(toPath) - 1; i >= 0; i-- {
+				text = fmt.Sprintf("%s {\n%s}", toPath[i], indentLines(text, "  "))
+			}
+			updates = append(updates, insertAtBodyEnd(b, parent, text))
+		}
+	}
+	return updates
+}
+
+// fixReferenceOrigin fixes the reference origin content (a traversal) that targets to a block of the blockType.
+// It returns a warning if the origin can't be fixed.
+func (r rule) fixReferenceOrigin(content []byte, blockType BlockType) ([]byte, *Diagnostic) {
+	steps := referenceSteps(content, blockType)
+	if len(steps) < len(r.path) {
+		return content, nil
+	}
+	for i, name := range r.path {
+		if steps[i].Name != name {
+			return content, nil
+		}
+	}
+	last := steps[len(r.path)-1]
+	nameRange := hcl.Range{
+		Start: hcl.Pos{Byte: last.SrcRange.End.Byte - len(last.Name)},
+		End:   last.SrcRange.End,
+	}
+
+	var update writer.Update
+	switch r.action {
+	case RuleActionRenameAttribute, RuleActionRenameBlock:
+		update = writer.Update{Range: nameRange, Content: []byte(r.to)}
+	case RuleActionMoveAttribute:
+		var prefix string
+		for _, name := range strings.Split(r.to, ".") {
+			prefix += name + "[0]."
+		}
+		update = writer.Update{Range: hcl.Range{Start: nameRange.Start, End: nameRange.Start}, Content: []byte(prefix)}
+	case RuleActionDeleteAttribute:
+		return content, &Diagnostic{
+			Severity: SeverityWarning,
+			Summary:  "Reference to a deleted attribute",
+			Detail:   fmt.Sprintf("The attribute %q is deleted, the reference %q needs to be fixed manually.", strings.Join(r.path, "."), content),
+		}
+	default:
+		return content, nil
+	}
+	nc, err := writer.UpdateContent(content, writer.Updates{update})
+	if err != nil {
+		return content, nil
+	}
+	return nc, nil
+}
+
+// referenceSteps returns the attribute steps of the reference origin content (a traversal) after the address of the
+// targeted block of the blockType, ignoring the index steps.
+func referenceSteps(content []byte, blockType BlockType) []hcl.TraverseAttr {
+	trav, diags := hclsyntax.ParseTraversalAbs(content, "", hcl.InitialPos)
+	if diags.HasErrors() {
+		return nil
+	}
+	n := 2
+	if blockType == BlockTypeDataSource {
+		n = 3
+	}
+	if len(trav) <= n {
+		return nil
+	}
+	var steps []hcl.TraverseAttr
+	for _, step := range trav[n:] {
+		if attr, ok := step.(hcl.TraverseAttr); ok {
+			steps = append(steps, attr)
+		}
+	}
+	return steps
+}
+
+// nestedBodies returns the bodies of the nested blocks at the path (by the block type) of the body, including the
+// content of the dynamic blocks. It returns the body itself for an empty path.
+func nestedBodies(body *hclsyntax.Body, path []string) []*hclsyntax.Body {
+	if len(path) == 0 {
+		return []*hclsyntax.Body{body}
+	}
+	var out []*hclsyntax.Body
+	for _, blk := range body.Blocks {
+		switch {
+		case blk.Type == path[0]:
+			out = append(out, nestedBodies(blk.Body, path[1:])...)
+		case blk.Type == "dynamic" && len(blk.Labels) == 1 && blk.Labels[0] == path[0]:
+			for _, cblk := range blk.Body.Blocks {
+				if cblk.Type == "content" {
+					out = append(out, nestedBodies(cblk.Body, path[1:])...)
+				}
+			}
+		}
+	}
+	return out
+}
+
+func hasBlock(body *hclsyntax.Body, name string) bool {
+	for _, blk := range body.Blocks {
+		if blk.Type == name || (blk.Type == "dynamic" && len(blk.Labels) == 1 && blk.Labels[0] == name) {
+			return true
+		}
+	}
+	return false
+}
+
+// lineRange expands the range to the whole lines it spans (including the trailing newline), if there is nothing
+// else on these lines.
+func lineRange(b []byte, rng hcl.Range) hcl.Range {
+	start := bytes.LastIndexByte(b[:rng.Start.Byte], '\n') + 1
+	if len(bytes.TrimSpace(b[start:rng.Start.Byte])) != 0 {
+		return rng
+	}
+	end := rng.End.Byte
+	if idx := bytes.IndexByte(b[end:], '\n'); idx != -1 {
+		if len(bytes.TrimSpace(b[end:end+idx])) != 0 {
+			return rng
+		}
+		end += idx + 1
+	} else {
+		end = len(b)
+	}
+	return hcl.Range{Start: hcl.Pos{Byte: start}, End: hcl.Pos{Byte: end}}
+}
+
+// insertAtBodyEnd returns the update that inserts the text at the end of the body (right before the closing brace),
+// indented one level deeper than the closing brace.
+func insertAtBodyEnd(b []byte, body *hclsyntax.Body, text string) writer.Update {
+	// The body's range includes the braces
+	pos := body.SrcRange.End.Byte - 1
+	lineStart := bytes.LastIndexByte(b[:pos], '\n') + 1
+	linePrefix := b[lineStart:pos]
+	if len(bytes.TrimSpace(linePrefix)) == 0 {
+		return writer.Update{
+			Range:   hcl.Range{Start: hcl.Pos{Byte: lineStart}, End: hcl.Pos{Byte: lineStart}},
+			Content: []byte(indentLines(text, string(linePrefix)+"  ")),
+		}
+	}
+	// The closing brace is not on its own line, e.g. a single line block
+	indent := linePrefix[:len(linePrefix)-len(bytes.TrimLeft(linePrefix, " \t"))]
+	return writer.Update{
+		Range:   hcl.Range{Start: hcl.Pos{Byte: pos}, End: hcl.Pos{Byte: pos}},
+		Content: []byte("\n" + indentLines(text, string(indent)+"  ") + string(indent)),
+	}
+}
+
+// indentLines prefixes each line of the text with the indent, and ends it with a newline.
+func indentLines(text, indent string) string {
+	var sb strings.Builder
+	for _, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+		if line != "" {
+			sb.WriteString(indent)
+		}
+		sb.WriteString(line + "\n")
+	}
+	return sb.String()
+}
+
+// literalValue evaluates the HCL expression of a literal value.
+func literalValue(expr []byte) (cty.Value, error) {
+	e, diags := hclsyntax.ParseExpression(expr, "", hcl.InitialPos)
+	if diags.HasErrors() {
+		return cty.NilVal, diags
+	}
+	v, diags := e.Value(nil)
+	if diags.HasErrors() {
+		return cty.NilVal, diags
+	}
+	return v, nil
+}
@@ -0,0 +1,185 @@
+package fixer_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/magodo/terrafix/internal/fixer"
+	"github.com/stretchr/testify/require"
+)
+
+func writeRules(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	return path
+}
+
+const yamlRules = `rules:
+  - action: rename_attribute
+    block_type: resource
+    block_name: foo_account
+    version: 0
+    path: enable_https
+    to: https_enabled
+  - action: move_attribute
+    block_type: resource
+    block_name: foo_account
+    path: ip_rules
+    to: network_rule
+  - action: set_default
+    block_type: resource
+    block_name: foo_account
+    path: tier
+    value: '"Standard"'
+  - action: delete_attribute
+    block_type: resource
+    block_name: foo_account
+    path: legacy
+  - action: rename_block
+    block_type: resource
+    block_name: foo_account
+    path: identity.old
+    to: new
+  - action: map_value
+    block_type: resource
+    block_name: foo_account
+    path: sku
+    values:
+      '"Basic"': '"Standard"'
+  - action: rename_attribute
+    block_type: resource
+    block_name: foo_account
+    version: 1
+    path: name
+    to: not_applied
+`
+
+func TestRuleFixerDefinition(t *testing.T) {
+	fx, err := fixer.NewRuleFixer(writeRules(t, "rules.yaml", yamlRules))
+	require.NoError(t, err)
+
+	resp, err := fx.FixDefinition(context.Background(), fixer.FixDefinitionRequest{
+		BlockType: fixer.BlockTypeResource,
+		BlockName: "foo_account",
+		Version:   0,
+		RawContent: []byte(`resource "foo_account" "test" {
+  name         = "test"
+  enable_https = true
+  ip_rules     = ["1.2.3.4"]
+  legacy       = "x"
+  sku          = "Basic"
+  identity {
+    old {
+      type = "SystemAssigned"
+    }
+    dynamic "old" {
+      for_each = []
+      content {}
+    }
+  }
+}`),
+	})
+	require.NoError(t, err)
+	require.Equal(t, `resource "foo_account" "test" {
+  name         = "test"
+  https_enabled = true
+  sku          = "Standard"
+  identity {
+    new {
+      type = "SystemAssigned"
+    }
+    dynamic "new" {
+      for_each = []
+      content {}
+    }
+  }
+  network_rule {
+    ip_rules     = ["1.2.3.4"]
+  }
+  tier = "Standard"
+}`, string(resp.RawContent))
+
+	// Not matching the block name
+	resp, err = fx.FixDefinition(context.Background(), fixer.FixDefinitionRequest{
+		BlockType:  fixer.BlockTypeResource,
+		BlockName:  "foo_other",
+		RawContent: []byte(`resource "foo_other" "test" {}`),
+	})
+	require.NoError(t, err)
+	require.Equal(t, `resource "foo_other" "test" {}`, string(resp.RawContent))
+}
+
+func TestRuleFixerReferenceOrigins(t *testing.T) {
+	fx, err := fixer.NewRuleFixer(writeRules(t, "rules.yaml", yamlRules))
+	require.NoError(t, err)
+
+	resp, err := fx.FixReferenceOrigins(context.Background(), fixer.FixReferenceOriginsRequest{
+		BlockType: fixer.BlockTypeResource,
+		BlockName: "foo_account",
+		Version:   0,
+		RawContents: [][]byte{
+			[]byte("foo_account.test.enable_https"),
+			[]byte("foo_account.test.ip_rules"),
+			[]byte("foo_account.test.identity[0].old[0].type"),
+			[]byte("foo_account.test.legacy"),
+			[]byte("foo_account.test.name"),
+		},
+	})
+	require.NoError(t, err)
+	var contents []string
+	for _, content := range resp.RawContents {
+		contents = append(contents, string(content))
+	}
+	require.Equal(t, []string{
+		"foo_account.test.https_enabled",
+		"foo_account.test.network_rule[0].ip_rules",
+		"foo_account.test.identity[0].new[0].type",
+		"foo_account.test.legacy",
+		"foo_account.test.name",
+	}, contents)
+	require.Len(t, resp.Diagnostics[3], 1)
+	require.Equal(t, fixer.SeverityWarning, resp.Diagnostics[3][0].Severity)
+	require.Empty(t, resp.Diagnostics[0])
+}
+
+func TestRuleFixerHCL(t *testing.T) {
+	fx, err := fixer.NewRuleFixer(writeRules(t, "rules.hcl", `
+rule "map_value" {
+  block_type = "datasource"
+  block_name = "foo_account"
+  path       = "sku"
+  values     = { "Basic" = "Standard", "Premium" = upper("premium_v2") }
+}
+
+rule "set_default" {
+  block_type = "datasource"
+  block_name = "foo_account"
+  path       = "tier"
+  value      = 1
+}
+`))
+	require.NoError(t, err)
+
+	resp, err := fx.FixDefinition(context.Background(), fixer.FixDefinitionRequest{
+		BlockType:  fixer.BlockTypeDataSource,
+		BlockName:  "foo_account",
+		RawContent: []byte("data \"foo_account\" \"test\" {\n  sku = \"Premium\"\n}"),
+	})
+	require.NoError(t, err)
+	require.Equal(t, "data \"foo_account\" \"test\" {\n  sku = upper(\"premium_v2\")\n  tier = 1\n}", string(resp.RawContent))
+}
+
+func TestNewRuleFixerInvalid(t *testing.T) {
+	_, err := fixer.NewRuleFixer(writeRules(t, "rules.yaml", `rules:
+  - action: rename_attribute
+    block_type: resource
+    block_name: foo_account
+    path: name
+`))
+	require.ErrorContains(t, err, `missing "to"`)
+
+	_, err = fixer.NewRuleFixer(writeRules(t, "rules.json", `{}`))
+	require.Error(t, err)
+}
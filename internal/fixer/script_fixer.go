@@ -0,0 +1,468 @@
+package fixer
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"sort"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/magodo/terrafix/internal/writer"
+	ctyjson "github.com/zclconf/go-cty/cty/json"
+	"go.starlark.net/lib/json"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"go.starlark.net/syntax"
+)
+
+// ScriptMaxExecutionSteps is the maximum number of the Starlark computation steps of each call to the script, which
+// prevents a buggy script from running forever.
+const ScriptMaxExecutionSteps = 100_000_000
+
+// ScriptFixer fixes the configurations by a Starlark (https://github.com/google/starlark-go) script, for the
+// transformations that need a bit of logic (e.g. split a string into two attributes, compute a value from the state).
+// The script is sandboxed: it can't access the file system, the network or the environment, and the only module
+// available besides the Starlark builtins is "json" (https://pkg.go.dev/go.starlark.net/lib/json).
+//
+// The script defines either or both of the following functions:
+//
+//	def fix_definition(req):
+//	    # req.block_type:     "provider", "resource" or "datasource"
+//	    # req.block_name:     e.g. "azurerm_foo", or the provider type for the provider block
+//	    # req.version:        the schema version of the block
+//	    # req.block:          the block, see below
+//	    # req.state:          the decoded terraform state of the resource, or None
+//	    # req.states:         the decoded terraform state of each instance, keyed by the instance address
+//	    # req.warn(summary, detail = "", attribute = ""):
+//	    #                     adds a warning, optionally about the dot separated attribute path in the fixed block
+//	    name = req.block.attributes.get("name")
+//	    if name and name.value != None:
+//	        prefix, _, suffix = name.value.partition("-")
+//	        name.set(json.encode(prefix))
+//	        req.block.set_attribute("suffix", json.encode(suffix))
+//
+//	def fix_reference(req):
+//	    # req.block_type, req.block_name, req.version and req.warn: the same as above
+//	    # req.content:        the reference origin, e.g. "azurerm_foo.test.settings[0].old_name"
+//	    # req.attributes:     the attribute names after the block address, ignoring the indexes,
+//	    #                     e.g. ["settings", "old_name"]
+//	    if req.attributes[:2] == ["settings", "old_name"]:
+//	        return req.content.replace(".old_name", ".new_name")
+//	    return None  # unchanged
+//
+// The block (and each nested block) has the following fields and methods:
+//
+//   - type, labels: the block type and the labels, e.g. "dynamic" and ["settings"] for a dynamic block
+//   - attributes: the attributes keyed by the name, in the source order
+//   - blocks: the list of the nested blocks (including the dynamic blocks), in the source order
+//   - set_attribute(name, expr): sets the attribute to the HCL expression source, which is added if absent
+//   - append(text): appends the HCL source (e.g. a nested block) to the end of the body
+//   - rename(type): renames the nested block, or the label for a dynamic block (not for the top-level block)
+//   - remove(): removes the nested block (not for the top-level block)
+//
+// Each attribute has the following fields and methods:
+//
+//   - name: the attribute name
+//   - expr: the HCL expression source, e.g. "var.foo" or "\"foo\""
+//   - value: the value of the expression if it is a literal value (e.g. a string, number, bool, list, map), or None
+//   - rename(name): renames the attribute
+//   - set(expr): sets the attribute to the HCL expression source
+//   - remove(): removes the attribute
+//
+// The edits are applied against the original content all at once after the function returns, so the fields
+// always reflect the original content, and each attribute or block can be edited at most once.
+// A function that fails (e.g. via the fail() builtin) fails the fix.
+//
+// It is safe for concurrent use, as the script globals are frozen once loaded, and each call runs in its own thread.
+type ScriptFixer struct {
+	path          string
+	fixDefinition starlark.Callable
+	fixReference  starlark.Callable
+}
+
+var _ Fixer = &ScriptFixer{}
+
+// NewScriptFixer loads the Starlark script at path.
+func NewScriptFixer(path string) (*ScriptFixer, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	thread := newScriptThread(path)
+	// Allow the top-level control flows (e.g. a for loop building a lookup table), and the use of set().
+	opts := &syntax.FileOptions{TopLevelControl: true, Set: true}
+	globals, err := starlark.ExecFileOptions(opts, thread, path, b, starlark.StringDict{"json": json.Module})
+	if err != nil {
+		return nil, fmt.Errorf("loading script %q: %v", path, err)
+	}
+	globals.Freeze()
+
+	f := &ScriptFixer{path: path}
+	for name, fn := range map[string]*starlark.Callable{
+		"fix_definition": &f.fixDefinition,
+		"fix_reference":  &f.fixReference,
+	} {
+		v, ok := globals[name]
+		if !ok {
+			continue
+		}
+		callable, ok := v.(starlark.Callable)
+		if !ok {
+			return nil, fmt.Errorf("loading script %q: %s is not a function, got %s", path, name, v.Type())
+		}
+		*fn = callable
+	}
+	if f.fixDefinition == nil && f.fixReference == nil {
+		return nil, fmt.Errorf("loading script %q: neither fix_definition nor fix_reference is defined", path)
+	}
+	return f, nil
+}
+
+func newScriptThread(path string) *starlark.Thread {
+	thread := &starlark.Thread{
+		Name: path,
+		Print: func(_ *starlark.Thread, msg string) {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path, msg)
+		},
+		// Disallow load()
+		Load: func(_ *starlark.Thread, module string) (starlark.StringDict, error) {
+			return nil, fmt.Errorf("load of %q is not allowed", module)
+		},
+	}
+	thread.SetMaxExecutionSteps(ScriptMaxExecutionSteps)
+	return thread
+}
+
+// call calls the script function fn with the request, which can be cancelled via the ctx.
+func (f *ScriptFixer) call(ctx context.Context, fn starlark.Callable, req starlark.Value) (starlark.Value, error) {
+	thread := newScriptThread(f.path)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			thread.Cancel(ctx.Err().Error())
+		case <-done:
+		}
+	}()
+	v, err := starlark.Call(thread, fn, starlark.Tuple{req}, nil)
+	if err != nil {
+		if evalErr, ok := err.(*starlark.EvalError); ok {
+			return nil, fmt.Errorf("calling %s: %s", fn.Name(), evalErr.Backtrace())
+		}
+		return nil, fmt.Errorf("calling %s: %v", fn.Name(), err)
+	}
+	return v, nil
+}
+
+func (f *ScriptFixer) FixDefinition(ctx context.Context, req FixDefinitionRequest) (*FixDefinitionResponse, error) {
+	if f.fixDefinition == nil {
+		return &FixDefinitionResponse{RawContent: req.RawContent}, nil
+	}
+	blk, err := parseBlock(req.RawContent)
+	if err != nil {
+		return nil, err
+	}
+
+	edits := &scriptEdits{content: req.RawContent}
+	var warns scriptWarnings
+	state, err := decodeJSON(req.RawState)
+	if err != nil {
+		return nil, fmt.Errorf("decoding state: %v", err)
+	}
+	states := starlark.NewDict(len(req.RawStates))
+	for _, addr := range slices.Sorted(maps.Keys(req.RawStates)) {
+		v, err := decodeJSON(req.RawStates[addr])
+		if err != nil {
+			return nil, fmt.Errorf("decoding state of %s: %v", addr, err)
+		}
+		if err := states.SetKey(starlark.String(addr), v); err != nil {
+			return nil, err
+		}
+	}
+	fields := scriptRequestFields(req.BlockType, req.BlockName, req.Version, &warns)
+	fields["block"] = edits.blockValue(blk, true)
+	fields["state"] = state
+	fields["states"] = states
+
+	if _, err := f.call(ctx, f.fixDefinition, starlarkstruct.FromStringDict(starlark.String("request"), fields)); err != nil {
+		return nil, err
+	}
+
+	content, err := edits.apply()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := parseBlock(content); err != nil {
+		return nil, fmt.Errorf("the script results in invalid content: %v", err)
+	}
+	return &FixDefinitionResponse{RawContent: content, Diagnostics: warns.diagnostics(content)}, nil
+}
+
+func (f *ScriptFixer) FixReferenceOrigins(ctx context.Context, req FixReferenceOriginsRequest) (*FixReferenceOriginsResponse, error) {
+	resp := &FixReferenceOriginsResponse{
+		RawContents: make([][]byte, len(req.RawContents)),
+		Diagnostics: make([]Diagnostics, len(req.RawContents)),
+	}
+	for i, content := range req.RawContents {
+		resp.RawContents[i] = content
+		if f.fixReference == nil {
+			continue
+		}
+		var attrs []starlark.Value
+		for _, step := range referenceSteps(content, req.BlockType) {
+			attrs = append(attrs, starlark.String(step.Name))
+		}
+		var warns scriptWarnings
+		fields := scriptRequestFields(req.BlockType, req.BlockName, req.Version, &warns)
+		fields["content"] = starlark.String(content)
+		fields["attributes"] = starlark.NewList(attrs)
+
+		v, err := f.call(ctx, f.fixReference, starlarkstruct.FromStringDict(starlark.String("request"), fields))
+		if err != nil {
+			return nil, fmt.Errorf("reference origin %q: %v", content, err)
+		}
+		switch v := v.(type) {
+		case starlark.NoneType:
+		case starlark.String:
+			resp.RawContents[i] = []byte(v.GoString())
+		default:
+			return nil, fmt.Errorf("reference origin %q: %s returns %s, expects a string or None", content, f.fixReference.Name(), v.Type())
+		}
+		resp.Diagnostics[i] = warns.diagnostics(nil)
+	}
+	return resp, nil
+}
+
+// scriptRequestFields returns the common fields of the requests to the script.
+func scriptRequestFields(blockType BlockType, blockName string, version int, warns *scriptWarnings) starlark.StringDict {
+	return starlark.StringDict{
+		"block_type": starlark.String(blockType),
+		"block_name": starlark.String(blockName),
+		"version":    starlark.MakeInt(version),
+		"warn":       starlark.NewBuiltin("warn", warns.add),
+	}
+}
+
+// decodeJSON decodes the JSON into a Starlark value, or None if it is empty.
+func decodeJSON(b []byte) (starlark.Value, error) {
+	if len(b) == 0 {
+		return starlark.None, nil
+	}
+	return starlark.Call(&starlark.Thread{}, json.Module.Members["decode"], starlark.Tuple{starlark.String(b)}, nil)
+}
+
+type scriptWarning struct {
+	summary   string
+	detail    string
+	attribute string
+}
+
+type scriptWarnings []scriptWarning
+
+func (warns *scriptWarnings) add(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var w scriptWarning
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "summary", &w.summary, "detail?", &w.detail, "attribute?", &w.attribute); err != nil {
+		return nil, err
+	}
+	*warns = append(*warns, w)
+	return starlark.None, nil
+}
+
+// diagnostics returns the warning diagnostics, whose subjects are the attributes in the fixed block content (if any).
+func (warns scriptWarnings) diagnostics(content []byte) Diagnostics {
+	var diags Diagnostics
+	for _, w := range warns {
+		diag := Diagnostic{Severity: SeverityWarning, Summary: w.summary, Detail: w.detail}
+		if w.attribute != "" && content != nil {
+			diag.Subject = AttributeRange(content, w.attribute)
+		}
+		diags = append(diags, diag)
+	}
+	return diags
+}
+
+// scriptEdits records the edits made by the script to the block content.
+type scriptEdits struct {
+	content []byte
+	updates writer.Updates
+	// The texts to be inserted at the end of each body, in the order of the calls
+	inserts map[*hclsyntax.Body][]string
+	// The bodies in the order of the first insertion, to keep the output deterministic
+	insertBodies []*hclsyntax.Body
+}
+
+func (e *scriptEdits) update(rng hcl.Range, content string) {
+	e.updates = append(e.updates, writer.Update{Range: rng, Content: []byte(content)})
+}
+
+func (e *scriptEdits) insert(body *hclsyntax.Body, text string) {
+	if e.inserts == nil {
+		e.inserts = map[*hclsyntax.Body][]string{}
+	}
+	if _, ok := e.inserts[body]; !ok {
+		e.insertBodies = append(e.insertBodies, body)
+	}
+	e.inserts[body] = append(e.inserts[body], text)
+}
+
+func (e *scriptEdits) apply() ([]byte, error) {
+	updates := e.updates
+	for _, body := range e.insertBodies {
+		var text string
+		for _, t := range e.inserts[body] {
+			text += indentLines(t, "")
+		}
+		updates = append(updates, insertAtBodyEnd(e.content, body, text))
+	}
+	if len(updates) == 0 {
+		return e.content, nil
+	}
+	nc, err := writer.UpdateContent(e.content, updates)
+	if err != nil {
+		return nil, fmt.Errorf("applying the edits of the script: %v", err)
+	}
+	return nc, nil
+}
+
+// blockValue returns the Starlark value of the block, whose methods record the edits.
+func (e *scriptEdits) blockValue(blk *hclsyntax.Block, topLevel bool) starlark.Value {
+	var labels []starlark.Value
+	for _, label := range blk.Labels {
+		labels = append(labels, starlark.String(label))
+	}
+
+	attrs := make([]*hclsyntax.Attribute, 0, len(blk.Body.Attributes))
+	for _, attr := range blk.Body.Attributes {
+		attrs = append(attrs, attr)
+	}
+	sort.Slice(attrs, func(i, j int) bool { return attrs[i].SrcRange.Start.Byte < attrs[j].SrcRange.Start.Byte })
+	attrDict := starlark.NewDict(len(attrs))
+	for _, attr := range attrs {
+		_ = attrDict.SetKey(starlark.String(attr.Name), e.attributeValue(attr))
+	}
+
+	var blocks []starlark.Value
+	for _, nblk := range blk.Body.Blocks {
+		blocks = append(blocks, e.blockValue(nblk, false))
+	}
+
+	fields := starlark.StringDict{
+		"type":       starlark.String(blk.Type),
+		"labels":     starlark.NewList(labels),
+		"attributes": attrDict,
+		"blocks":     starlark.NewList(blocks),
+		"set_attribute": starlark.NewBuiltin("set_attribute", func(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var name, expr string
+			if err := starlark.UnpackArgs(b.Name(), args, kwargs, "name", &name, "expr", &expr); err != nil {
+				return nil, err
+			}
+			if err := validateExpr(expr); err != nil {
+				return nil, err
+			}
+			if attr, ok := blk.Body.Attributes[name]; ok {
+				e.update(attr.Expr.Range(), expr)
+			} else {
+				e.insert(blk.Body, fmt.Sprintf("%s = %s", name, expr))
+			}
+			return starlark.None, nil
+		}),
+		"append": starlark.NewBuiltin("append", func(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var text string
+			if err := starlark.UnpackArgs(b.Name(), args, kwargs, "text", &text); err != nil {
+				return nil, err
+			}
+			e.insert(blk.Body, text)
+			return starlark.None, nil
+		}),
+		"rename": starlark.NewBuiltin("rename", func(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var typ string
+			if err := starlark.UnpackArgs(b.Name(), args, kwargs, "type", &typ); err != nil {
+				return nil, err
+			}
+			if topLevel {
+				return nil, fmt.Errorf("%s: the top-level block can't be renamed", b.Name())
+			}
+			if blk.Type == "dynamic" && len(blk.Labels) == 1 {
+				e.update(blk.LabelRanges[0], fmt.Sprintf("%q", typ))
+			} else {
+				e.update(blk.TypeRange, typ)
+			}
+			return starlark.None, nil
+		}),
+		"remove": starlark.NewBuiltin("remove", func(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			if err := starlark.UnpackArgs(b.Name(), args, kwargs); err != nil {
+				return nil, err
+			}
+			if topLevel {
+				return nil, fmt.Errorf("%s: the top-level block can't be removed", b.Name())
+			}
+			e.update(lineRange(e.content, blk.Range()), "")
+			return starlark.None, nil
+		}),
+	}
+	return starlarkstruct.FromStringDict(starlark.String("block"), fields)
+}
+
+// attributeValue returns the Starlark value of the attribute, whose methods record the edits.
+func (e *scriptEdits) attributeValue(attr *hclsyntax.Attribute) starlark.Value {
+	fields := starlark.StringDict{
+		"name":  starlark.String(attr.Name),
+		"expr":  starlark.String(attr.Expr.Range().SliceBytes(e.content)),
+		"value": literalStarlarkValue(attr.Expr),
+		"rename": starlark.NewBuiltin("rename", func(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var name string
+			if err := starlark.UnpackArgs(b.Name(), args, kwargs, "name", &name); err != nil {
+				return nil, err
+			}
+			e.update(attr.NameRange, name)
+			return starlark.None, nil
+		}),
+		"set": starlark.NewBuiltin("set", func(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var expr string
+			if err := starlark.UnpackArgs(b.Name(), args, kwargs, "expr", &expr); err != nil {
+				return nil, err
+			}
+			if err := validateExpr(expr); err != nil {
+				return nil, err
+			}
+			e.update(attr.Expr.Range(), expr)
+			return starlark.None, nil
+		}),
+		"remove": starlark.NewBuiltin("remove", func(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			if err := starlark.UnpackArgs(b.Name(), args, kwargs); err != nil {
+				return nil, err
+			}
+			e.update(lineRange(e.content, attr.SrcRange), "")
+			return starlark.None, nil
+		}),
+	}
+	return starlarkstruct.FromStringDict(starlark.String("attribute"), fields)
+}
+
+// literalStarlarkValue returns the Starlark value of the expression if it is a literal value, or None otherwise.
+func literalStarlarkValue(expr hclsyntax.Expression) starlark.Value {
+	v, diags := expr.Value(nil)
+	if diags.HasErrors() || !v.IsWhollyKnown() {
+		return starlark.None
+	}
+	b, err := ctyjson.Marshal(v, v.Type())
+	if err != nil {
+		return starlark.None
+	}
+	sv, err := decodeJSON(b)
+	if err != nil {
+		return starlark.None
+	}
+	return sv
+}
+
+func validateExpr(expr string) error {
+	if _, diags := hclsyntax.ParseExpression([]byte(expr), "", hcl.InitialPos); diags.HasErrors() {
+		return fmt.Errorf("invalid expression %q: %v", expr, diags.Error())
+	}
+	return nil
+}
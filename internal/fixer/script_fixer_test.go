@@ -0,0 +1,145 @@
+package fixer_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/magodo/terrafix/internal/fixer"
+	"github.com/stretchr/testify/require"
+)
+
+const script = `
+SKUS = {"Basic": "Standard"}
+
+def fix_definition(req):
+    if req.block_type != "resource" or req.block_name != "foo_account":
+        return
+    blk = req.block
+    name = blk.attributes.get("name")
+    if name and name.value != None:
+        prefix, _, suffix = name.value.partition("-")
+        name.set(json.encode(prefix))
+        blk.set_attribute("suffix", json.encode(suffix))
+    if "sku" in blk.attributes:
+        sku = blk.attributes["sku"]
+        sku.set(json.encode(SKUS.get(sku.value, sku.value)))
+    if "legacy" in blk.attributes:
+        blk.attributes["legacy"].remove()
+        req.warn("legacy is removed", attribute = "suffix")
+    if req.state != None:
+        blk.set_attribute("id", json.encode(req.state["attribute_values"]["id"]))
+    for nblk in blk.blocks:
+        if nblk.type == "rule":
+            nblk.rename("network_rule")
+            nblk.attributes["ip"].rename("ip_rules")
+
+def fix_reference(req):
+    if req.attributes[:2] == ["rule", "ip"]:
+        return req.content.replace(".rule", ".network_rule").replace(".ip", ".ip_rules")
+    if req.attributes[:1] == ["legacy"]:
+        req.warn("legacy is removed")
+    return None
+`
+
+func TestScriptFixerDefinition(t *testing.T) {
+	fx, err := fixer.NewScriptFixer(writeRules(t, "fix.star", script))
+	require.NoError(t, err)
+
+	resp, err := fx.FixDefinition(context.Background(), fixer.FixDefinitionRequest{
+		BlockType: fixer.BlockTypeResource,
+		BlockName: "foo_account",
+		RawContent: []byte(`resource "foo_account" "test" {
+  name   = "foo-bar"
+  sku    = "Basic"
+  legacy = true
+  rule {
+    ip = ["1.2.3.4"]
+  }
+}`),
+		RawState: []byte(`{"attribute_values": {"id": "/foo/bar"}}`),
+	})
+	require.NoError(t, err)
+	require.Equal(t, `resource "foo_account" "test" {
+  name   = "foo"
+  sku    = "Standard"
+  network_rule {
+    ip_rules = ["1.2.3.4"]
+  }
+  suffix = "bar"
+  id = "/foo/bar"
+}`, string(resp.RawContent))
+	require.Len(t, resp.Diagnostics, 1)
+	require.Equal(t, fixer.SeverityWarning, resp.Diagnostics[0].Severity)
+	require.NotNil(t, resp.Diagnostics[0].Subject)
+	require.Equal(t, `suffix = "bar"`, string(resp.Diagnostics[0].Subject.SliceBytes(resp.RawContent)))
+
+	// Other blocks are left unchanged
+	content := []byte(`resource "foo_other" "test" {
+  name = "foo-bar"
+}`)
+	resp, err = fx.FixDefinition(context.Background(), fixer.FixDefinitionRequest{
+		BlockType:  fixer.BlockTypeResource,
+		BlockName:  "foo_other",
+		RawContent: content,
+	})
+	require.NoError(t, err)
+	require.Equal(t, string(content), string(resp.RawContent))
+}
+
+func TestScriptFixerReferenceOrigins(t *testing.T) {
+	fx, err := fixer.NewScriptFixer(writeRules(t, "fix.star", script))
+	require.NoError(t, err)
+
+	resp, err := fx.FixReferenceOrigins(context.Background(), fixer.FixReferenceOriginsRequest{
+		BlockType: fixer.BlockTypeResource,
+		BlockName: "foo_account",
+		RawContents: [][]byte{
+			[]byte("foo_account.test.rule[0].ip"),
+			[]byte("foo_account.test.legacy"),
+			[]byte("foo_account.test.name"),
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "foo_account.test.network_rule[0].ip_rules", string(resp.RawContents[0]))
+	require.Equal(t, "foo_account.test.legacy", string(resp.RawContents[1]))
+	require.Equal(t, "foo_account.test.name", string(resp.RawContents[2]))
+	require.Empty(t, resp.Diagnostics[0])
+	require.Len(t, resp.Diagnostics[1], 1)
+	require.Empty(t, resp.Diagnostics[2])
+}
+
+func TestScriptFixerError(t *testing.T) {
+	_, err := fixer.NewScriptFixer(writeRules(t, "fix.star", `x = 1`))
+	require.ErrorContains(t, err, "neither fix_definition nor fix_reference is defined")
+
+	_, err = fixer.NewScriptFixer(writeRules(t, "fix.star", `load("os.star", "x")`))
+	require.ErrorContains(t, err, "not allowed")
+
+	fx, err := fixer.NewScriptFixer(writeRules(t, "fix.star", `
+def fix_definition(req):
+    fail("unsupported")
+`))
+	require.NoError(t, err)
+	_, err = fx.FixDefinition(context.Background(), fixer.FixDefinitionRequest{
+		BlockType:  fixer.BlockTypeResource,
+		BlockName:  "foo_account",
+		RawContent: []byte(`resource "foo_account" "test" {}`),
+	})
+	require.ErrorContains(t, err, "unsupported")
+
+	// The endless loop is terminated by the cancelled context
+	fx, err = fixer.NewScriptFixer(writeRules(t, "fix.star", `
+def fix_definition(req):
+    for i in range(1000000000):
+        pass
+`))
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = fx.FixDefinition(ctx, fixer.FixDefinitionRequest{
+		BlockType:  fixer.BlockTypeResource,
+		BlockName:  "foo_account",
+		RawContent: []byte(`resource "foo_account" "test" {}`),
+	})
+	require.ErrorContains(t, err, "context canceled")
+}
@@ -0,0 +1,330 @@
+package jsonconfig
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// BlockFromNative converts the top-level block in native syntax to the JSON object that defines its body.
+// The block type and labels are not part of the output, as they are defined by the keys that contain the
+// JSON object.
+//
+// The output is indented by indent, with each line (except the first one) prefixed by prefix.
+// The comments directly in the body of the block, as well as of each nested block, are converted to the comment
+// property "//" of the corresponding JSON object, which is always the first property.
+func BlockFromNative(content []byte, prefix, indent string) ([]byte, error) {
+	f, diags := hclsyntax.ParseConfig(content, "", hcl.InitialPos)
+	if diags.HasErrors() {
+		return nil, fmt.Errorf("parsing the block: %v", diags.Error())
+	}
+	body := f.Body.(*hclsyntax.Body)
+	if len(body.Attributes) != 0 || len(body.Blocks) != 1 {
+		return nil, fmt.Errorf("expects exactly one block")
+	}
+	blk := body.Blocks[0]
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	first := !writeCommentMember(&buf, content, blk)
+	if err := writeJSONMembers(&buf, content, "", blk.Body, first); err != nil {
+		return nil, err
+	}
+	buf.WriteByte('}')
+
+	var out bytes.Buffer
+	if err := json.Indent(&out, buf.Bytes(), prefix, indent); err != nil {
+		return nil, fmt.Errorf("indenting the JSON: %v", err)
+	}
+	return out.Bytes(), nil
+}
+
+// BlockHeader returns the type and labels of the top-level block in native syntax.
+func BlockHeader(content []byte) (string, []string, error) {
+	f, diags := hclsyntax.ParseConfig(content, "", hcl.InitialPos)
+	if diags.HasErrors() {
+		return "", nil, fmt.Errorf("parsing the block: %v", diags.Error())
+	}
+	body := f.Body.(*hclsyntax.Body)
+	if len(body.Attributes) != 0 || len(body.Blocks) != 1 {
+		return "", nil, fmt.Errorf("expects exactly one block")
+	}
+	return body.Blocks[0].Type, body.Blocks[0].Labels, nil
+}
+
+// writeCommentMember writes the comments directly in the block body as the comment property "//", and tells whether
+// it is written.
+func writeCommentMember(buf *bytes.Buffer, src []byte, blk *hclsyntax.Block) bool {
+	comments := bodyComments(src, blk)
+	if len(comments) == 0 {
+		return false
+	}
+	buf.Write(marshalString("//"))
+	buf.WriteByte(':')
+	buf.Write(marshalString(strings.Join(comments, "\n")))
+	return true
+}
+
+// bodyComments returns the text of the comments that are directly in the block body.
+func bodyComments(src []byte, blk *hclsyntax.Block) []string {
+	tokens, diags := hclsyntax.LexConfig(src, "", hcl.InitialPos)
+	if diags.HasErrors() {
+		return nil
+	}
+	var (
+		out   []string
+		depth int
+	)
+	for _, tok := range tokens {
+		if tok.Range.Start.Byte < blk.OpenBraceRange.Start.Byte || tok.Range.Start.Byte >= blk.CloseBraceRange.End.Byte {
+			continue
+		}
+		switch tok.Type {
+		case hclsyntax.TokenOBrace, hclsyntax.TokenOBrack, hclsyntax.TokenOParen, hclsyntax.TokenTemplateInterp, hclsyntax.TokenTemplateControl:
+			depth++
+		case hclsyntax.TokenCBrace, hclsyntax.TokenCBrack, hclsyntax.TokenCParen, hclsyntax.TokenTemplateSeqEnd:
+			depth--
+		case hclsyntax.TokenComment:
+			if depth != 1 {
+				continue
+			}
+			text := string(tok.Bytes)
+			switch {
+			case strings.HasPrefix(text, "#"):
+				text = strings.TrimPrefix(text, "#")
+			case strings.HasPrefix(text, "//"):
+				text = strings.TrimPrefix(text, "//")
+			case strings.HasPrefix(text, "/*"):
+				text = strings.TrimSuffix(strings.TrimPrefix(text, "/*"), "*/")
+			}
+			out = append(out, strings.TrimSpace(text))
+		}
+	}
+	return out
+}
+
+// writeJSONMembers writes the attributes and nested blocks of the body as the members of a JSON object.
+// The nested blocks of the same type are grouped into one member, at the position of the first one.
+// The blockType is the type of the block that contains this body, or "" for the top-level block.
+func writeJSONMembers(buf *bytes.Buffer, src []byte, blockType string, body *hclsyntax.Body, first bool) error {
+	type item struct {
+		pos  int
+		attr *hclsyntax.Attribute
+		blks []*hclsyntax.Block
+	}
+	var items []*item
+	for _, attr := range body.Attributes {
+		items = append(items, &item{pos: attr.SrcRange.Start.Byte, attr: attr})
+	}
+	blkItems := map[string]*item{}
+	for _, blk := range body.Blocks {
+		if it, ok := blkItems[blk.Type]; ok {
+			it.blks = append(it.blks, blk)
+			continue
+		}
+		it := &item{pos: blk.Range().Start.Byte, blks: []*hclsyntax.Block{blk}}
+		blkItems[blk.Type] = it
+		items = append(items, it)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].pos < items[j].pos })
+
+	for _, it := range items {
+		if !first {
+			buf.WriteByte(',')
+		}
+		first = false
+
+		if attr := it.attr; attr != nil {
+			buf.Write(marshalString(attr.Name))
+			buf.WriteByte(':')
+			if staticRefAttrs[blockType][attr.Name] {
+				if err := writeStaticRefJSON(buf, src, attr.Expr); err != nil {
+					return fmt.Errorf("attribute %q: %v", attr.Name, err)
+				}
+				continue
+			}
+			if err := writeExprJSON(buf, src, attr.Expr); err != nil {
+				return fmt.Errorf("attribute %q: %v", attr.Name, err)
+			}
+			continue
+		}
+
+		buf.Write(marshalString(it.blks[0].Type))
+		buf.WriteByte(':')
+		if err := writeBlocksJSON(buf, src, it.blks, 0); err != nil {
+			return fmt.Errorf("block %q: %v", it.blks[0].Type, err)
+		}
+	}
+	return nil
+}
+
+// writeBlocksJSON writes the blocks of the same type as a JSON value. The blocks are nested by their labels
+// starting from the labelIdx. A single block is written as a JSON object, while multiple blocks are written
+// as an array of JSON objects.
+func writeBlocksJSON(buf *bytes.Buffer, src []byte, blks []*hclsyntax.Block, labelIdx int) error {
+	if labelIdx < len(blks[0].Labels) {
+		var labels []string
+		byLabel := map[string][]*hclsyntax.Block{}
+		for _, blk := range blks {
+			if len(blk.Labels) != len(blks[0].Labels) {
+				return fmt.Errorf("inconsistent number of labels")
+			}
+			label := blk.Labels[labelIdx]
+			if _, ok := byLabel[label]; !ok {
+				labels = append(labels, label)
+			}
+			byLabel[label] = append(byLabel[label], blk)
+		}
+		buf.WriteByte('{')
+		for i, label := range labels {
+			if i != 0 {
+				buf.WriteByte(',')
+			}
+			buf.Write(marshalString(label))
+			buf.WriteByte(':')
+			if err := writeBlocksJSON(buf, src, byLabel[label], labelIdx+1); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+		return nil
+	}
+
+	if len(blks) > 1 {
+		buf.WriteByte('[')
+	}
+	for i, blk := range blks {
+		if i != 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteByte('{')
+		first := !writeCommentMember(buf, src, blk)
+		if err := writeJSONMembers(buf, src, blk.Type, blk.Body, first); err != nil {
+			return err
+		}
+		buf.WriteByte('}')
+	}
+	if len(blks) > 1 {
+		buf.WriteByte(']')
+	}
+	return nil
+}
+
+// writeStaticRefJSON writes a (list of) static reference as (an array of) JSON string.
+func writeStaticRefJSON(buf *bytes.Buffer, src []byte, expr hclsyntax.Expression) error {
+	if tuple, ok := expr.(*hclsyntax.TupleConsExpr); ok {
+		buf.WriteByte('[')
+		for i, elem := range tuple.Exprs {
+			if i != 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeStaticRefJSON(buf, src, elem); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+		return nil
+	}
+	if tmpl, ok := expr.(*hclsyntax.TemplateExpr); ok && tmpl.IsStringLiteral() {
+		// The legacy quoted reference
+		return writeExprJSON(buf, src, expr)
+	}
+	buf.Write(marshalString(string(expr.Range().SliceBytes(src))))
+	return nil
+}
+
+// writeExprJSON writes the expression as a JSON value. The literal values, templates, tuples and objects
+// are written as their JSON counterparts, while other expressions are written as a template string
+// that contains a single interpolation.
+func writeExprJSON(buf *bytes.Buffer, src []byte, expr hclsyntax.Expression) error {
+	switch expr := expr.(type) {
+	case *hclsyntax.LiteralValueExpr:
+		if expr.Val.IsNull() {
+			buf.WriteString("null")
+			return nil
+		}
+		// Either a number or a bool
+		buf.Write(expr.SrcRange.SliceBytes(src))
+		return nil
+	case *hclsyntax.TemplateExpr:
+		if s, ok := templateString(src, expr); ok {
+			buf.Write(marshalString(s))
+			return nil
+		}
+	case *hclsyntax.TemplateWrapExpr:
+		buf.Write(marshalString("${" + string(expr.Wrapped.Range().SliceBytes(src)) + "}"))
+		return nil
+	case *hclsyntax.TupleConsExpr:
+		buf.WriteByte('[')
+		for i, elem := range expr.Exprs {
+			if i != 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeExprJSON(buf, src, elem); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+		return nil
+	case *hclsyntax.ObjectConsExpr:
+		buf.WriteByte('{')
+		for i, item := range expr.Items {
+			if i != 0 {
+				buf.WriteByte(',')
+			}
+			buf.Write(marshalString(objectKeyString(src, item.KeyExpr)))
+			buf.WriteByte(':')
+			if err := writeExprJSON(buf, src, item.ValueExpr); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+		return nil
+	}
+	buf.Write(marshalString("${" + string(expr.Range().SliceBytes(src)) + "}"))
+	return nil
+}
+
+// templateString returns the JSON string of the template, if it consists of only literals and interpolations.
+func templateString(src []byte, expr *hclsyntax.TemplateExpr) (string, bool) {
+	var sb strings.Builder
+	for _, part := range expr.Parts {
+		if lit, ok := part.(*hclsyntax.LiteralValueExpr); ok && lit.Val.Type() == cty.String {
+			s := lit.Val.AsString()
+			s = strings.ReplaceAll(s, "${", "$${")
+			s = strings.ReplaceAll(s, "%{", "%%{")
+			sb.WriteString(s)
+			continue
+		}
+		// Ensure the part is a plain interpolation, rather than a directive or an interpolation with strip markers
+		before := strings.TrimRight(string(src[:part.Range().Start.Byte]), " \t\n")
+		after := strings.TrimLeft(string(src[part.Range().End.Byte:]), " \t\n")
+		if !strings.HasSuffix(before, "${") || !strings.HasPrefix(after, "}") {
+			return "", false
+		}
+		sb.WriteString("${" + string(part.Range().SliceBytes(src)) + "}")
+	}
+	return sb.String(), true
+}
+
+// objectKeyString returns the JSON object key of the object constructor key expression.
+func objectKeyString(src []byte, expr hclsyntax.Expression) string {
+	if key, ok := expr.(*hclsyntax.ObjectConsKeyExpr); ok {
+		if trav, ok := key.Wrapped.(*hclsyntax.ScopeTraversalExpr); ok && !key.ForceNonLiteral && len(trav.Traversal) == 1 {
+			return trav.Traversal.RootName()
+		}
+		expr = key.Wrapped
+	}
+	if tmpl, ok := expr.(*hclsyntax.TemplateExpr); ok {
+		if s, ok := templateString(src, tmpl); ok {
+			return s
+		}
+	}
+	return "${" + string(expr.Range().SliceBytes(src)) + "}"
+}
@@ -0,0 +1,195 @@
+// Package jsonconfig deals with the Terraform configuration in JSON syntax (i.e. .tf.json files).
+//
+// The fixers only understand the native HCL syntax. This package converts the blocks defined in JSON syntax
+// to the native syntax before sending them to the fixers, and converts the fixed blocks back to JSON.
+package jsonconfig
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	hcljson "github.com/hashicorp/hcl/v2/json"
+)
+
+// IsJSONFilename tells whether the file is a Terraform configuration file in JSON syntax.
+func IsJSONFilename(name string) bool {
+	return strings.HasSuffix(name, ".tf.json")
+}
+
+// topLevelSchema is the schema of the top-level blocks that are interested by terrafix.
+var topLevelSchema = &hcl.BodySchema{
+	Blocks: []hcl.BlockHeaderSchema{
+		{Type: "provider", LabelNames: []string{"name"}},
+		{Type: "resource", LabelNames: []string{"type", "name"}},
+		{Type: "data", LabelNames: []string{"type", "name"}},
+	},
+}
+
+// Blocks returns the top-level provider, resource and data source blocks defined in the JSON file,
+// ordered by their position.
+func Blocks(f *hcl.File) (hcl.Blocks, error) {
+	if !hcljson.IsJSONBody(f.Body) {
+		return nil, fmt.Errorf("%s is not a JSON file", f.Body.MissingItemRange().Filename)
+	}
+	content, _, diags := f.Body.PartialContent(topLevelSchema)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	blks := content.Blocks
+	sortBlocks(blks)
+	return blks, nil
+}
+
+// BodyRange returns the range of the JSON object that defines the body of the block.
+func BodyRange(blk *hcl.Block) hcl.Range {
+	return hcl.RangeBetween(blk.DefRange, blk.Body.MissingItemRange())
+}
+
+// Traversals returns all the absolute traversals referenced in the JSON file, ordered by their position.
+// The traversals whose source can't be located precisely (e.g. due to the escape sequences in the JSON string)
+// are omitted.
+func Traversals(f *hcl.File) ([]hcl.Traversal, error) {
+	if !hcljson.IsJSONBody(f.Body) {
+		return nil, fmt.Errorf("%s is not a JSON file", f.Body.MissingItemRange().Filename)
+	}
+	attrs, diags := f.Body.JustAttributes()
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	var out []hcl.Traversal
+	for _, attr := range attrs {
+		for _, traversal := range attr.Expr.Variables() {
+			rng := traversal.SourceRange()
+			if rng.End.Byte > len(f.Bytes) {
+				continue
+			}
+			src := rng.SliceBytes(f.Bytes)
+			if bytes.ContainsRune(src, '\\') {
+				continue
+			}
+			// The range is calculated against the unescaped JSON string, ensure it matches the source.
+			parsed, diags := hclsyntax.ParseTraversalAbs(src, rng.Filename, rng.Start)
+			if diags.HasErrors() || len(parsed) != len(traversal) || parsed.RootName() != traversal.RootName() {
+				continue
+			}
+			out = append(out, traversal)
+		}
+	}
+	sortTraversals(out)
+	return out, nil
+}
+
+func sortBlocks(blks hcl.Blocks) {
+	sort.SliceStable(blks, func(i, j int) bool {
+		return blks[i].DefRange.Start.Byte < blks[j].DefRange.Start.Byte
+	})
+}
+
+func sortTraversals(traversals []hcl.Traversal) {
+	sort.SliceStable(traversals, func(i, j int) bool {
+		return traversals[i].SourceRange().Start.Byte < traversals[j].SourceRange().Start.Byte
+	})
+}
+
+// jsonMember is a member of a JSON object
+type jsonMember struct {
+	Key   string
+	Value any
+}
+
+// jsonObject is a JSON object that keeps the order of its members.
+type jsonObject []jsonMember
+
+// decodeJSON decodes the JSON value, where the objects are decoded as jsonObject, and the numbers are
+// decoded as json.Number.
+func decodeJSON(b []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	v, err := decodeJSONValue(dec)
+	if err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("unexpected trailing content")
+	}
+	return v, nil
+}
+
+func decodeJSONValue(dec *json.Decoder) (any, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	delim, ok := tok.(json.Delim)
+	if !ok {
+		return tok, nil
+	}
+	switch delim {
+	case '{':
+		obj := jsonObject{}
+		for dec.More() {
+			tok, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			key, ok := tok.(string)
+			if !ok {
+				return nil, fmt.Errorf("unexpected object key %v", tok)
+			}
+			v, err := decodeJSONValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			obj = append(obj, jsonMember{Key: key, Value: v})
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		return obj, nil
+	case '[':
+		arr := []any{}
+		for dec.More() {
+			v, err := decodeJSONValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		return arr, nil
+	default:
+		return nil, fmt.Errorf("unexpected delimiter %v", delim)
+	}
+}
+
+// marshalString marshals the string as a JSON string, without escaping the HTML characters.
+func marshalString(s string) []byte {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	// Encoding a string never fails
+	_ = enc.Encode(s)
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+}
+
+// EscapeString escapes the content so that it can be put inside a JSON string.
+func EscapeString(s string) []byte {
+	b := marshalString(s)
+	return b[1 : len(b)-1]
+}
+
+// staticRefAttrs are the meta-arguments whose value is a (list of) static reference, keyed by the type of the
+// containing block ("" for the top-level block). In JSON syntax, these references are expressed as plain strings
+// instead of templates.
+var staticRefAttrs = map[string]map[string]bool{
+	"":          {"depends_on": true, "provider": true},
+	"lifecycle": {"ignore_changes": true, "replace_triggered_by": true},
+	"dynamic":   {"iterator": true},
+}
@@ -0,0 +1,207 @@
+package jsonconfig_test
+
+import (
+	"testing"
+
+	"github.com/hashicorp/hcl/v2"
+	hcljson "github.com/hashicorp/hcl/v2/json"
+	tfjson "github.com/hashicorp/terraform-json"
+	"github.com/magodo/terrafix/internal/jsonconfig"
+	"github.com/stretchr/testify/require"
+)
+
+const testConfig = `{
+  "resource": {
+    "azurerm_resource_group": {
+      "test": {
+        "//": "the test resource group",
+        "count": 2,
+        "name": "rg-${var.name}-${count.index}",
+        "location": "${var.location}",
+        "tags": {
+          "env": "dev",
+          "owner": "${local.owner}"
+        },
+        "block": [
+          {
+            "a": 1
+          },
+          {
+            "a": 2
+          }
+        ],
+        "dynamic": {
+          "block": {
+            "for_each": "${var.blocks}",
+            "content": {
+              "a": "${block.value}"
+            }
+          }
+        },
+        "depends_on": [
+          "azurerm_virtual_network.test"
+        ],
+        "lifecycle": {
+          "ignore_changes": [
+            "tags"
+          ]
+        }
+      }
+    }
+  },
+  "provider": {
+    "azurerm": {
+      "features": {}
+    }
+  },
+  "output": {
+    "id": {
+      "value": "${azurerm_resource_group.test[0].id}"
+    }
+  }
+}
+`
+
+const testNativeConfig = `resource "azurerm_resource_group" "test" {
+  # the test resource group
+  count    = 2
+  name     = "rg-${var.name}-${count.index}"
+  location = var.location
+  tags = {
+    "env"   = "dev"
+    "owner" = local.owner
+  }
+  block {
+    a = 1
+  }
+  block {
+    a = 2
+  }
+  dynamic "block" {
+    for_each = var.blocks
+    content {
+      a = block.value
+    }
+  }
+  depends_on = [azurerm_virtual_network.test]
+  lifecycle {
+    ignore_changes = [tags]
+  }
+}`
+
+var testSchema = &tfjson.SchemaBlock{
+	Attributes: map[string]*tfjson.SchemaAttribute{
+		"name":     {},
+		"location": {},
+		"tags":     {},
+	},
+	NestedBlocks: map[string]*tfjson.SchemaBlockType{
+		"block": {
+			NestingMode: tfjson.SchemaNestingModeList,
+			Block: &tfjson.SchemaBlock{
+				Attributes: map[string]*tfjson.SchemaAttribute{
+					"a": {},
+				},
+			},
+		},
+	},
+}
+
+func parseTestConfig(t *testing.T) *hcl.File {
+	f, diags := hcljson.Parse([]byte(testConfig), "main.tf.json")
+	require.False(t, diags.HasErrors(), diags.Error())
+	return f
+}
+
+func TestBlocks(t *testing.T) {
+	blks, err := jsonconfig.Blocks(parseTestConfig(t))
+	require.NoError(t, err)
+	require.Len(t, blks, 2)
+	require.Equal(t, "resource", blks[0].Type)
+	require.Equal(t, []string{"azurerm_resource_group", "test"}, blks[0].Labels)
+	require.Equal(t, "provider", blks[1].Type)
+	require.Equal(t, []string{"azurerm"}, blks[1].Labels)
+}
+
+func TestBlockToNative(t *testing.T) {
+	f := parseTestConfig(t)
+	blks, err := jsonconfig.Blocks(f)
+	require.NoError(t, err)
+	b, err := jsonconfig.BlockToNative(f.Bytes, blks[0], testSchema)
+	require.NoError(t, err)
+	require.Equal(t, testNativeConfig, string(b))
+}
+
+func TestBlockFromNative(t *testing.T) {
+	f := parseTestConfig(t)
+	blks, err := jsonconfig.Blocks(f)
+	require.NoError(t, err)
+	b, err := jsonconfig.BlockFromNative([]byte(testNativeConfig), "      ", "  ")
+	require.NoError(t, err)
+	require.Equal(t, string(jsonconfig.BodyRange(blks[0]).SliceBytes(f.Bytes)), string(b))
+
+	// Complex templates are wrapped as a whole
+	b, err = jsonconfig.BlockFromNative([]byte(`resource "foo" "test" {
+  a = "%{if var.x}x%{endif}"
+  b = var.x ? 1 : 2
+}`), "", "  ")
+	require.NoError(t, err)
+	require.Equal(t, `{
+  "a": "${\"%{if var.x}x%{endif}\"}",
+  "b": "${var.x ? 1 : 2}"
+}`, string(b))
+	// The comments of the nested blocks are kept, as the first property
+	nested := `resource "foo" "test" {
+  a = 1
+  # top
+  block {
+    b = 2
+    # nested
+    dynamic "inner" {
+      for_each = var.x
+      content {
+        // content
+        c = inner.value
+      }
+    }
+  }
+}`
+	b, err = jsonconfig.BlockFromNative([]byte(nested), "", "  ")
+	require.NoError(t, err)
+	require.Equal(t, `{
+  "//": "top",
+  "a": 1,
+  "block": {
+    "//": "nested",
+    "b": 2,
+    "dynamic": {
+      "inner": {
+        "for_each": "${var.x}",
+        "content": {
+          "//": "content",
+          "c": "${inner.value}"
+        }
+      }
+    }
+  }
+}`, string(b))
+}
+
+func TestTraversals(t *testing.T) {
+	f := parseTestConfig(t)
+	traversals, err := jsonconfig.Traversals(f)
+	require.NoError(t, err)
+	var srcs []string
+	for _, traversal := range traversals {
+		srcs = append(srcs, string(traversal.SourceRange().SliceBytes(f.Bytes)))
+	}
+	require.Equal(t, []string{
+		"var.name",
+		"count.index",
+		"var.location",
+		"local.owner",
+		"var.blocks",
+		"block.value",
+		"azurerm_resource_group.test[0].id",
+	}, srcs)
+}
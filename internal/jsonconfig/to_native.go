@@ -0,0 +1,238 @@
+package jsonconfig
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	tfjson "github.com/hashicorp/terraform-json"
+)
+
+// BlockToNative converts the top-level block defined in the JSON file (whose content is src) to the native syntax.
+//
+// As the JSON syntax can't tell a nested block from an attribute of an object type, the schema of the block is
+// used to identify the nested blocks. The schema can be nil, in which case only the meta-argument blocks
+// (e.g. lifecycle, dynamic) are identified.
+// The comments (i.e. the "//" properties) in the block body, as well as in the nested blocks, are converted to the
+// native comments.
+func BlockToNative(src []byte, blk *hcl.Block, sch *tfjson.SchemaBlock) ([]byte, error) {
+	v, err := decodeJSON(BodyRange(blk).SliceBytes(src))
+	if err != nil {
+		return nil, fmt.Errorf("decoding JSON body of %s: %v", blk.DefRange, err)
+	}
+	body, ok := v.(jsonObject)
+	if !ok {
+		return nil, fmt.Errorf("the body of %s is not a JSON object", blk.DefRange)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(blk.Type)
+	for _, label := range blk.Labels {
+		buf.WriteString(" " + quoteString(label))
+	}
+	buf.WriteString(" {\n")
+	if err := writeNativeBody(&buf, "", body, sch); err != nil {
+		return nil, fmt.Errorf("converting %s: %v", blk.DefRange, err)
+	}
+	buf.WriteString("}\n")
+
+	return bytes.TrimSuffix(hclwrite.Format(buf.Bytes()), []byte("\n")), nil
+}
+
+// writeNativeBody writes the body in native syntax. The blockType is the type of the block that contains
+// this body, or "" for the top-level block.
+func writeNativeBody(buf *bytes.Buffer, blockType string, body jsonObject, sch *tfjson.SchemaBlock) error {
+	for _, m := range body {
+		if m.Key == "//" {
+			comment, ok := m.Value.(string)
+			if !ok {
+				return fmt.Errorf(`the comment property "//" is not a string`)
+			}
+			for _, line := range strings.Split(comment, "\n") {
+				buf.WriteString(strings.TrimSpace("# "+line) + "\n")
+			}
+			continue
+		}
+
+		if staticRefAttrs[blockType][m.Key] {
+			expr, err := staticRefToNative(m.Value)
+			if err != nil {
+				return fmt.Errorf("attribute %q: %v", m.Key, err)
+			}
+			buf.WriteString(m.Key + " = " + expr + "\n")
+			continue
+		}
+
+		var (
+			isBlock   bool
+			nestedSch *tfjson.SchemaBlock
+			labelN    int
+		)
+		switch {
+		case blockType == "" && m.Key == "lifecycle":
+			isBlock = true
+		case m.Key == "dynamic" && sch != nil:
+			isBlock = true
+			labelN = 1
+		case m.Key == "content" && blockType == "dynamic":
+			// The schema of the content block is already set to the one of the dynamic block.
+			isBlock = true
+			nestedSch = sch
+		case sch != nil && sch.NestedBlocks[m.Key] != nil:
+			isBlock = true
+			nestedSch = sch.NestedBlocks[m.Key].Block
+		}
+		if !isBlock {
+			buf.WriteString(m.Key + " = " + exprToNative(m.Value) + "\n")
+			continue
+		}
+		if err := writeNativeBlocks(buf, m.Key, nil, labelN, m.Value, sch, nestedSch); err != nil {
+			return fmt.Errorf("block %q: %v", m.Key, err)
+		}
+	}
+	return nil
+}
+
+// writeNativeBlocks writes the nested block(s) of the blockType in native syntax, whose JSON value is v.
+// The labelN is the number of labels that are still expected to be consumed from the JSON value.
+// The parentSch is the schema of the containing block, which is used to find the schema of the dynamic blocks.
+func writeNativeBlocks(buf *bytes.Buffer, blockType string, labels []string, labelN int, v any, parentSch, sch *tfjson.SchemaBlock) error {
+	switch v := v.(type) {
+	case []any:
+		for _, elem := range v {
+			if err := writeNativeBlocks(buf, blockType, labels, labelN, elem, parentSch, sch); err != nil {
+				return err
+			}
+		}
+		return nil
+	case jsonObject:
+		if labelN > 0 {
+			for _, m := range v {
+				if err := writeNativeBlocks(buf, blockType, append(labels, m.Key), labelN-1, m.Value, parentSch, sch); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if blockType == "dynamic" && parentSch != nil {
+			if bt := parentSch.NestedBlocks[labels[0]]; bt != nil {
+				sch = bt.Block
+			}
+		}
+		buf.WriteString(blockType)
+		for _, label := range labels {
+			buf.WriteString(" " + quoteString(label))
+		}
+		buf.WriteString(" {\n")
+		if err := writeNativeBody(buf, blockType, v, sch); err != nil {
+			return err
+		}
+		buf.WriteString("}\n")
+		return nil
+	default:
+		return fmt.Errorf("expects a JSON object or array, got %v", v)
+	}
+}
+
+// exprToNative converts a JSON value of an attribute to the expression in native syntax.
+func exprToNative(v any) string {
+	switch v := v.(type) {
+	case string:
+		return templateToNative(v)
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	case nil:
+		return "null"
+	case []any:
+		var elems []string
+		for _, elem := range v {
+			elems = append(elems, exprToNative(elem))
+		}
+		return "[" + strings.Join(elems, ", ") + "]"
+	case jsonObject:
+		if len(v) == 0 {
+			return "{}"
+		}
+		var sb strings.Builder
+		sb.WriteString("{\n")
+		for _, m := range v {
+			sb.WriteString(templateToNative(m.Key) + " = " + exprToNative(m.Value) + "\n")
+		}
+		sb.WriteString("}")
+		return sb.String()
+	default:
+		panic(fmt.Sprintf("unexpected JSON value type %T", v))
+	}
+}
+
+// templateToNative converts a JSON string, which is a template, to the expression in native syntax.
+// A template that only contains a single interpolation is unwrapped, e.g. "${var.foo}" is converted to var.foo.
+func templateToNative(s string) string {
+	expr, diags := hclsyntax.ParseTemplate([]byte(s), "", hcl.InitialPos)
+	if !diags.HasErrors() {
+		if wrap, ok := expr.(*hclsyntax.TemplateWrapExpr); ok && strings.HasPrefix(s, "${") && !strings.HasPrefix(s, "${~") && !strings.HasSuffix(s, "~}") {
+			return strings.TrimSpace(string(wrap.Wrapped.Range().SliceBytes([]byte(s))))
+		}
+	}
+	return quoteString(s)
+}
+
+// staticRefToNative converts a JSON value of a static reference (or a list of static references) to the
+// native syntax, e.g. "azurerm_resource_group.test" is converted to azurerm_resource_group.test.
+func staticRefToNative(v any) (string, error) {
+	switch v := v.(type) {
+	case string:
+		ref := strings.TrimSpace(v)
+		if strings.HasPrefix(ref, "${") && strings.HasSuffix(ref, "}") {
+			ref = strings.TrimSpace(ref[2 : len(ref)-1])
+		}
+		return ref, nil
+	case []any:
+		var elems []string
+		for _, elem := range v {
+			ref, err := staticRefToNative(elem)
+			if err != nil {
+				return "", err
+			}
+			elems = append(elems, ref)
+		}
+		return "[" + strings.Join(elems, ", ") + "]", nil
+	default:
+		return "", fmt.Errorf("expects a string or an array of strings, got %v", v)
+	}
+}
+
+// quoteString quotes the string in native syntax. The template sequences (i.e. ${ and %{) are kept as is.
+func quoteString(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			sb.WriteString(`\"`)
+		case '\\':
+			sb.WriteString(`\\`)
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\r':
+			sb.WriteString(`\r`)
+		case '\t':
+			sb.WriteString(`\t`)
+		default:
+			if r < 0x20 {
+				fmt.Fprintf(&sb, `\u%04x`, r)
+				continue
+			}
+			sb.WriteRune(r)
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
@@ -0,0 +1,87 @@
+// Package providerschema obtains the provider schemas without terraform, either from the provider executables
+// or from a saved "terraform providers schema -json" output.
+package providerschema
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	tfjson "github.com/hashicorp/terraform-json"
+	"github.com/magodo/terraform-client-go/tfclient"
+	"github.com/magodo/terraform-client-go/tfclient/typ"
+)
+
+// FormatVersion is the format version of the provider schemas built by this package.
+const FormatVersion = "1.0"
+
+// FromClient returns the schema of the provider via the client, in the same representation as
+// "terraform providers schema -json".
+func FromClient(c tfclient.Client) (*tfjson.ProviderSchema, error) {
+	resp, diags := c.GetProviderSchema()
+	if diags.HasErrors() {
+		return nil, fmt.Errorf("get provider schema: %v", diags.Err())
+	}
+	return FromResponse(resp), nil
+}
+
+// FromResponse converts the provider schema response to the representation of "terraform providers schema -json".
+func FromResponse(resp *typ.GetProviderSchemaResponse) *tfjson.ProviderSchema {
+	sch := &tfjson.ProviderSchema{
+		ConfigSchema:      schemaPtr(resp.Provider),
+		ResourceSchemas:   map[string]*tfjson.Schema{},
+		DataSourceSchemas: map[string]*tfjson.Schema{},
+		Functions:         map[string]*tfjson.FunctionSignature{},
+	}
+	for name, rsch := range resp.ResourceTypes {
+		sch.ResourceSchemas[name] = schemaPtr(rsch)
+	}
+	for name, dsch := range resp.DataSources {
+		sch.DataSourceSchemas[name] = schemaPtr(dsch)
+	}
+	for name, decl := range resp.Functions {
+		sig := &tfjson.FunctionSignature{
+			Description:        decl.Description,
+			Summary:            decl.Summary,
+			DeprecationMessage: decl.DeprecationMessage,
+			ReturnType:         decl.ReturnType,
+		}
+		for _, param := range decl.Parameters {
+			sig.Parameters = append(sig.Parameters, functionParameter(param))
+		}
+		if decl.VariadicParameter != nil {
+			sig.VariadicParameter = functionParameter(*decl.VariadicParameter)
+		}
+		sch.Functions[name] = sig
+	}
+	return sch
+}
+
+// LoadFile loads the provider schemas from the file, which is the output of "terraform providers schema -json".
+func LoadFile(path string) (*tfjson.ProviderSchemas, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var schs tfjson.ProviderSchemas
+	if err := json.Unmarshal(b, &schs); err != nil {
+		return nil, fmt.Errorf("decoding provider schemas from %q: %v", path, err)
+	}
+	return &schs, nil
+}
+
+func schemaPtr(sch tfjson.Schema) *tfjson.Schema {
+	if sch.Block == nil {
+		sch.Block = &tfjson.SchemaBlock{}
+	}
+	return &sch
+}
+
+func functionParameter(param typ.FunctionParam) *tfjson.FunctionParameter {
+	return &tfjson.FunctionParameter{
+		Name:        param.Name,
+		Description: param.Description,
+		IsNullable:  param.AllowNullValue,
+		Type:        param.Type,
+	}
+}
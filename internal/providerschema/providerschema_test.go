@@ -0,0 +1,50 @@
+package providerschema_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	tfjson "github.com/hashicorp/terraform-json"
+	"github.com/magodo/terrafix/internal/providerschema"
+	"github.com/magodo/terraform-client-go/tfclient/typ"
+	"github.com/stretchr/testify/require"
+	"github.com/zclconf/go-cty/cty"
+)
+
+func TestFromResponse(t *testing.T) {
+	sch := providerschema.FromResponse(&typ.GetProviderSchemaResponse{
+		ResourceTypes: map[string]tfjson.Schema{
+			"foo_bar": {Version: 1, Block: &tfjson.SchemaBlock{Attributes: map[string]*tfjson.SchemaAttribute{"name": {AttributeType: cty.String, Required: true}}}},
+		},
+		Functions: map[string]typ.FunctionDecl{
+			"echo": {Parameters: []typ.FunctionParam{{Name: "input", Type: cty.String}}, ReturnType: cty.String},
+		},
+	})
+	require.NotNil(t, sch.ConfigSchema.Block)
+	require.Equal(t, uint64(1), sch.ResourceSchemas["foo_bar"].Version)
+	require.True(t, sch.ResourceSchemas["foo_bar"].Block.Attributes["name"].Required)
+	require.Empty(t, sch.DataSourceSchemas)
+	require.Equal(t, cty.String, sch.Functions["echo"].ReturnType)
+	require.Equal(t, "input", sch.Functions["echo"].Parameters[0].Name)
+}
+
+func TestLoadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "schema.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{
+  "format_version": "1.0",
+  "provider_schemas": {
+    "registry.terraform.io/hashicorp/foo": {
+      "provider": {"version": 0, "block": {}},
+      "resource_schemas": {"foo_bar": {"version": 2, "block": {}}}
+    }
+  }
+}`), 0644))
+	schs, err := providerschema.LoadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), schs.Schemas["registry.terraform.io/hashicorp/foo"].ResourceSchemas["foo_bar"].Version)
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"provider_schemas": {}}`), 0644))
+	_, err = providerschema.LoadFile(path)
+	require.Error(t, err)
+}
@@ -0,0 +1,241 @@
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/magodo/terrafix/internal/fixer"
+)
+
+// Phase is the phase of the fix that a change comes from
+type Phase string
+
+const (
+	// PhaseLoad is the loading of the modules, before any fix
+	PhaseLoad       Phase = "load"
+	PhaseReference  Phase = "reference"
+	PhaseDefinition Phase = "definition"
+	// PhaseValidate is the post-fix "terraform validate" of the fixed configurations
+	PhaseValidate Phase = "validate"
+)
+
+// Report records the changes applied to each file of each module.
+// The modules are ordered by path, and the files are ordered by name.
+type Report struct {
+	Modules []*Module `json:"modules"`
+
+	// ExternalModules are the external modules (e.g. registry, git modules) that are changed,
+	// which need to be patched by their owners.
+	ExternalModules []ExternalModule `json:"external_modules,omitempty"`
+
+	// Failures are the blocks that failed to be fixed in the continue-on-error mode, ordered as they are processed.
+	Failures []Failure `json:"failures,omitempty"`
+
+	// Diagnostics are the (non-error) diagnostics from the fixers, ordered as they are applied.
+	Diagnostics []Diagnostic `json:"diagnostics,omitempty"`
+
+	// Skipped are the blocks and reference origins that are not sent to the fixers, as the fixers don't claim to
+	// fix them, ordered as they are processed.
+	Skipped []Skip `json:"skipped,omitempty"`
+}
+
+type Module struct {
+	Path  string  `json:"path"`
+	Files []*File `json:"files"`
+}
+
+type File struct {
+	Name string `json:"name"`
+	// The changes are ordered as they are applied
+	Changes []Change `json:"changes"`
+}
+
+type ExternalModule struct {
+	// The key of the module in the module manifest, e.g. "network.subnet"
+	Key     string `json:"key"`
+	Source  string `json:"source"`
+	Version string `json:"version,omitempty"`
+	// The directory where the module is installed, relative to the root module
+	Dir string `json:"dir"`
+}
+
+type Change struct {
+	Phase Phase `json:"phase"`
+
+	// The block that triggers this change.
+	// For the reference phase, this is the resource/data source that is targeted by the reference origin.
+	BlockType fixer.BlockType `json:"block_type"`
+	BlockName string          `json:"block_name"`
+	Version   int             `json:"version"`
+	// The address of the block definition, or the reference origin, see Failure.
+	Address string `json:"address"`
+
+	// The range of the old content, in the original file (i.e. before any fix), which is the file content before
+	// any change of this phase is applied for the reference phase. For the definition phase, the positions in the
+	// lines changed by the reference phase are mapped to the beginning of those lines in the original file.
+	Range      Range  `json:"range"`
+	OldContent string `json:"old_content"`
+	NewContent string `json:"new_content"`
+}
+
+// Failure is a block (or a file, or a module) that failed to be fixed.
+type Failure struct {
+	Phase  Phase  `json:"phase"`
+	Module string `json:"module"`
+	// The file and range are absent for a module level failure.
+	File  string `json:"file,omitempty"`
+	Range *Range `json:"range,omitempty"`
+
+	// The block that failed to be fixed, absent for a file or module level failure.
+	// For the reference phase, this is the resource/data source that is targeted by the reference origin.
+	BlockType fixer.BlockType `json:"block_type,omitempty"`
+	BlockName string          `json:"block_name,omitempty"`
+	// The address of the block definition (e.g. azurerm_resource_group.test), or the reference origin
+	// (e.g. azurerm_resource_group.test.name).
+	Address string `json:"address,omitempty"`
+
+	// The error message, including the diagnostics from the provider
+	Error string `json:"error"`
+}
+
+// String returns a one line summary of the failure, e.g. "mod/main.tf:1,1: azurerm_resource_group.test: some error".
+func (f Failure) String() string {
+	loc := location(f.Module, f.File, f.Range)
+	if f.Address != "" {
+		return fmt.Sprintf("%s: %s: %s", loc, f.Address, f.Error)
+	}
+	return fmt.Sprintf("%s: %s", loc, f.Error)
+}
+
+// Skip is a block (or a reference origin) that is skipped, as the fixer doesn't claim to fix it.
+type Skip struct {
+	Phase  Phase  `json:"phase"`
+	Module string `json:"module"`
+	File   string `json:"file"`
+	Range  Range  `json:"range"`
+
+	// The block that is skipped, see Change.
+	BlockType fixer.BlockType `json:"block_type"`
+	BlockName string          `json:"block_name"`
+	Version   int             `json:"version"`
+	// The address of the block definition, or the reference origin, see Failure.
+	Address string `json:"address"`
+
+	Reason string `json:"reason"`
+}
+
+// String returns a one line summary of the skip, e.g. "mod/main.tf:1,1: azurerm_resource_group.test: some reason".
+func (s Skip) String() string {
+	return fmt.Sprintf("%s: %s: %s", location(s.Module, s.File, &s.Range), s.Address, s.Reason)
+}
+
+// Diagnostic is a diagnostic from the fixer about a fix, e.g. a warning about an attribute to be reviewed,
+// or a diagnostic from the post-fix "terraform validate" (the validate phase), which has no block or address, and
+// has no file or range if it is not about a specific location.
+type Diagnostic struct {
+	Phase  Phase  `json:"phase"`
+	Module string `json:"module"`
+	File   string `json:"file"`
+	// The range that this diagnostic is about, in the file content right after the fix is applied.
+	// This is either the range of the fixed content, or a part of it.
+	Range Range `json:"range"`
+
+	// The block that triggers this diagnostic, see Change.
+	BlockType fixer.BlockType `json:"block_type"`
+	BlockName string          `json:"block_name"`
+	// The address of the block definition, or the reference origin, see Failure.
+	Address string `json:"address"`
+
+	Severity fixer.Severity `json:"severity"`
+	Summary  string         `json:"summary"`
+	Detail   string         `json:"detail,omitempty"`
+}
+
+// String returns a one line summary of the diagnostic, e.g. "mod/main.tf:3,5: azurerm_resource_group.test: some summary: some detail".
+func (d Diagnostic) String() string {
+	msg := d.Summary
+	if d.Detail != "" {
+		msg += ": " + d.Detail
+	}
+	var rng *Range
+	if d.File != "" {
+		rng = &d.Range
+	}
+	if d.Address == "" {
+		return fmt.Sprintf("%s: %s", location(d.Module, d.File, rng), msg)
+	}
+	return fmt.Sprintf("%s: %s: %s", location(d.Module, d.File, rng), d.Address, msg)
+}
+
+// location returns the location in form of "<module>/<file>:<line>,<column>", where the file and range are optional.
+func location(module, file string, rng *Range) string {
+	loc := module
+	if file != "" {
+		loc = path.Join(module, file)
+	}
+	if rng != nil {
+		loc += fmt.Sprintf(":%d,%d", rng.Start.Line, rng.Start.Column)
+	}
+	return loc
+}
+
+type Range struct {
+	Start Pos `json:"start"`
+	End   Pos `json:"end"`
+}
+
+type Pos struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+	Byte   int `json:"byte"`
+}
+
+func NewRange(rng hcl.Range) Range {
+	return Range{
+		Start: Pos{Line: rng.Start.Line, Column: rng.Start.Column, Byte: rng.Start.Byte},
+		End:   Pos{Line: rng.End.Line, Column: rng.End.Column, Byte: rng.End.Byte},
+	}
+}
+
+// Add adds a change to the file of the module.
+func (r *Report) Add(modPath, filename string, change Change) {
+	i := sort.Search(len(r.Modules), func(i int) bool { return r.Modules[i].Path >= modPath })
+	if i == len(r.Modules) || r.Modules[i].Path != modPath {
+		r.Modules = append(r.Modules[:i], append([]*Module{{Path: modPath}}, r.Modules[i:]...)...)
+	}
+	mod := r.Modules[i]
+
+	j := sort.Search(len(mod.Files), func(j int) bool { return mod.Files[j].Name >= filename })
+	if j == len(mod.Files) || mod.Files[j].Name != filename {
+		mod.Files = append(mod.Files[:j], append([]*File{{Name: filename}}, mod.Files[j:]...)...)
+	}
+	f := mod.Files[j]
+
+	f.Changes = append(f.Changes, change)
+}
+
+// AddFailure records a failure.
+func (r *Report) AddFailure(failure Failure) {
+	r.Failures = append(r.Failures, failure)
+}
+
+// AddSkip records a skipped block or reference origin.
+func (r *Report) AddSkip(skip Skip) {
+	r.Skipped = append(r.Skipped, skip)
+}
+
+// AddDiagnostic records a diagnostic.
+func (r *Report) AddDiagnostic(diag Diagnostic) {
+	r.Diagnostics = append(r.Diagnostics, diag)
+}
+
+// WriteJSON writes the report in JSON format.
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
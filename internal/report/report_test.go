@@ -0,0 +1,70 @@
+package report_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/magodo/terrafix/internal/fixer"
+	"github.com/magodo/terrafix/internal/report"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReport(t *testing.T) {
+	var r report.Report
+	r.Add("mod/b", "main.tf", report.Change{Phase: report.PhaseDefinition, BlockType: fixer.BlockTypeResource, BlockName: "foo"})
+	r.Add("mod", "main.tf", report.Change{Phase: report.PhaseReference, BlockType: fixer.BlockTypeResource, BlockName: "foo"})
+	r.Add("mod", "a.tf", report.Change{Phase: report.PhaseReference, BlockType: fixer.BlockTypeDataSource, BlockName: "bar"})
+	r.Add("mod", "main.tf", report.Change{Phase: report.PhaseDefinition, BlockType: fixer.BlockTypeResource, BlockName: "foo"})
+
+	require.Len(t, r.Modules, 2)
+	require.Equal(t, "mod", r.Modules[0].Path)
+	require.Equal(t, "mod/b", r.Modules[1].Path)
+	require.Len(t, r.Modules[0].Files, 2)
+	require.Equal(t, "a.tf", r.Modules[0].Files[0].Name)
+	require.Equal(t, "main.tf", r.Modules[0].Files[1].Name)
+	require.Len(t, r.Modules[0].Files[1].Changes, 2)
+	require.Equal(t, report.PhaseReference, r.Modules[0].Files[1].Changes[0].Phase)
+	require.Equal(t, report.PhaseDefinition, r.Modules[0].Files[1].Changes[1].Phase)
+
+	var buf bytes.Buffer
+	require.NoError(t, r.WriteJSON(&buf))
+	require.Contains(t, buf.String(), `"block_type": "datasource"`)
+}
+
+func TestFailure(t *testing.T) {
+	rng := report.Range{Start: report.Pos{Line: 3, Column: 1, Byte: 20}, End: report.Pos{Line: 5, Column: 2, Byte: 60}}
+	var r report.Report
+	r.AddFailure(report.Failure{Phase: report.PhaseDefinition, Module: "mod", File: "main.tf", Range: &rng, Address: "foo.test", Error: "boom"})
+	r.AddFailure(report.Failure{Phase: report.PhaseDefinition, Module: "mod", Error: "bad module"})
+
+	require.Equal(t, "mod/main.tf:3,1: foo.test: boom", r.Failures[0].String())
+	require.Equal(t, "mod: bad module", r.Failures[1].String())
+
+	var buf bytes.Buffer
+	require.NoError(t, r.WriteJSON(&buf))
+	require.Contains(t, buf.String(), `"failures": [`)
+}
+
+func TestDiagnostic(t *testing.T) {
+	rng := report.Range{Start: report.Pos{Line: 3, Column: 5, Byte: 24}, End: report.Pos{Line: 3, Column: 9, Byte: 28}}
+	var r report.Report
+	r.AddDiagnostic(report.Diagnostic{Phase: report.PhaseDefinition, Module: "mod", File: "main.tf", Range: rng, Address: "foo.test", Severity: fixer.SeverityWarning, Summary: "review", Detail: "please"})
+	r.AddDiagnostic(report.Diagnostic{Phase: report.PhaseValidate, Module: "mod", File: "main.tf", Range: rng, Severity: fixer.SeverityError, Summary: "Missing required argument"})
+	r.AddDiagnostic(report.Diagnostic{Phase: report.PhaseValidate, Module: "mod", Severity: fixer.SeverityWarning, Summary: "Deprecated argument"})
+
+	require.Equal(t, "mod/main.tf:3,5: foo.test: review: please", r.Diagnostics[0].String())
+	require.Equal(t, "mod/main.tf:3,5: Missing required argument", r.Diagnostics[1].String())
+	require.Equal(t, "mod: Deprecated argument", r.Diagnostics[2].String())
+}
+
+func TestSkip(t *testing.T) {
+	rng := report.Range{Start: report.Pos{Line: 3, Column: 1, Byte: 20}, End: report.Pos{Line: 5, Column: 2, Byte: 60}}
+	var r report.Report
+	r.AddSkip(report.Skip{Phase: report.PhaseDefinition, Module: "mod", File: "main.tf", Range: rng, BlockType: fixer.BlockTypeResource, BlockName: "foo", Address: "foo.test", Reason: "not claimed"})
+
+	require.Equal(t, "mod/main.tf:3,1: foo.test: not claimed", r.Skipped[0].String())
+
+	var buf bytes.Buffer
+	require.NoError(t, r.WriteJSON(&buf))
+	require.Contains(t, buf.String(), `"skipped": [`)
+}
@@ -2,14 +2,18 @@ package state
 
 import (
 	"fmt"
+	"maps"
 	"path/filepath"
+	"slices"
 	"strings"
 
 	"github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/hcl-lang/reference"
 	"github.com/hashicorp/hcl/v2"
 	"github.com/hashicorp/hcl/v2/hclsyntax"
+	hcljson "github.com/hashicorp/hcl/v2/json"
 	tfjson "github.com/hashicorp/terraform-json"
+	tfaddr "github.com/hashicorp/terraform-registry-address"
 	"github.com/hashicorp/terraform-schema/earlydecoder"
 	tfmodule "github.com/hashicorp/terraform-schema/module"
 	"github.com/magodo/terrafix/internal/filesystem"
@@ -18,12 +22,17 @@ import (
 type ModuleState struct {
 	SourceAddr tfmodule.ModuleSourceAddr
 
+	// The static addresses (i.e. without index) of the module calls that call this module, in the order they are
+	// found, e.g. module.net.module.subnet. It is [""] for the root module.
+	Addrs []string
+
 	Meta tfmodule.Meta
 
 	Files map[string]*hcl.File
 
 	// The terraform state of the resources/data sources.
-	// Only the resource with no resource/module "count"/"for_each" used will be populated.
+	// Only the resource that has exactly one instance, across all the module calls that call this module, and with no
+	// resource/module "count"/"for_each" used will be populated.
 	//
 	// The key is the relative resource address to the containing module, without the index part:
 	// - Absoulute address: [module.<module name>[\[index\]].][data.]<resource type>.<resource name>[\[<index>\]]
@@ -31,13 +40,50 @@ type ModuleState struct {
 	// (as we only support non-index addressed resources)
 	TFStateResources map[string]*tfjson.StateResource
 
+	// The terraform state of all the instances of the resources/data sources, including those
+	// with resource/module "count"/"for_each" used.
+	//
+	// The key is the same relative resource address as TFStateResources. The value is a map keyed by
+	// the absolute address of each instance, e.g. module.foo["a"].azurerm_resource_group.test[0].
+	TFStateResourceInstances map[string]map[string]*tfjson.StateResource
+
+	// The terraform state of each instance of this module, of all the module calls that call this module.
+	tfstates []*tfjson.StateModule
+
 	OriginRefs reference.Origins
 	TargetRefs reference.Targets
 }
 
-func (s *RootState) AddModuleState(fs filesystem.FS, modPath string, tfstate *tfjson.StateModule) error {
+// Filenames returns the names of the files of this module, in lexical order.
+func (s *ModuleState) Filenames() []string {
+	return slices.Sorted(maps.Keys(s.Files))
+}
+
+// ProviderAddr returns the fully qualified address of the provider, which is referred by the local name in this module.
+// For the provider that is not defined in the required_providers block, it is assumed to be namespaced by hashicorp.
+func (s *ModuleState) ProviderAddr(localName string) tfaddr.Provider {
+	if addr, ok := s.Meta.ProviderReferences[tfmodule.ProviderRef{LocalName: localName}]; ok {
+		return adjustProviderAddr(addr)
+	}
+	return adjustProviderAddr(tfaddr.Provider{
+		Type:      localName,
+		Namespace: tfaddr.LegacyProviderNamespace,
+		Hostname:  tfaddr.DefaultProviderRegistryHost,
+	})
+}
+
+// AddModuleState adds the module state for the module at modPath, and recursively for its local module calls.
+// The tfstates are the terraform state of each instance of this module, which can be more than one if
+// the module (or any of its ancestors) uses "count"/"for_each". The modAddr is the static address of the module call
+// that calls this module, or "" for the root module.
+//
+// A module that is called by more than one module call is only added once, with the addresses and the tfstates of
+// the other module calls merged into it (see addModuleCall).
+func (s *RootState) AddModuleState(fs filesystem.FS, modPath, modAddr string, tfstates []*tfjson.StateModule) error {
 	state := ModuleState{
 		SourceAddr: tfmodule.LocalSourceAddr(modPath),
+		Addrs:      []string{modAddr},
+		tfstates:   tfstates,
 	}
 
 	// ModuleState: Files
@@ -47,13 +93,21 @@ func (s *RootState) AddModuleState(fs filesystem.FS, modPath string, tfstate *tf
 		return fmt.Errorf("reading dir %q: %v", modPath, err)
 	}
 	for _, e := range es {
-		if e.Type().IsRegular() && strings.HasSuffix(e.Name(), ".tf") {
+		if e.Type().IsRegular() && IsModuleFilename(e.Name()) {
 			fpath := filepath.Join(modPath, e.Name())
 			b, err := fs.ReadFile(fpath)
 			if err != nil {
 				return fmt.Errorf("reading %q: %v", fpath, err)
 			}
-			f, diags := hclsyntax.ParseConfig(b, e.Name(), hcl.InitialPos)
+			var (
+				f     *hcl.File
+				diags hcl.Diagnostics
+			)
+			if strings.HasSuffix(e.Name(), ".tf.json") {
+				f, diags = hcljson.Parse(b, e.Name())
+			} else {
+				f, diags = hclsyntax.ParseConfig(b, e.Name(), hcl.InitialPos)
+			}
 			if diags.HasErrors() {
 				return fmt.Errorf("HCL parse %q: %v", fpath, diags.Error())
 			}
@@ -70,20 +124,7 @@ func (s *RootState) AddModuleState(fs filesystem.FS, modPath string, tfstate *tf
 	state.Meta = *meta
 
 	// ModuleState: TFState
-	tfStateResources := map[string]*tfjson.StateResource{}
-	if tfstate != nil {
-		for _, res := range tfstate.Resources {
-			if res.Index != nil {
-				continue
-			}
-			relResAddr := res.Type + "." + res.Name
-			if res.Mode == tfjson.DataResourceMode {
-				relResAddr = "data." + relResAddr
-			}
-			tfStateResources[relResAddr] = res
-		}
-	}
-	state.TFStateResources = tfStateResources
+	state.setTFState()
 
 	// Add the the partially built module state into the root state.
 	// The Origin/Target Refs will be updated once all the modules are added.
@@ -96,52 +137,169 @@ func (s *RootState) AddModuleState(fs filesystem.FS, modPath string, tfstate *tf
 		return fmt.Errorf("getting declared module calls for %q failed: %v", modPath, err)
 	}
 	var errs *multierror.Error
-	for localName, mc := range declared {
-		var mcPath string
-		var modState *tfjson.StateModule
-		switch source := mc.SourceAddr.(type) {
-		// For local module sources, we can construct the path directly from the configuration
-		case tfmodule.LocalSourceAddr:
-			mcPath = filepath.Join(modPath, filepath.FromSlash(source.String()))
-
-			if tfstate != nil {
-				// The module address in tfjson follows the following pattern:
-				// [module.<local name>[\[index\]].]...
-				// E.g. module.a[0].module.b.module.c[0]
-				// We only supports modules with no indexed-address.
-				for _, cm := range tfstate.ChildModules {
-					// Simply split by "." as "." won't appear in the module name
-					segs := strings.Split(cm.Address, ".")
-					modName := segs[len(segs)-1]
-					if bracketIdx := strings.Index(modName, "["); bracketIdx != -1 {
-						continue
-					}
-
-					if localName == modName {
-						modState = cm
-						break
-					}
-				}
-			}
-		default:
-			// Only local module is taken into consideration as it is mutable
+	// Iterate the module calls in order, so that the error (if any) is deterministic
+	for _, localName := range slices.Sorted(maps.Keys(declared)) {
+		mc := declared[localName]
+		mcPath, ok := s.moduleCallPath(modPath, mc)
+		if !ok {
 			continue
 		}
+		mcAddr := joinModuleAddr(modAddr, localName)
+		modStates := childModuleStates(tfstates, localName)
+
+		// In the keep-going mode, the module call that fails is skipped, together with its descendant modules.
+		fail := func(err error) {
+			if s.opt.KeepGoing {
+				s.ModuleCallErrors = append(s.ModuleCallErrors, ModuleCallError{Path: mcPath, Addr: mcAddr, Err: err})
+				return
+			}
+			errs = multierror.Append(errs, fmt.Errorf("module call %s: %v", mcAddr, err))
+		}
 
 		fi, err := fs.Stat(mcPath)
-		if err != nil || !fi.IsDir() {
-			multierror.Append(errs, err)
+		if err != nil {
+			fail(err)
+			continue
+		}
+		if !fi.IsDir() {
+			fail(fmt.Errorf("the module path %q is not a directory", mcPath))
 			continue
 		}
 
 		if _, ok := s.ModuleStates[mcPath]; ok {
+			if err := s.addModuleCall(mcPath, mcAddr, modStates); err != nil {
+				fail(fmt.Errorf("add module call for %q: %v", mcPath, err))
+			}
 			continue
 		}
 
-		if err := s.AddModuleState(fs, mcPath, modState); err != nil {
-			multierror.Append(errs, fmt.Errorf("add module state for %q: %v", mcPath, err))
+		if err := s.AddModuleState(fs, mcPath, mcAddr, modStates); err != nil {
+			fail(fmt.Errorf("add module state for %q: %v", mcPath, err))
 		}
 	}
 
 	return errs.ErrorOrNil()
 }
+
+// moduleCallPath returns the path of the module that is called by the module call declared in the module of modPath.
+// It returns false if the called module is not taken into consideration.
+func (s *RootState) moduleCallPath(modPath string, mc tfmodule.DeclaredModuleCall) (string, bool) {
+	switch source := mc.SourceAddr.(type) {
+	// For local module sources, we can construct the path directly from the configuration
+	case tfmodule.LocalSourceAddr:
+		return filepath.Join(modPath, filepath.FromSlash(source.String())), true
+	default:
+		// By default, only local module is taken into consideration as it is mutable.
+		// The external modules are only taken into consideration when opted in, which are located
+		// via the module manifest.
+		if !s.opt.IncludeExternalModules {
+			return "", false
+		}
+		dir, ok := s.InstalledModulePath(s.RootPath, mc.SourceAddr.String())
+		if !ok {
+			return "", false
+		}
+		return filepath.Join(s.RootPath, dir), true
+	}
+}
+
+// addModuleCall adds another module call, of the address and the tfstates of its instances, to the module that is
+// already added, as well as to its descendant modules.
+func (s *RootState) addModuleCall(modPath, modAddr string, tfstates []*tfjson.StateModule) error {
+	ms := s.ModuleStates[modPath]
+	if slices.Contains(ms.Addrs, modAddr) {
+		return nil
+	}
+	ms.Addrs = append(ms.Addrs, modAddr)
+	ms.tfstates = append(ms.tfstates, tfstates...)
+	ms.setTFState()
+	declared, err := s.DeclaredModuleCalls(modPath)
+	if err != nil {
+		return err
+	}
+	for _, localName := range slices.Sorted(maps.Keys(declared)) {
+		mcPath, ok := s.moduleCallPath(modPath, declared[localName])
+		if !ok {
+			continue
+		}
+		if _, ok := s.ModuleStates[mcPath]; !ok {
+			continue
+		}
+		if err := s.addModuleCall(mcPath, joinModuleAddr(modAddr, localName), childModuleStates(tfstates, localName)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setTFState populates the terraform state of the resources/data sources from the tfstates of the module instances.
+func (s *ModuleState) setTFState() {
+	s.TFStateResources = map[string]*tfjson.StateResource{}
+	s.TFStateResourceInstances = map[string]map[string]*tfjson.StateResource{}
+	for _, tfstate := range s.tfstates {
+		for _, res := range tfstate.Resources {
+			relResAddr := res.Type + "." + res.Name
+			if res.Mode == tfjson.DataResourceMode {
+				relResAddr = "data." + relResAddr
+			}
+			if s.TFStateResourceInstances[relResAddr] == nil {
+				s.TFStateResourceInstances[relResAddr] = map[string]*tfjson.StateResource{}
+			}
+			s.TFStateResourceInstances[relResAddr][res.Address] = res
+		}
+	}
+	for relResAddr, insts := range s.TFStateResourceInstances {
+		if len(insts) != 1 {
+			continue
+		}
+		for _, res := range insts {
+			if res.Index == nil && !isInstancedModuleAddr(res.Address) {
+				s.TFStateResources[relResAddr] = res
+			}
+		}
+	}
+}
+
+// childModuleStates collects each instance of the module call named localName from each instance of the module.
+// The module address in tfjson follows the following pattern:
+// [module.<local name>[\[index\]].]...
+// E.g. module.a[0].module.b.module.c[0]
+func childModuleStates(tfstates []*tfjson.StateModule, localName string) []*tfjson.StateModule {
+	var out []*tfjson.StateModule
+	for _, tfstate := range tfstates {
+		for _, cm := range tfstate.ChildModules {
+			if moduleCallName(tfstate.Address, cm.Address) == localName {
+				out = append(out, cm)
+			}
+		}
+	}
+	return out
+}
+
+// joinModuleAddr returns the static address of the module call named localName in the module of parentAddr.
+func joinModuleAddr(parentAddr, localName string) string {
+	if parentAddr == "" {
+		return "module." + localName
+	}
+	return parentAddr + ".module." + localName
+}
+
+// moduleCallName returns the module call's local name of the child module address, relative to its parent module address.
+// E.g. parent: module.a[0], child: module.a[0].module.b["x"] returns "b".
+func moduleCallName(parentAddr, childAddr string) string {
+	rel := childAddr
+	if parentAddr != "" {
+		rel = strings.TrimPrefix(rel, parentAddr+".")
+	}
+	rel = strings.TrimPrefix(rel, "module.")
+	if bracketIdx := strings.Index(rel, "["); bracketIdx != -1 {
+		rel = rel[:bracketIdx]
+	}
+	return rel
+}
+
+// isInstancedModuleAddr tells whether the module address contains any index, i.e. the module or any of its
+// ancestors uses "count"/"for_each".
+func isInstancedModuleAddr(addr string) bool {
+	return strings.Contains(addr, "[")
+}
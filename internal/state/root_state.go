@@ -3,8 +3,9 @@ package state
 import (
 	"context"
 	"fmt"
-	"os"
+	"maps"
 	"path/filepath"
+	"slices"
 
 	"strings"
 
@@ -40,24 +41,74 @@ type RootState struct {
 	// manifest to the path of the local directory where the module is installed
 	InstalledModules InstalledModules
 
+	// opt is the option used to build this root state
+	opt Option
+
 	// ModuleStates includes states of each module, keyed by module path.
 	// Especially, the "." key represents the root module.
 	//
 	// TODO: Shall we use tfmodule.ModuleSourceAddr instead?
 	ModuleStates map[string]*ModuleState
+
+	// ModuleCallErrors are the errors of the module calls that are skipped in the keep-going mode (see
+	// Option.KeepGoing), in the order they are found.
+	ModuleCallErrors []ModuleCallError
+}
+
+// ModuleCallError is the error of a module call whose module (e.g. the local path doesn't exist) can't be added.
+type ModuleCallError struct {
+	// The path of the called module
+	Path string
+	// The static address of the module call, e.g. module.net.module.subnet
+	Addr string
+	Err  error
+}
+
+// Option configures how the RootState is built
+type Option struct {
+	// IncludeExternalModules tells whether to also build the module states of the external modules
+	// (e.g. registry, git modules) that are installed under .terraform/modules.
+	// The filesystem is expected to include the installed modules.
+	IncludeExternalModules bool
+
+	// StateFile is the path to a state file (e.g. a snapshot pulled by "terraform state pull"), relative to the
+	// current working directory. If not specified, the state is read from the backend configured by the root module.
+	StateFile string
+
+	// Workspace is the workspace whose state is read from the backend. If not specified, the currently
+	// selected workspace is used. It is ignored when StateFile is specified.
+	Workspace string
+
+	// ProviderSchemas is the schemas of the providers used by the configuration, e.g. fetched from the provider
+	// executables directly, or loaded from a saved "terraform providers schema -json" output.
+	// If specified, the RootState is built without terraform (the tf can be nil), hence no "terraform init" or backend
+	// access is needed: the core schema is of the latest terraform version known, and the terraform state is only
+	// read from the StateFile (if specified), which is parsed directly.
+	ProviderSchemas *tfjson.ProviderSchemas
+
+	// KeepGoing tells whether to skip the module calls whose modules can't be added (e.g. the local path of the
+	// module doesn't exist, or the module has invalid syntax), which are recorded in the ModuleCallErrors, instead
+	// of failing.
+	KeepGoing bool
 }
 
-func NewRootState(tf *tfexec.Terraform, fs filesystem.FS, path string) (*RootState, error) {
+func NewRootState(tf *tfexec.Terraform, fs filesystem.FS, path string, opt Option) (*RootState, error) {
 	ctx := context.Background()
-	var rootState RootState
+	rootState := RootState{
+		opt: opt,
+	}
 
 	path = filepath.Clean(path)
 
 	rootState.RootPath = path
 
-	tfVersion, _, err := tf.Version(ctx, false)
-	if err != nil {
-		return nil, fmt.Errorf("terraform version failed: %v", err)
+	tfVersion := tfschema.LatestAvailableVersion
+	if opt.ProviderSchemas == nil {
+		v, _, err := tf.Version(ctx, false)
+		if err != nil {
+			return nil, fmt.Errorf("terraform version failed: %v", err)
+		}
+		tfVersion = v
 	}
 	rootState.CoreVersion = tfVersion
 
@@ -69,9 +120,12 @@ func NewRootState(tf *tfexec.Terraform, fs filesystem.FS, path string) (*RootSta
 	rootState.CoreSchema = coreSchema
 
 	// Provider schemas
-	providerSchemasJSON, err := tf.ProvidersSchema(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("terraform providers schema failed: %v", err)
+	providerSchemasJSON := opt.ProviderSchemas
+	if providerSchemasJSON == nil {
+		providerSchemasJSON, err = tf.ProvidersSchema(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("terraform providers schema failed: %v", err)
+		}
 	}
 	rootState.ProviderSchemasJSON = providerSchemasJSON
 	providerSchemas := map[tfaddr.Provider]*tfschema.ProviderSchema{}
@@ -93,26 +147,25 @@ func NewRootState(tf *tfexec.Terraform, fs filesystem.FS, path string) (*RootSta
 	rootState.InstalledModules = InstalledModulesFromManifest(mm)
 
 	// Terraform State
-	var tfStateModule *tfjson.StateModule
-	if _, err := os.Stat(filepath.Join(path, "terraform.tfstate")); err == nil {
-		tfstate, err := tf.ShowStateFile(ctx, "terraform.tfstate")
-		if err != nil {
-			return nil, fmt.Errorf("showing state file: %v", err)
-		}
-		if tfstate != nil && tfstate.Values != nil {
-			tfStateModule = tfstate.Values.RootModule
-		}
+	var tfStateModules []*tfjson.StateModule
+	tfstate, err := loadTFState(ctx, tf, opt)
+	if err != nil {
+		return nil, fmt.Errorf("loading terraform state: %v", err)
+	}
+	if tfstate != nil && tfstate.Values != nil {
+		tfStateModules = append(tfStateModules, tfstate.Values.RootModule)
 	}
 
 	// Add module states
 	rootState.ModuleStates = map[string]*ModuleState{}
-	if err := rootState.AddModuleState(fs, path, tfStateModule); err != nil {
+	if err := rootState.AddModuleState(fs, path, "", tfStateModules); err != nil {
 		return nil, fmt.Errorf("add module state for %q: %v", path, err)
 	}
 
 	// Collect references
 	d := rootState.Decoder()
-	for modPath, modState := range rootState.ModuleStates {
+	for _, modPath := range rootState.ModulePaths() {
+		modState := rootState.ModuleStates[modPath]
 		pd, err := d.Path(lang.Path{Path: modPath, LanguageID: languageIDTF})
 		if err != nil {
 			return nil, fmt.Errorf("failed to new path decoder for %q: %v", modPath, err)
@@ -134,6 +187,11 @@ func NewRootState(tf *tfexec.Terraform, fs filesystem.FS, path string) (*RootSta
 	return &rootState, nil
 }
 
+// ModulePaths returns the paths of all the modules, in lexical order.
+func (s *RootState) ModulePaths() []string {
+	return slices.Sorted(maps.Keys(s.ModuleStates))
+}
+
 func (s *RootState) Decoder() *decoder.Decoder {
 	return decoder.NewDecoder(s)
 }
@@ -240,7 +298,7 @@ func (s *RootState) PathContext(path lang.Path) (*decoder.PathContext, error) {
 // Paths implements decoder.PathReader.
 func (s *RootState) Paths(ctx context.Context) []lang.Path {
 	var paths []lang.Path
-	for path := range s.ModuleStates {
+	for _, path := range s.ModulePaths() {
 		paths = append(paths, lang.Path{
 			Path:       path,
 			LanguageID: languageIDTF,
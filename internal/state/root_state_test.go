@@ -12,10 +12,12 @@ import (
 	"github.com/hashicorp/hcl-lang/reference"
 	"github.com/hashicorp/hcl/v2"
 	"github.com/hashicorp/terraform-exec/tfexec"
+	tfjson "github.com/hashicorp/terraform-json"
 	"github.com/magodo/terrafix/internal/filesystem"
 	"github.com/magodo/terrafix/internal/state"
 	"github.com/magodo/terrafix/internal/terraform/find"
 	"github.com/stretchr/testify/require"
+	"github.com/zclconf/go-cty/cty"
 )
 
 func TestRootStateDecoder(t *testing.T) {
@@ -28,7 +30,7 @@ func TestRootStateDecoder(t *testing.T) {
 	fs, err := filesystem.NewMemFS(rootModPath, nil)
 	require.NoError(t, err)
 
-	root, err := state.NewRootState(tf, fs, rootModPath)
+	root, err := state.NewRootState(tf, fs, rootModPath, state.Option{})
 	require.NoError(t, err)
 
 	// Two module states are expected
@@ -366,7 +368,7 @@ func TestNewRootState_PopulateTFState(t *testing.T) {
 	fs, err := filesystem.NewMemFS(rootModPath, nil)
 	require.NoError(t, err)
 
-	root, err := state.NewRootState(tf, fs, rootModPath)
+	root, err := state.NewRootState(tf, fs, rootModPath, state.Option{})
 	require.NoError(t, err)
 
 	mod0 := root.ModuleStates["testdata/nested_modules"]
@@ -380,6 +382,16 @@ func TestNewRootState_PopulateTFState(t *testing.T) {
 	require.Len(t, mod2.TFStateResources, 2)
 	require.NotNil(t, mod2.TFStateResources["azurerm_resource_group.test"])
 	require.NotNil(t, mod2.TFStateResources["data.azurerm_resource_group.test"])
+
+	// The indexed resource instances are only populated in the TFStateResourceInstances
+	require.Len(t, mod0.TFStateResourceInstances, 2)
+	require.Len(t, mod0.TFStateResourceInstances["data.azurerm_resource_group.test"], 1)
+	insts := mod0.TFStateResourceInstances["azurerm_resource_group.test"]
+	require.Len(t, insts, 2)
+	require.NotNil(t, insts["azurerm_resource_group.test[0]"])
+	require.NotNil(t, insts["azurerm_resource_group.test[1]"])
+	require.Len(t, mod2.TFStateResourceInstances["azurerm_resource_group.test"], 1)
+	require.NotNil(t, mod2.TFStateResourceInstances["azurerm_resource_group.test"]["module.test.module.test.azurerm_resource_group.test"])
 }
 
 func TestNewRootState_RemoteModule(t *testing.T) {
@@ -392,6 +404,129 @@ func TestNewRootState_RemoteModule(t *testing.T) {
 	fs, err := filesystem.NewMemFS(rootModPath, nil)
 	require.NoError(t, err)
 
-	_, err = state.NewRootState(tf, fs, rootModPath)
+	_, err = state.NewRootState(tf, fs, rootModPath, state.Option{})
+	require.NoError(t, err)
+}
+
+func TestNewRootState_ProviderSchemas(t *testing.T) {
+	rootModPath := "testdata/nested_modules"
+
+	fs, err := filesystem.NewMemFS(rootModPath, nil)
+	require.NoError(t, err)
+
+	rgSchema := &tfjson.Schema{
+		Block: &tfjson.SchemaBlock{
+			Attributes: map[string]*tfjson.SchemaAttribute{
+				"name":     {AttributeType: cty.String, Required: true},
+				"location": {AttributeType: cty.String, Optional: true, Computed: true},
+			},
+		},
+	}
+	// No terraform is used when the provider schemas are specified
+	root, err := state.NewRootState(nil, fs, rootModPath, state.Option{
+		StateFile: filepath.Join(rootModPath, "terraform.tfstate"),
+		ProviderSchemas: &tfjson.ProviderSchemas{
+			FormatVersion: "1.0",
+			Schemas: map[string]*tfjson.ProviderSchema{
+				"registry.terraform.io/hashicorp/azurerm": {
+					ConfigSchema:      &tfjson.Schema{Block: &tfjson.SchemaBlock{}},
+					ResourceSchemas:   map[string]*tfjson.Schema{"azurerm_resource_group": rgSchema},
+					DataSourceSchemas: map[string]*tfjson.Schema{"azurerm_resource_group": rgSchema},
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	mod0 := root.ModuleStates["testdata/nested_modules"]
+	require.Len(t, mod0.TFStateResources, 1)
+	require.NotNil(t, mod0.TFStateResources["data.azurerm_resource_group.test"])
+	insts := mod0.TFStateResourceInstances["azurerm_resource_group.test"]
+	require.Len(t, insts, 2)
+	require.NotNil(t, insts["azurerm_resource_group.test[1]"])
+	mod2 := root.ModuleStates["testdata/nested_modules/module/module"]
+	require.Len(t, mod2.TFStateResources, 2)
+	require.Equal(t, []string{"module.test.module.test"}, mod2.Addrs)
+	require.NotNil(t, mod2.TFStateResourceInstances["azurerm_resource_group.test"]["module.test.module.test.azurerm_resource_group.test"])
+}
+
+func TestNewRootState_SharedModule(t *testing.T) {
+	rootModPath := "testdata/shared_module"
+
+	fs, err := filesystem.NewMemFS(rootModPath, nil)
+	require.NoError(t, err)
+
+	rgSchema := &tfjson.Schema{
+		Block: &tfjson.SchemaBlock{
+			Attributes: map[string]*tfjson.SchemaAttribute{
+				"name":     {AttributeType: cty.String, Required: true},
+				"location": {AttributeType: cty.String, Optional: true, Computed: true},
+			},
+		},
+	}
+	root, err := state.NewRootState(nil, fs, rootModPath, state.Option{
+		StateFile: filepath.Join(rootModPath, "terraform.tfstate"),
+		ProviderSchemas: &tfjson.ProviderSchemas{
+			FormatVersion: "1.0",
+			Schemas: map[string]*tfjson.ProviderSchema{
+				"registry.terraform.io/hashicorp/azurerm": {
+					ConfigSchema:    &tfjson.Schema{Block: &tfjson.SchemaBlock{}},
+					ResourceSchemas: map[string]*tfjson.Schema{"azurerm_resource_group": rgSchema},
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, root.ModuleStates, 3)
+
+	// The module called by both module calls has the instances of both, while none of them is the unique one.
+	mod := root.ModuleStates["testdata/shared_module/module"]
+	require.Equal(t, []string{"module.a", "module.b"}, mod.Addrs)
+	require.Empty(t, mod.TFStateResources)
+	insts := mod.TFStateResourceInstances["azurerm_resource_group.test"]
+	require.Len(t, insts, 2)
+	require.Equal(t, "terrafix-test-a", insts["module.a.azurerm_resource_group.test"].AttributeValues["name"])
+	require.Equal(t, "terrafix-test-b", insts["module.b.azurerm_resource_group.test"].AttributeValues["name"])
+
+	// So is its descendant module
+	inner := root.ModuleStates["testdata/shared_module/module/inner"]
+	require.Equal(t, []string{"module.a.module.inner", "module.b.module.inner"}, inner.Addrs)
+	require.Empty(t, inner.TFStateResources)
+	insts = inner.TFStateResourceInstances["azurerm_resource_group.test"]
+	require.Len(t, insts, 2)
+	require.NotNil(t, insts["module.a.module.inner.azurerm_resource_group.test"])
+	require.NotNil(t, insts["module.b.module.inner.azurerm_resource_group.test"])
+}
+
+func TestNewRootState_MissingModule(t *testing.T) {
+	rootModPath := "testdata/missing_module"
+
+	fs, err := filesystem.NewMemFS(rootModPath, nil)
+	require.NoError(t, err)
+
+	opt := state.Option{
+		ProviderSchemas: &tfjson.ProviderSchemas{
+			FormatVersion: "1.0",
+			Schemas: map[string]*tfjson.ProviderSchema{
+				"registry.terraform.io/hashicorp/azurerm": {
+					ConfigSchema: &tfjson.Schema{Block: &tfjson.SchemaBlock{}},
+				},
+			},
+		},
+	}
+	_, err = state.NewRootState(nil, fs, rootModPath, opt)
+	require.ErrorContains(t, err, "module call module.missing: ")
+	require.ErrorContains(t, err, `module call module.not_dir: the module path "testdata/missing_module/not_dir.tf" is not a directory`)
+
+	// The failed module calls are skipped in the keep-going mode
+	opt.KeepGoing = true
+	root, err := state.NewRootState(nil, fs, rootModPath, opt)
 	require.NoError(t, err)
+	require.Equal(t, []string{"testdata/missing_module", "testdata/missing_module/module"}, root.ModulePaths())
+	require.Len(t, root.ModuleCallErrors, 2)
+	require.Equal(t, "testdata/missing_module/not_exist", root.ModuleCallErrors[0].Path)
+	require.Equal(t, "module.missing", root.ModuleCallErrors[0].Addr)
+	require.Equal(t, "testdata/missing_module/not_dir.tf", root.ModuleCallErrors[1].Path)
+	require.Equal(t, "module.not_dir", root.ModuleCallErrors[1].Addr)
+	require.EqualError(t, root.ModuleCallErrors[1].Err, `the module path "testdata/missing_module/not_dir.tf" is not a directory`)
 }
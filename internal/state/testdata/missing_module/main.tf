@@ -0,0 +1,11 @@
+module "exist" {
+  source = "./module"
+}
+
+module "missing" {
+  source = "./not_exist"
+}
+
+module "not_dir" {
+  source = "./not_dir.tf"
+}
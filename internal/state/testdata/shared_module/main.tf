@@ -0,0 +1,7 @@
+module "a" {
+  source = "./module"
+}
+
+module "b" {
+  source = "./module"
+}
@@ -0,0 +1,4 @@
+resource "azurerm_resource_group" "test" {
+  name     = "terrafix-test-inner"
+  location = "westus2"
+}
@@ -0,0 +1,8 @@
+resource "azurerm_resource_group" "test" {
+  name     = "terrafix-test-mod"
+  location = "westus2"
+}
+
+module "inner" {
+  source = "./inner"
+}
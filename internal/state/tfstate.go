@@ -0,0 +1,299 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/terraform-exec/tfexec"
+	tfjson "github.com/hashicorp/terraform-json"
+	"github.com/magodo/terrafix/internal/terraform/datadir"
+)
+
+// loadTFState loads the terraform state of the root module.
+//
+// If the opt.StateFile is specified, the state is read from that file. Otherwise, the state is read from
+// the backend configured by the root module (which defaults to the local backend), in the workspace
+// specified by opt.Workspace, or the currently selected workspace if not specified.
+//
+// The workspace is never selected, so that the workspace selected by the user is untouched (see workspaceTerraform).
+//
+// If the opt.ProviderSchemas is specified, terraform is not used. The state is only read from the opt.StateFile
+// (if specified) by parsing it directly, otherwise there is no state.
+func loadTFState(ctx context.Context, tf *tfexec.Terraform, opt Option) (*tfjson.State, error) {
+	if opt.ProviderSchemas != nil {
+		if opt.StateFile == "" {
+			return nil, nil
+		}
+		b, err := os.ReadFile(opt.StateFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading state file %q: %v", opt.StateFile, err)
+		}
+		tfstate, err := ParseStateFile(b)
+		if err != nil {
+			return nil, fmt.Errorf("parsing state file %q: %v", opt.StateFile, err)
+		}
+		return tfstate, nil
+	}
+
+	if opt.StateFile != "" {
+		// The terraform command runs in the root module, resolve the path against the current working directory instead.
+		path, err := filepath.Abs(opt.StateFile)
+		if err != nil {
+			return nil, err
+		}
+		tfstate, err := tf.ShowStateFile(ctx, path)
+		if err != nil {
+			return nil, fmt.Errorf("showing state file %q: %v", opt.StateFile, err)
+		}
+		return tfstate, nil
+	}
+
+	if opt.Workspace != "" {
+		wtf, cleanup, err := workspaceTerraform(ctx, tf, opt.Workspace)
+		if err != nil {
+			return nil, err
+		}
+		defer cleanup()
+		tf = wtf
+	}
+
+	tfstate, err := tf.Show(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("showing state: %v", err)
+	}
+	return tfstate, nil
+}
+
+// workspaceTerraform returns a terraform of the same working directory and executable as tf, which runs in the
+// workspace without changing the workspace selected by the user.
+//
+// As tfexec doesn't allow TF_WORKSPACE, it runs with a throwaway data dir (TF_DATA_DIR), which links to the entries
+// of the original data dir, except for the "environment" file that records the selected workspace.
+// The returned function removes the throwaway data dir.
+func workspaceTerraform(ctx context.Context, tf *tfexec.Terraform, workspace string) (*tfexec.Terraform, func(), error) {
+	workspaces, _, err := tf.WorkspaceList(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("listing workspaces: %v", err)
+	}
+	if !slices.Contains(workspaces, workspace) {
+		return nil, nil, fmt.Errorf("workspace %q doesn't exist", workspace)
+	}
+
+	dataDir := os.Getenv("TF_DATA_DIR")
+	if dataDir == "" {
+		dataDir = datadir.DataDirName
+	}
+	if !filepath.IsAbs(dataDir) {
+		dataDir = filepath.Join(tf.WorkingDir(), dataDir)
+	}
+	tmpDir, err := newWorkspaceDataDir(dataDir, workspace)
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating the data dir for workspace %q: %v", workspace, err)
+	}
+	cleanup := func() { os.RemoveAll(tmpDir) }
+
+	wtf, err := tfexec.NewTerraform(tf.WorkingDir(), tf.ExecPath())
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	env := map[string]string{}
+	for _, kv := range os.Environ() {
+		k, v, _ := strings.Cut(kv, "=")
+		env[k] = v
+	}
+	env = tfexec.CleanEnv(env)
+	env["TF_DATA_DIR"] = tmpDir
+	if err := wtf.SetEnv(env); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return wtf, cleanup, nil
+}
+
+// newWorkspaceDataDir creates a temporary terraform data dir that selects the workspace, and links to the entries of
+// the dataDir (if exists) otherwise.
+func newWorkspaceDataDir(dataDir, workspace string) (string, error) {
+	tmpDir, err := os.MkdirTemp("", "terrafix-data-dir-")
+	if err != nil {
+		return "", err
+	}
+	entries, err := os.ReadDir(dataDir)
+	if err != nil && !os.IsNotExist(err) {
+		os.RemoveAll(tmpDir)
+		return "", err
+	}
+	for _, entry := range entries {
+		if entry.Name() == "environment" {
+			continue
+		}
+		if err := os.Symlink(filepath.Join(dataDir, entry.Name()), filepath.Join(tmpDir, entry.Name())); err != nil {
+			os.RemoveAll(tmpDir)
+			return "", err
+		}
+	}
+	if err := os.WriteFile(filepath.Join(tmpDir, "environment"), []byte(workspace), 0644); err != nil {
+		os.RemoveAll(tmpDir)
+		return "", err
+	}
+	return tmpDir, nil
+}
+
+// rawState is the raw terraform state (e.g. pulled by "terraform state pull"), in the format version 4.
+type rawState struct {
+	Version          int           `json:"version"`
+	TerraformVersion string        `json:"terraform_version"`
+	Resources        []rawResource `json:"resources"`
+}
+
+type rawResource struct {
+	Module    string        `json:"module"`
+	Mode      string        `json:"mode"`
+	Type      string        `json:"type"`
+	Name      string        `json:"name"`
+	Provider  string        `json:"provider"`
+	Instances []rawInstance `json:"instances"`
+}
+
+type rawInstance struct {
+	IndexKey      interface{}            `json:"index_key"`
+	Deposed       string                 `json:"deposed"`
+	SchemaVersion uint64                 `json:"schema_version"`
+	Attributes    map[string]interface{} `json:"attributes"`
+	DependsOn     []string               `json:"dependencies"`
+	Status        string                 `json:"status"`
+}
+
+// ParseStateFile parses the content of a state file without terraform. The content can be either the output of
+// "terraform show -json", or a raw state (e.g. pulled by "terraform state pull") in the format version 4,
+// which is converted to the former. The deposed instances of the raw state are ignored.
+func ParseStateFile(b []byte) (*tfjson.State, error) {
+	var probe struct {
+		FormatVersion string `json:"format_version"`
+	}
+	if err := json.Unmarshal(b, &probe); err != nil {
+		return nil, err
+	}
+	if probe.FormatVersion != "" {
+		var tfstate tfjson.State
+		if err := json.Unmarshal(b, &tfstate); err != nil {
+			return nil, err
+		}
+		return &tfstate, nil
+	}
+
+	var raw rawState
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, err
+	}
+	if raw.Version != 4 {
+		return nil, fmt.Errorf("unsupported state format version %d", raw.Version)
+	}
+
+	root := &tfjson.StateModule{}
+	modules := map[string]*tfjson.StateModule{"": root}
+	var moduleFor func(addr string) *tfjson.StateModule
+	moduleFor = func(addr string) *tfjson.StateModule {
+		if mod, ok := modules[addr]; ok {
+			return mod
+		}
+		parent := moduleFor(parentModuleAddr(addr))
+		mod := &tfjson.StateModule{Address: addr}
+		parent.ChildModules = append(parent.ChildModules, mod)
+		modules[addr] = mod
+		return mod
+	}
+
+	for _, res := range raw.Resources {
+		mod := moduleFor(res.Module)
+		relAddr := res.Type + "." + res.Name
+		mode := tfjson.ManagedResourceMode
+		if res.Mode == "data" {
+			relAddr = "data." + relAddr
+			mode = tfjson.DataResourceMode
+		}
+		if res.Module != "" {
+			relAddr = res.Module + "." + relAddr
+		}
+		for _, inst := range res.Instances {
+			if inst.Deposed != "" {
+				continue
+			}
+			addr := relAddr
+			index := inst.IndexKey
+			switch key := inst.IndexKey.(type) {
+			case float64:
+				addr += "[" + strconv.FormatFloat(key, 'f', -1, 64) + "]"
+			case string:
+				addr += "[" + strconv.Quote(key) + "]"
+			case nil:
+			default:
+				return nil, fmt.Errorf("invalid index key %v of %s", key, relAddr)
+			}
+			mod.Resources = append(mod.Resources, &tfjson.StateResource{
+				Address:         addr,
+				Mode:            mode,
+				Type:            res.Type,
+				Name:            res.Name,
+				Index:           index,
+				ProviderName:    providerName(res.Provider),
+				SchemaVersion:   inst.SchemaVersion,
+				AttributeValues: inst.Attributes,
+				DependsOn:       inst.DependsOn,
+				Tainted:         inst.Status == "tainted",
+			})
+		}
+	}
+
+	return &tfjson.State{
+		FormatVersion:    "1.0",
+		TerraformVersion: raw.TerraformVersion,
+		Values:           &tfjson.StateValues{RootModule: root},
+	}, nil
+}
+
+// parentModuleAddr returns the address of the parent module, e.g. module.a[0] for module.a[0].module.b["x"].
+// It returns "" for the child of the root module.
+func parentModuleAddr(addr string) string {
+	depth, quoted := 0, false
+	last := -1
+	for i := 0; i < len(addr); i++ {
+		switch c := addr[i]; {
+		case quoted:
+			if c == '\\' {
+				i++
+			} else if c == '"' {
+				quoted = false
+			}
+		case c == '"':
+			quoted = true
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		case c == '.' && depth == 0 && strings.HasPrefix(addr[i+1:], "module."):
+			last = i
+		}
+	}
+	if last == -1 {
+		return ""
+	}
+	return addr[:last]
+}
+
+// providerName returns the provider's address from the provider configuration address of the raw state,
+// e.g. registry.terraform.io/hashicorp/azurerm for provider["registry.terraform.io/hashicorp/azurerm"].alias.
+func providerName(addr string) string {
+	_, rest, ok := strings.Cut(addr, `provider["`)
+	if !ok {
+		return addr
+	}
+	name, _, _ := strings.Cut(rest, `"]`)
+	return name
+}
@@ -0,0 +1,43 @@
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewWorkspaceDataDir(t *testing.T) {
+	dataDir := filepath.Join(t.TempDir(), ".terraform")
+	require.NoError(t, os.MkdirAll(filepath.Join(dataDir, "providers"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dataDir, "terraform.tfstate"), []byte("backend"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dataDir, "environment"), []byte("default"), 0644))
+
+	tmpDir, err := newWorkspaceDataDir(dataDir, "staging")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	b, err := os.ReadFile(filepath.Join(tmpDir, "environment"))
+	require.NoError(t, err)
+	require.Equal(t, "staging", string(b))
+	b, err = os.ReadFile(filepath.Join(tmpDir, "terraform.tfstate"))
+	require.NoError(t, err)
+	require.Equal(t, "backend", string(b))
+	fi, err := os.Stat(filepath.Join(tmpDir, "providers"))
+	require.NoError(t, err)
+	require.True(t, fi.IsDir())
+
+	// The selected workspace of the original data dir is untouched
+	b, err = os.ReadFile(filepath.Join(dataDir, "environment"))
+	require.NoError(t, err)
+	require.Equal(t, "default", string(b))
+
+	// A data dir that doesn't exist yet
+	tmpDir2, err := newWorkspaceDataDir(filepath.Join(t.TempDir(), ".terraform"), "staging")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir2)
+	b, err = os.ReadFile(filepath.Join(tmpDir2, "environment"))
+	require.NoError(t, err)
+	require.Equal(t, "staging", string(b))
+}
@@ -0,0 +1,208 @@
+// Package validate validates the fixed blocks against the schema of the new provider.
+package validate
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	tfjson "github.com/hashicorp/terraform-json"
+)
+
+// metaArguments are the meta-arguments (attributes and blocks) that are allowed in the top-level block of each type,
+// in addition to the ones defined by the schema.
+var metaArguments = map[string]struct {
+	attrs  map[string]bool
+	blocks map[string]bool
+}{
+	"provider": {
+		attrs: map[string]bool{"alias": true, "version": true},
+	},
+	"resource": {
+		attrs:  map[string]bool{"count": true, "for_each": true, "provider": true, "depends_on": true},
+		blocks: map[string]bool{"lifecycle": true, "provisioner": true, "connection": true},
+	},
+	"data": {
+		attrs:  map[string]bool{"count": true, "for_each": true, "provider": true, "depends_on": true},
+		blocks: map[string]bool{"lifecycle": true},
+	},
+}
+
+// ParseBlock parses the content, which is expected to be exactly one top-level block in native syntax.
+// The positions of the block are based on the start position in the file named filename.
+func ParseBlock(content []byte, filename string, start hcl.Pos) (*hclsyntax.Block, hcl.Diagnostics) {
+	f, diags := hclsyntax.ParseConfig(content, filename, start)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	body := f.Body.(*hclsyntax.Body)
+	if len(body.Attributes) != 0 || len(body.Blocks) != 1 {
+		return nil, hcl.Diagnostics{{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid block",
+			Detail:   "Expects exactly one block.",
+			Subject:  body.SrcRange.Ptr(),
+		}}
+	}
+	return body.Blocks[0], nil
+}
+
+// Block validates the top-level provider/resource/data source block against its schema, including:
+//
+//   - The attributes and nested blocks are defined by the schema (or are meta-arguments)
+//   - The required attributes are set, while the computed only attributes are not
+//   - The number of the nested blocks of each type matches its nesting mode and min/max items
+//
+// The nested blocks generated by "dynamic" blocks are validated by their content, but not counted.
+func Block(blk *hclsyntax.Block, sch *tfjson.SchemaBlock) hcl.Diagnostics {
+	meta := metaArguments[blk.Type]
+	return validateBody(blk.Body, sch, meta.attrs, meta.blocks)
+}
+
+func validateBody(body *hclsyntax.Body, sch *tfjson.SchemaBlock, metaAttrs, metaBlocks map[string]bool) hcl.Diagnostics {
+	var diags hcl.Diagnostics
+
+	for _, attr := range sortedAttributes(body) {
+		if metaAttrs[attr.Name] {
+			continue
+		}
+		asch, ok := sch.Attributes[attr.Name]
+		if !ok {
+			detail := fmt.Sprintf("An argument named %q is not expected here.", attr.Name)
+			if _, ok := sch.NestedBlocks[attr.Name]; ok {
+				detail += fmt.Sprintf(" Did you mean to define a block of type %q?", attr.Name)
+			}
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Unsupported argument",
+				Detail:   detail,
+				Subject:  attr.NameRange.Ptr(),
+			})
+			continue
+		}
+		if asch.Computed && !asch.Optional && !asch.Required {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid argument",
+				Detail:   fmt.Sprintf("The argument %q is read-only and can't be configured.", attr.Name),
+				Subject:  attr.NameRange.Ptr(),
+			})
+		}
+	}
+
+	var names []string
+	for name := range sch.Attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !sch.Attributes[name].Required {
+			continue
+		}
+		if _, ok := body.Attributes[name]; ok {
+			continue
+		}
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Missing required argument",
+			Detail:   fmt.Sprintf("The argument %q is required, but no definition was found.", name),
+			Subject:  body.MissingItemRange().Ptr(),
+		})
+	}
+
+	counts := map[string]int{}
+	dynamics := map[string]bool{}
+	for _, blk := range body.Blocks {
+		if metaBlocks[blk.Type] {
+			continue
+		}
+		if blk.Type == "dynamic" {
+			if len(blk.Labels) != 1 {
+				continue
+			}
+			bsch, ok := sch.NestedBlocks[blk.Labels[0]]
+			if !ok {
+				diags = append(diags, unsupportedBlock(blk.Labels[0], blk.LabelRanges[0]))
+				continue
+			}
+			dynamics[blk.Labels[0]] = true
+			for _, cblk := range blk.Body.Blocks {
+				if cblk.Type == "content" && bsch.Block != nil {
+					diags = append(diags, validateBody(cblk.Body, bsch.Block, nil, nil)...)
+				}
+			}
+			continue
+		}
+		bsch, ok := sch.NestedBlocks[blk.Type]
+		if !ok {
+			diags = append(diags, unsupportedBlock(blk.Type, blk.TypeRange))
+			continue
+		}
+		counts[blk.Type]++
+		if max := maxItems(bsch); max > 0 && counts[blk.Type] > max {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Too many blocks",
+				Detail:   fmt.Sprintf("No more than %d %q blocks are allowed.", max, blk.Type),
+				Subject:  blk.TypeRange.Ptr(),
+			})
+		}
+		if bsch.Block != nil {
+			diags = append(diags, validateBody(blk.Body, bsch.Block, nil, nil)...)
+		}
+	}
+
+	names = nil
+	for name := range sch.NestedBlocks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		bsch := sch.NestedBlocks[name]
+		if dynamics[name] || counts[name] >= int(bsch.MinItems) {
+			continue
+		}
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Insufficient blocks",
+			Detail:   fmt.Sprintf("At least %d %q blocks are required.", bsch.MinItems, name),
+			Subject:  body.MissingItemRange().Ptr(),
+		})
+	}
+
+	return diags
+}
+
+// maxItems returns the max number of the blocks of the block type, or 0 if it is unlimited.
+func maxItems(bsch *tfjson.SchemaBlockType) int {
+	switch bsch.NestingMode {
+	case tfjson.SchemaNestingModeSingle, tfjson.SchemaNestingModeGroup:
+		return 1
+	case tfjson.SchemaNestingModeMap:
+		return 0
+	default:
+		return int(bsch.MaxItems)
+	}
+}
+
+func unsupportedBlock(typ string, rng hcl.Range) *hcl.Diagnostic {
+	return &hcl.Diagnostic{
+		Severity: hcl.DiagError,
+		Summary:  "Unsupported block type",
+		Detail:   fmt.Sprintf("Blocks of type %q are not expected here.", typ),
+		Subject:  rng.Ptr(),
+	}
+}
+
+// sortedAttributes returns the attributes of the body, ordered by their positions.
+func sortedAttributes(body *hclsyntax.Body) []*hclsyntax.Attribute {
+	var attrs []*hclsyntax.Attribute
+	for _, attr := range body.Attributes {
+		attrs = append(attrs, attr)
+	}
+	sort.Slice(attrs, func(i, j int) bool {
+		return attrs[i].SrcRange.Start.Byte < attrs[j].SrcRange.Start.Byte
+	})
+	return attrs
+}
@@ -0,0 +1,128 @@
+package validate_test
+
+import (
+	"testing"
+
+	"github.com/hashicorp/hcl/v2"
+	tfjson "github.com/hashicorp/terraform-json"
+	"github.com/magodo/terrafix/internal/validate"
+	"github.com/stretchr/testify/require"
+)
+
+var testSchema = &tfjson.SchemaBlock{
+	Attributes: map[string]*tfjson.SchemaAttribute{
+		"id":       {Computed: true},
+		"name":     {Required: true},
+		"location": {Required: true},
+		"tags":     {Optional: true},
+	},
+	NestedBlocks: map[string]*tfjson.SchemaBlockType{
+		"identity": {
+			NestingMode: tfjson.SchemaNestingModeList,
+			MinItems:    1,
+			MaxItems:    1,
+			Block: &tfjson.SchemaBlock{
+				Attributes: map[string]*tfjson.SchemaAttribute{
+					"type": {Required: true},
+				},
+			},
+		},
+		"rule": {
+			NestingMode: tfjson.SchemaNestingModeSet,
+			Block: &tfjson.SchemaBlock{
+				Attributes: map[string]*tfjson.SchemaAttribute{
+					"ip": {Optional: true},
+				},
+			},
+		},
+	},
+}
+
+func TestBlock(t *testing.T) {
+	cases := []struct {
+		name      string
+		content   string
+		summaries []string
+	}{
+		{
+			name: "valid",
+			content: `resource "foo" "test" {
+  count    = 2
+  name     = "test"
+  location = "westus"
+  identity {
+    type = "SystemAssigned"
+  }
+  dynamic "rule" {
+    for_each = var.rules
+    content {
+      ip = rule.value
+    }
+  }
+  lifecycle {
+    ignore_changes = [tags]
+  }
+}`,
+		},
+		{
+			name: "invalid",
+			content: `resource "foo" "test" {
+  id       = "foo"
+  name     = "test"
+  unknown  = 1
+  identity {
+  }
+  identity {
+    type = "SystemAssigned"
+  }
+  dynamic "not_exist" {
+    content {}
+  }
+  rule {
+    port = 1
+  }
+}`,
+			summaries: []string{
+				"Invalid argument",
+				"Unsupported argument",
+				"Missing required argument",
+				"Missing required argument",
+				"Too many blocks",
+				"Unsupported block type",
+				"Unsupported argument",
+			},
+		},
+		{
+			name: "missing block",
+			content: `resource "foo" "test" {
+  name     = "test"
+  location = "westus"
+}`,
+			summaries: []string{"Insufficient blocks"},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			blk, diags := validate.ParseBlock([]byte(tt.content), "main.tf", hcl.InitialPos)
+			require.False(t, diags.HasErrors(), diags.Error())
+			var summaries []string
+			for _, diag := range validate.Block(blk, testSchema) {
+				require.NotNil(t, diag.Subject)
+				summaries = append(summaries, diag.Summary)
+			}
+			require.Equal(t, tt.summaries, summaries)
+		})
+	}
+}
+
+func TestParseBlock(t *testing.T) {
+	blk, diags := validate.ParseBlock([]byte(`resource "foo" "test" {
+  name = "test"
+}`), "main.tf", hcl.Pos{Line: 10, Column: 1, Byte: 100})
+	require.False(t, diags.HasErrors())
+	require.Equal(t, 11, blk.Body.Attributes["name"].SrcRange.Start.Line)
+
+	_, diags = validate.ParseBlock([]byte(`a = 1`), "main.tf", hcl.InitialPos)
+	require.True(t, diags.HasErrors())
+}
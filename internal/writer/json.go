@@ -0,0 +1,67 @@
+package writer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/magodo/terrafix/internal/jsonconfig"
+)
+
+// UpdateJSONContent is the counterpart of UpdateContent for the configuration in JSON syntax.
+//
+// The Content of each update is in native syntax, which is encoded to JSON in place before being applied:
+//   - For the update whose Range covers a JSON object (i.e. a block body), the Content is expected to be a
+//     top-level block, which is encoded as the JSON object, indented consistently with the original content.
+//   - Otherwise, the Range is expected to be within a JSON string (e.g. a reference origin inside a template),
+//     and the Content is escaped as a part of the JSON string.
+//
+// The updated content is ensured to be a valid JSON.
+func UpdateJSONContent(b []byte, updates Updates) ([]byte, error) {
+	indent := detectIndent(b)
+	for i, update := range updates {
+		start := update.Range.Start.Byte
+		if start >= len(b) {
+			return nil, fmt.Errorf("update exceeded the raw content length: %s", update.Range)
+		}
+		if b[start] != '{' {
+			updates[i].Content = jsonconfig.EscapeString(string(update.Content))
+			continue
+		}
+		content, err := jsonconfig.BlockFromNative(update.Content, linePrefix(b, start), indent)
+		if err != nil {
+			return nil, fmt.Errorf("encoding the update of %s to JSON: %v", update.Range, err)
+		}
+		updates[i].Content = content
+	}
+	nb, err := UpdateContent(b, updates)
+	if err != nil {
+		return nil, err
+	}
+	if !json.Valid(nb) {
+		return nil, fmt.Errorf("the updated content is not a valid JSON")
+	}
+	return nb, nil
+}
+
+// linePrefix returns the leading whitespaces of the line that contains the offset.
+func linePrefix(b []byte, offset int) string {
+	lineStart := bytes.LastIndexByte(b[:offset], '\n') + 1
+	end := lineStart
+	for end < offset && (b[end] == ' ' || b[end] == '\t') {
+		end++
+	}
+	return string(b[lineStart:end])
+}
+
+// detectIndent returns the indentation used by the JSON content, which is the leading whitespaces
+// of the first indented line. It defaults to two spaces.
+func detectIndent(b []byte) string {
+	for _, line := range bytes.Split(b, []byte("\n")) {
+		trimmed := bytes.TrimLeft(line, " \t")
+		if len(trimmed) != len(line) && len(trimmed) != 0 {
+			return string(line[:len(line)-len(trimmed)])
+		}
+	}
+	return "  "
+}
@@ -1,8 +1,10 @@
 package writer
 
 import (
+	"bytes"
 	"fmt"
 	"sort"
+	"unicode/utf8"
 
 	"github.com/hashicorp/hcl/v2"
 )
@@ -50,3 +52,35 @@ func UpdateContent(b []byte, updates Updates) ([]byte, error) {
 	nb = append(nb, b[startOffset:]...)
 	return nb, nil
 }
+
+// UpdatedRanges returns the range of each update's content in the new content nb, which is the result of
+// UpdateContent on the (sorted) updates.
+func UpdatedRanges(nb []byte, updates Updates) []hcl.Range {
+	var (
+		out   []hcl.Range
+		delta int
+	)
+	for _, update := range updates {
+		start := update.Range.Start.Byte + delta
+		end := start + len(update.Content)
+		out = append(out, hcl.Range{
+			Filename: update.Range.Filename,
+			Start:    PosAt(nb, start),
+			End:      PosAt(nb, end),
+		})
+		delta += len(update.Content) - (update.Range.End.Byte - update.Range.Start.Byte)
+	}
+	return out
+}
+
+// PosAt returns the position of the byte offset in b.
+func PosAt(b []byte, offset int) hcl.Pos {
+	offset = min(offset, len(b))
+	line := bytes.Count(b[:offset], []byte("\n")) + 1
+	lineStart := bytes.LastIndexByte(b[:offset], '\n') + 1
+	return hcl.Pos{
+		Line:   line,
+		Column: utf8.RuneCount(b[lineStart:offset]) + 1,
+		Byte:   offset,
+	}
+}
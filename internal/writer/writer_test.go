@@ -84,3 +84,74 @@ func TestUpdateContent(t *testing.T) {
 		})
 	}
 }
+
+func TestUpdateJSONContent(t *testing.T) {
+	b := []byte(`{
+  "resource": {
+    "foo": {
+      "test": {
+        "a": "${foo.bar.old}"
+      }
+    }
+  }
+}
+`)
+	updates := writer.Updates{
+		{
+			// The JSON object of the block body
+			Range: hcl.Range{
+				Start: hcl.Pos{Byte: 45},
+				End:   hcl.Pos{Byte: 84},
+			},
+			Content: []byte(`resource "foo" "test" {
+  a = foo.bar.new
+  b = ["x"]
+}`),
+		},
+	}
+	nb, err := writer.UpdateJSONContent(b, updates)
+	require.NoError(t, err)
+	require.Equal(t, `{
+  "resource": {
+    "foo": {
+      "test": {
+        "a": "${foo.bar.new}",
+        "b": [
+          "x"
+        ]
+      }
+    }
+  }
+}
+`, string(nb))
+	require.Equal(t, nb[45:len(nb)-13], updates[0].Content)
+
+	// The reference origin inside the JSON string
+	nb, err = writer.UpdateJSONContent(b, writer.Updates{
+		{
+			Range: hcl.Range{
+				Start: hcl.Pos{Byte: 63},
+				End:   hcl.Pos{Byte: 74},
+			},
+			Content: []byte(`foo.bar["new"]`),
+		},
+	})
+	require.NoError(t, err)
+	require.Contains(t, string(nb), `"a": "${foo.bar[\"new\"]}"`)
+}
+
+func TestUpdatedRanges(t *testing.T) {
+	b := []byte("a = 1\nb = 2\nc = 3\n")
+	updates := writer.Updates{
+		{Range: hcl.Range{Start: hcl.Pos{Byte: 4}, End: hcl.Pos{Byte: 5}}, Content: []byte("[\n  1,\n]")},
+		{Range: hcl.Range{Start: hcl.Pos{Byte: 16}, End: hcl.Pos{Byte: 17}}, Content: []byte("33")},
+	}
+	nb, err := writer.UpdateContent(b, updates)
+	require.NoError(t, err)
+	rngs := writer.UpdatedRanges(nb, updates)
+	require.Len(t, rngs, 2)
+	require.Equal(t, hcl.Pos{Line: 1, Column: 5, Byte: 4}, rngs[0].Start)
+	require.Equal(t, hcl.Pos{Line: 3, Column: 2, Byte: 12}, rngs[0].End)
+	require.Equal(t, "33", string(rngs[1].SliceBytes(nb)))
+	require.Equal(t, hcl.Pos{Line: 5, Column: 5, Byte: 23}, rngs[1].Start)
+}
@@ -33,14 +33,15 @@ func main() {
 	if err != nil {
 		log.Fatalf("error new memory filesystem: %s", err)
 	}
-	root, err := state.NewRootState(tf, fs, rootModPath)
+	root, err := state.NewRootState(tf, fs, rootModPath, state.Option{})
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	d := root.Decoder()
 
-	for modPath, modState := range root.ModuleStates {
+	for _, modPath := range root.ModulePaths() {
+		modState := root.ModuleStates[modPath]
 		fmt.Printf("\nModule path: %s\n\n", modPath)
 		fmt.Println("Origins:")
 		for _, ref := range modState.OriginRefs {